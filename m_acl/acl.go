@@ -0,0 +1,227 @@
+// Package m_acl implements access control lists of proxy targets.
+//
+// An ACL is an ordered list of rules like
+//
+//	allow 10.1.0.0/16
+//	deny :25
+//	deny example.com
+//	deny *
+//
+// Each rule matches a CIDR or IP, a port or port range, a domain with its
+// subdomains, or anything. The first rule matching a target decides, and
+// targets matching no rule are allowed.
+package m_acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrDenied means a target is denied by ACL
+var ErrDenied = errors.New("acl: target denied")
+
+// DefaultDeny is the list of loopback, link-local, private, multicast,
+// broadcast, reserved and cloud metadata ranges, which are denied after
+// configured rules unless disabled.
+var DefaultDeny = []string{
+	// loopback and unspecified
+	"0.0.0.0/8", "127.0.0.0/8", "::/128", "::1/128",
+	// link-local, including metadata service 169.254.169.254
+	"169.254.0.0/16", "fe80::/10",
+	// private
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+	// shared address space, including metadata service 100.100.100.200
+	"100.64.0.0/10",
+	// multicast
+	"224.0.0.0/4", "ff00::/8",
+	// reserved, including limited broadcast 255.255.255.255
+	"240.0.0.0/4", "255.255.255.255/32",
+	// metadata service by name
+	"metadata.google.internal",
+}
+
+// Matcher matches targets by a CIDR or IP, a port or port range, a domain
+// with its subdomains, or anything.
+type Matcher struct {
+	any    bool
+	ipnet  *net.IPNet
+	domain string
+	portLo int
+	portHi int
+}
+
+// ParseMatcher parses matcher of form "*", "10.0.0.0/8", "10.0.0.1",
+// ":25", ":8000-9000" or "example.com".
+func ParseMatcher(s string) (*Matcher, error) {
+	m := &Matcher{}
+	switch {
+	case s == "*":
+		m.any = true
+	case strings.Contains(s, "/"):
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("acl: bad cidr %q", s)
+		}
+		m.ipnet = ipnet
+	case net.ParseIP(s) != nil:
+		ip := net.ParseIP(s)
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		m.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(s, ":"):
+		lo, hi, err := parsePorts(s[1:])
+		if err != nil {
+			return nil, fmt.Errorf("acl: bad port %q", s)
+		}
+		m.portLo, m.portHi = lo, hi
+	default:
+		m.domain = normalize(s)
+	}
+	return m, nil
+}
+
+// Match reports whether m matches target. ip is nil if target is a domain
+// not resolved.
+func (m *Matcher) Match(host string, ip net.IP, port int) bool {
+	return m.match(normalize(host), ip, port)
+}
+
+// match is Match of normalized host
+func (m *Matcher) match(host string, ip net.IP, port int) bool {
+	switch {
+	case m.any:
+		return true
+	case m.ipnet != nil:
+		return ip != nil && m.ipnet.Contains(ip)
+	case m.domain != "":
+		return host == m.domain || strings.HasSuffix(host, "."+m.domain)
+	}
+	return port >= m.portLo && port <= m.portHi
+}
+
+type rule struct {
+	*Matcher
+	text  string
+	allow bool
+}
+
+// ACL is an ordered list of rules
+type ACL struct {
+	rules []*rule
+}
+
+// New creates an ACL of rules, followed by rules denying DefaultDeny if
+// denyPrivate is true.
+func New(rules []string, denyPrivate bool) (*ACL, error) {
+	a, err := Parse(rules)
+	if err != nil {
+		return nil, err
+	}
+	if denyPrivate {
+		for _, s := range DefaultDeny {
+			r, _ := parseRule("deny " + s)
+			a.rules = append(a.rules, r)
+		}
+	}
+	return a, nil
+}
+
+// Parse parses rules of form "allow|deny matcher".
+func Parse(rules []string) (*ACL, error) {
+	a := &ACL{}
+	for _, s := range rules {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+func parseRule(s string) (*rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("acl: bad rule %q", s)
+	}
+	r := &rule{text: strings.Join(fields, " ")}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("acl: bad action of rule %q", s)
+	}
+
+	m, err := ParseMatcher(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("%v of rule %q", err, s)
+	}
+	r.Matcher = m
+	return r, nil
+}
+
+func parsePorts(s string) (int, int, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	h, err := strconv.Atoi(hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if l < 0 || h > 0xFFFF || l > h {
+		return 0, 0, errors.New("bad port range")
+	}
+	return l, h, nil
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// With returns an ACL checking rules of override before those of a.
+func (a *ACL) With(override *ACL) *ACL {
+	if override == nil || len(override.rules) == 0 {
+		return a
+	}
+	rules := make([]*rule, 0, len(override.rules)+len(a.rules))
+	rules = append(rules, override.rules...)
+	rules = append(rules, a.rules...)
+	return &ACL{rules: rules}
+}
+
+// Check checks target of host and port, which is resolved to ip. ip is nil
+// if host is a domain resolved elsewhere, then only rules of domain, port
+// and anything apply. Error wrapping ErrDenied is returned if denied.
+func (a *ACL) Check(host string, ip net.IP, port int) error {
+	if a == nil {
+		return nil
+	}
+	host = normalize(host)
+	for _, r := range a.rules {
+		if r.match(host, ip, port) {
+			if r.allow {
+				return nil
+			}
+			target := net.JoinHostPort(host, strconv.Itoa(port))
+			if ip != nil && ip.String() != host {
+				target += " (" + ip.String() + ")"
+			}
+			return fmt.Errorf("%w: %s by rule %q", ErrDenied, target, r.text)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package m_acl
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDefaultDeny(t *testing.T) {
+	a, err := New(nil, true)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	for _, ip := range []string{
+		"127.0.0.1", "::1", "169.254.169.254", "10.1.2.3", "172.16.0.1", "192.168.1.1",
+		"fd00::1", "fe80::1", "100.100.100.200", "0.0.0.0", "::ffff:127.0.0.1",
+		"224.0.0.1", "239.255.255.250", "ff02::1", "ff05::1:3", "240.0.0.1", "255.255.255.255",
+	} {
+		if err := a.Check(ip, net.ParseIP(ip), 80); !errors.Is(err, ErrDenied) {
+			t.Errorf("%s: got %v, want denied", ip, err)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888", "172.32.0.1", "223.255.255.255"} {
+		if err := a.Check(ip, net.ParseIP(ip), 80); err != nil {
+			t.Errorf("%s: got %v, want allowed", ip, err)
+		}
+	}
+	if err := a.Check("Metadata.Google.Internal.", nil, 80); !errors.Is(err, ErrDenied) {
+		t.Errorf("metadata domain: got %v, want denied", err)
+	}
+
+	// resolved ip is checked, whatever the domain is
+	if err := a.Check("rebind.example.com", net.ParseIP("127.0.0.1"), 80); !errors.Is(err, ErrDenied) {
+		t.Errorf("rebinding: got %v, want denied", err)
+	}
+}
+
+func TestRuleOrder(t *testing.T) {
+	a, err := New([]string{
+		"allow 10.1.0.0/16",
+		"deny :25",
+		"deny :6000-6100",
+		"deny example.com",
+		"deny 8.8.4.4",
+	}, true)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	for _, c := range []struct {
+		host  string
+		ip    string
+		port  int
+		allow bool
+	}{
+		{"10.1.2.3", "10.1.2.3", 22, true},
+		{"10.1.2.3", "10.1.2.3", 25, true}, // the first match wins
+		{"10.2.0.1", "10.2.0.1", 22, false},
+		{"mail.test", "1.1.1.1", 25, false},
+		{"x11.test", "1.1.1.1", 6050, false},
+		{"x11.test", "1.1.1.1", 6101, true},
+		{"example.com", "1.1.1.1", 443, false},
+		{"www.Example.com", "1.1.1.1", 443, false},
+		{"notexample.com", "1.1.1.1", 443, true},
+		{"8.8.4.4", "8.8.4.4", 53, false},
+		{"8.8.8.8", "8.8.8.8", 53, true},
+	} {
+		err := a.Check(c.host, net.ParseIP(c.ip), c.port)
+		if (err == nil) != c.allow {
+			t.Errorf("%s(%s):%d: got %v, want allow %v", c.host, c.ip, c.port, err, c.allow)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	global, _ := New([]string{"deny :22"}, true)
+	user, err := Parse([]string{"allow 192.168.1.0/24", "allow :22", "deny *"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	a := global.With(user)
+
+	if err := a.Check("192.168.1.5", net.ParseIP("192.168.1.5"), 80); err != nil {
+		t.Errorf("user allowed cidr: %v", err)
+	}
+	if err := a.Check("1.1.1.1", net.ParseIP("1.1.1.1"), 22); err != nil {
+		t.Errorf("user allowed port: %v", err)
+	}
+	if err := a.Check("1.1.1.1", net.ParseIP("1.1.1.1"), 80); !errors.Is(err, ErrDenied) {
+		t.Errorf("user deny all: got %v", err)
+	}
+	if err := global.Check("192.168.1.5", net.ParseIP("192.168.1.5"), 80); !errors.Is(err, ErrDenied) {
+		t.Errorf("global is changed by override: %v", err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, s := range []string{"allow", "permit 1.2.3.4", "deny 10.0.0.0/33", "deny :70000", "deny :20-10", "allow a b"} {
+		if _, err := Parse([]string{s}); err == nil {
+			t.Errorf("%q: parse should fail", s)
+		}
+	}
+}
@@ -86,6 +86,13 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 
 type aeadCipher struct{ m_shadow.Cipher }
 
+// IsAEAD reports whether c is an AEAD cipher, which Identify can tell apart
+// from others.
+func IsAEAD(c Cipher) bool {
+	_, ok := c.(*aeadCipher)
+	return ok
+}
+
 func (aead *aeadCipher) StreamConn(c net.Conn) net.Conn { return m_shadow.NewConn(c, aead) }
 func (aead *aeadCipher) PacketConn(c net.PacketConn) net.PacketConn {
 	return m_shadow.NewPacketConn(c, aead)
@@ -112,3 +119,17 @@ func kdf(password string, keyLen int) []byte {
 	}
 	return b[:keyLen]
 }
+
+// Identify finds out which one of ciphers enciphers the stream read from c,
+// see m_shadow.Identify. Only AEAD ciphers can be identified.
+func Identify(c net.Conn, ciphers []Cipher) (int, net.Conn, error) {
+	list := make([]m_shadow.Cipher, len(ciphers))
+	for i, ciph := range ciphers {
+		aead, ok := ciph.(*aeadCipher)
+		if !ok {
+			return -1, c, ErrCipherNotSupported
+		}
+		list[i] = aead.Cipher
+	}
+	return m_shadow.Identify(c, list)
+}
@@ -0,0 +1,80 @@
+// Package m_dialer implements outbound dialers, which connect directly or
+// through a chain of HTTP CONNECT and SOCKS5 proxies.
+package m_dialer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// handshakeTimeout is the max time of handshake with a proxy
+const handshakeTimeout = 10 * time.Second
+
+var (
+	ErrSchemeNotSupported = errors.New("dialer: proxy scheme not supported")
+	ErrBadAddr            = errors.New("dialer: bad address")
+)
+
+// Dialer connects to address on the named network
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// IPDialer connects to one of IPs resolved for address, so that IPs can be
+// checked before connecting. Dialers created by NewDirect implement it.
+type IPDialer interface {
+	DialIPs(network, addr string, ips []net.IP) (net.Conn, error)
+}
+
+// Direct connects to address directly
+var Direct Dialer = &net.Dialer{}
+
+// FromURL creates a dialer connecting through proxy u, which is dialed by
+// forward. Supported schemes are http and socks5, with optional user info
+// for authentication.
+func FromURL(u *url.URL, forward Dialer) (Dialer, error) {
+	var user, pass string
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return &httpProxy{addr: hostPort(u, "80"), user: user, pass: pass, forward: forward}, nil
+	case "socks5", "socks5h":
+		return &socks5Proxy{addr: hostPort(u, "1080"), user: user, pass: pass, forward: forward}, nil
+	}
+	return nil, ErrSchemeNotSupported
+}
+
+// Chain creates a dialer connecting through proxies in comma separated URL
+// list, the first one is dialed by direct. direct is returned if list is
+// empty.
+func Chain(direct Dialer, list string) (Dialer, error) {
+	d := direct
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("dialer: proxy %q: %v", s, err)
+		}
+		if d, err = FromURL(u, d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
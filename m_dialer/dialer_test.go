@@ -0,0 +1,221 @@
+package m_dialer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+func listen(t *testing.T, serve func(c net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return l
+}
+
+func echoServer(t *testing.T) net.Listener {
+	return listen(t, func(c net.Conn) { io.Copy(c, c) })
+}
+
+func relay(c net.Conn, addr string) {
+	rc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	go io.Copy(rc, c)
+	io.Copy(c, rc)
+}
+
+// httpProxyServer serves CONNECT requests with basic auth of user:pass
+func httpProxyServer(t *testing.T, user, pass string) net.Listener {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	return listen(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relay(c, req.Host)
+	})
+}
+
+// socks5ProxyServer serves CONNECT requests with username/password auth
+func socks5ProxyServer(t *testing.T, user, pass string) net.Listener {
+	return listen(t, func(c net.Conn) {
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+			return
+		}
+		c.Write([]byte{m_socks.Ver, m_socks.MethodUsernamePassword})
+
+		// VER ULEN UNAME PLEN PASSWD
+		io.ReadFull(c, buf[:2])
+		u := make([]byte, buf[1])
+		io.ReadFull(c, u)
+		io.ReadFull(c, buf[:1])
+		p := make([]byte, buf[0])
+		io.ReadFull(c, p)
+		if string(u) != user || string(p) != pass {
+			c.Write([]byte{m_socks.UserPassVer, m_socks.UserPassStatusFailure})
+			return
+		}
+		c.Write([]byte{m_socks.UserPassVer, m_socks.UserPassStatusSuccess})
+
+		if _, err := io.ReadFull(c, buf[:3]); err != nil {
+			return
+		}
+		tgt, err := m_socks.ReadAddr(c)
+		if err != nil {
+			return
+		}
+		c.Write([]byte{m_socks.Ver, m_socks.RepSuccess, 0, m_socks.ATYPIPv4, 0, 0, 0, 0, 0, 0})
+		relay(c, tgt.String())
+	})
+}
+
+func checkEcho(t *testing.T, d Dialer, addr string) {
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("echo: %q %v", b, err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	hp := httpProxyServer(t, "alice", "secret")
+	defer hp.Close()
+	sp := socks5ProxyServer(t, "bob", "secret")
+	defer sp.Close()
+
+	for _, list := range []string{
+		"",
+		fmt.Sprintf("http://alice:secret@%s", hp.Addr()),
+		fmt.Sprintf("socks5://bob:secret@%s", sp.Addr()),
+		fmt.Sprintf("http://alice:secret@%s, socks5://bob:secret@%s", hp.Addr(), sp.Addr()),
+		fmt.Sprintf("socks5://bob:secret@%s, http://alice:secret@%s", sp.Addr(), hp.Addr()),
+	} {
+		d, err := Chain(Direct, list)
+		if err != nil {
+			t.Fatalf("chain %q: %v", list, err)
+		}
+		checkEcho(t, d, echo.Addr().String())
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	hp := httpProxyServer(t, "alice", "secret")
+	defer hp.Close()
+	sp := socks5ProxyServer(t, "bob", "secret")
+	defer sp.Close()
+
+	for _, list := range []string{
+		fmt.Sprintf("http://alice:wrong@%s", hp.Addr()),
+		fmt.Sprintf("socks5://bob:wrong@%s", sp.Addr()),
+	} {
+		d, err := Chain(Direct, list)
+		if err != nil {
+			t.Fatalf("chain %q: %v", list, err)
+		}
+		if c, err := d.Dial("tcp", "127.0.0.1:1"); err == nil {
+			c.Close()
+			t.Fatalf("%s: dial should fail", list)
+		}
+	}
+}
+
+func TestSchemeNotSupported(t *testing.T) {
+	if _, err := Chain(Direct, "ftp://127.0.0.1:21"); err != ErrSchemeNotSupported {
+		t.Fatalf("got %v, want %v", err, ErrSchemeNotSupported)
+	}
+}
+
+func TestDirectLocalIP(t *testing.T) {
+	remote := make(chan net.Addr, 1)
+	l := listen(t, func(c net.Conn) { remote <- c.RemoteAddr() })
+	defer l.Close()
+
+	d, err := NewDirect(&DirectOptions{LocalIP: "127.0.0.2"})
+	if err != nil {
+		t.Fatalf("new direct: %v", err)
+	}
+	c, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Skipf("bind 127.0.0.2: %v", err)
+	}
+	defer c.Close()
+	if ip := (<-remote).(*net.TCPAddr).IP.String(); ip != "127.0.0.2" {
+		t.Fatalf("source ip: got %s, want 127.0.0.2", ip)
+	}
+}
+
+func TestDirectSockopts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if _, err := NewDirect(&DirectOptions{Mark: 1}); err == nil {
+			t.Fatal("sockopts should not be supported")
+		}
+		return
+	}
+
+	echo := echoServer(t)
+	defer echo.Close()
+	d, err := NewDirect(&DirectOptions{Interface: "lo", Mark: 100})
+	if err != nil {
+		t.Fatalf("new direct: %v", err)
+	}
+	c, err := d.Dial("tcp", echo.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("no privilege to set sockopts: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c.Close()
+
+	d, _ = NewDirect(&DirectOptions{Interface: "nonexistent0"})
+	if c, err = d.Dial("tcp", echo.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("dial should fail on nonexistent interface")
+	}
+}
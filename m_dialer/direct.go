@@ -0,0 +1,50 @@
+package m_dialer
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// DirectOptions is the settings of connecting directly
+type DirectOptions struct {
+	LocalIP   string // source IP of outgoing connections, chosen by system if empty
+	Interface string // network interface bound with SO_BINDTODEVICE, none if empty
+	Mark      int    // SO_MARK for policy routing, none if 0
+
+	Policy        string        // address family policy, see PolicyIPv4Only etc., system default if empty
+	FallbackDelay time.Duration // delay between attempts of happy eyeballs and default policy, DefaultFallbackDelay if 0
+}
+
+// NewDirect creates a dialer connecting directly with source address,
+// interface, mark and address family policy in opts.
+func NewDirect(opts *DirectOptions) (Dialer, error) {
+	d := &net.Dialer{}
+
+	if opts.LocalIP != "" {
+		ip := net.ParseIP(opts.LocalIP)
+		if ip == nil {
+			return nil, fmt.Errorf("dialer: bad local ip %q", opts.LocalIP)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if opts.Interface != "" || opts.Mark != 0 {
+		if err := checkSockopts(); err != nil {
+			return nil, err
+		}
+		iface, mark := opts.Interface, opts.Mark
+		d.Control = func(network, address string, rc syscall.RawConn) error {
+			var err error
+			ctrlErr := rc.Control(func(fd uintptr) {
+				err = setSockopts(fd, iface, mark)
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		}
+	}
+	return newPolicyDialer(d, opts.Policy, opts.FallbackDelay)
+}
@@ -0,0 +1,75 @@
+package m_dialer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpProxy connects through HTTP proxy with CONNECT method
+type httpProxy struct {
+	addr    string
+	user    string
+	pass    string
+	forward Dialer
+}
+
+func (d *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	c, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	br, err := d.connect(c, addr)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		// data of target sent along with response
+		return &bufConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+func (d *httpProxy) connect(c net.Conn, addr string) (*bufio.Reader, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\n", addr)
+	fmt.Fprintf(&b, "Host: %s\r\n", addr)
+	if d.user != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.pass))
+		fmt.Fprintf(&b, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	b.WriteString("\r\n")
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("dialer: http proxy %s: %s", d.addr, resp.Status)
+	}
+	return br, nil
+}
+
+// bufConn reads data left in buffer first
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,238 @@
+package m_dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+)
+
+// address family policies of direct dialer
+const (
+	PolicyIPv4Only      = "ipv4-only"
+	PolicyIPv6Only      = "ipv6-only"
+	PolicyPreferIPv4    = "prefer-v4"
+	PolicyPreferIPv6    = "prefer-v6"
+	PolicyHappyEyeballs = "happy-eyeballs" // RFC 8305
+)
+
+// DefaultFallbackDelay is the delay between connection attempts of happy
+// eyeballs recommended by RFC 8305.
+const DefaultFallbackDelay = 250 * time.Millisecond
+
+const (
+	resolveTimeout = 10 * time.Second // max time to resolve address
+	attemptTimeout = 10 * time.Second // max time of an attempt to one IP
+)
+
+// policyDialer resolves address and tries IPs in order of policy
+type policyDialer struct {
+	*net.Dialer
+	policy        string
+	fallbackDelay time.Duration
+}
+
+func newPolicyDialer(d *net.Dialer, policy string, fallbackDelay time.Duration) (Dialer, error) {
+	switch policy {
+	case "", PolicyIPv4Only, PolicyIPv6Only, PolicyPreferIPv4, PolicyPreferIPv6, PolicyHappyEyeballs:
+	default:
+		return nil, fmt.Errorf("dialer: unknown address family policy %q", policy)
+	}
+	if fallbackDelay <= 0 {
+		fallbackDelay = DefaultFallbackDelay
+	}
+	return &policyDialer{Dialer: d, policy: policy, fallbackDelay: fallbackDelay}, nil
+}
+
+func (d *policyDialer) Dial(network, addr string) (net.Conn, error) {
+	if d.policy == "" {
+		// system resolves and tries addresses, the family connected is
+		// known from remote address
+		c, err := d.Dialer.Dial(network, addr)
+		if err != nil {
+			log.Logger.Info("dialer: connect to %s failed: %v", addr, err)
+			return nil, err
+		}
+		if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			log.Logger.Info("dialer: connected to %s via %s (%s)", addr, ra.IP, family(ra.IP))
+		}
+		return c, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	return d.DialIPs(network, addr, ips)
+}
+
+// DialIPs dials one of ips resolved for addr in order of policy. Without
+// a policy, ips are tried in order as resolved, falling back to the next
+// one if an attempt does not connect in fallback delay.
+func (d *policyDialer) DialIPs(network, addr string, ips []net.IP) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips = d.order(ips)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("dialer: no address of %s allowed by policy %s", host, d.policy)
+	}
+
+	if d.policy == "" || d.policy == PolicyHappyEyeballs {
+		return d.race(network, addr, ips, port)
+	}
+	return d.serial(network, addr, ips, port)
+}
+
+// order filters and sorts ips by policy
+func (d *policyDialer) order(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch d.policy {
+	case "":
+		return ips
+	case PolicyIPv4Only:
+		return v4
+	case PolicyIPv6Only:
+		return v6
+	case PolicyPreferIPv4:
+		return append(v4, v6...)
+	case PolicyPreferIPv6:
+		return append(v6, v4...)
+	}
+
+	// happy eyeballs interleaves families, starting with IPv6
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+// dialIP dials ip within attemptTimeout
+func (d *policyDialer) dialIP(ctx context.Context, network string, ip net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	defer cancel()
+	return d.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// serial tries ips one by one
+func (d *policyDialer) serial(network, addr string, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for i, ip := range ips {
+		c, err := d.dialIP(context.Background(), network, ip, port)
+		if err == nil {
+			log.Logger.Info("dialer: connected to %s via %s (%s), %d attempts", addr, ip, family(ip), i+1)
+			return c, nil
+		}
+		log.Logger.Info("dialer: attempt %d to %s via %s (%s) failed: %v", i+1, addr, ip, family(ip), err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+type attempt struct {
+	c   net.Conn
+	err error
+	ip  net.IP
+}
+
+// race starts attempt to the next ip if the previous one does not succeed
+// in fallback delay or fails, the first established connection wins.
+func (d *policyDialer) race(network, addr string, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan attempt, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			c, err := d.dialIP(ctx, network, ip, port)
+			results <- attempt{c: c, err: err, ip: ip}
+		}()
+	}
+
+	start()
+	fallback := time.After(d.fallbackDelay)
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				log.Logger.Info("dialer: connected to %s via %s (%s), %d attempts", addr, r.ip, family(r.ip), next)
+				go closeLosers(results, pending)
+				return r.c, nil
+			}
+			log.Logger.Info("dialer: attempt to %s via %s (%s) failed: %v", addr, r.ip, family(r.ip), r.err)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				fallback = time.After(d.fallbackDelay)
+			}
+		case <-fallback:
+			if next < len(ips) {
+				start()
+				fallback = time.After(d.fallbackDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// closeLosers closes connections established by losing attempts
+func closeLosers(results chan attempt, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.err == nil {
+			r.c.Close()
+		}
+	}
+}
+
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
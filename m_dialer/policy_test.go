@@ -0,0 +1,91 @@
+package m_dialer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func ipList(ss ...string) []net.IP {
+	var ips []net.IP
+	for _, s := range ss {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips
+}
+
+func TestPolicyOrder(t *testing.T) {
+	ips := ipList("10.0.0.1", "10.0.0.2", "2001:db8::1", "2001:db8::2", "2001:db8::3")
+	for policy, want := range map[string]string{
+		PolicyIPv4Only:      "10.0.0.1 10.0.0.2",
+		PolicyIPv6Only:      "2001:db8::1 2001:db8::2 2001:db8::3",
+		PolicyPreferIPv4:    "10.0.0.1 10.0.0.2 2001:db8::1 2001:db8::2 2001:db8::3",
+		PolicyPreferIPv6:    "2001:db8::1 2001:db8::2 2001:db8::3 10.0.0.1 10.0.0.2",
+		PolicyHappyEyeballs: "2001:db8::1 10.0.0.1 2001:db8::2 10.0.0.2 2001:db8::3",
+	} {
+		d := &policyDialer{policy: policy}
+		got := ""
+		for i, ip := range d.order(ips) {
+			if i > 0 {
+				got += " "
+			}
+			got += ip.String()
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", policy, got, want)
+		}
+	}
+}
+
+func TestPolicyUnknown(t *testing.T) {
+	if _, err := NewDirect(&DirectOptions{Policy: "ipv5-only"}); err == nil {
+		t.Fatal("unknown policy should fail")
+	}
+}
+
+func TestHappyEyeballsFallback(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	d := &policyDialer{Dialer: &net.Dialer{}, policy: PolicyHappyEyeballs, fallbackDelay: 50 * time.Millisecond}
+	// 192.0.2.1 is unroutable or hangs, 127.0.0.2 refuses
+	for _, ips := range [][]net.IP{
+		ipList("192.0.2.1", "127.0.0.1"),
+		ipList("127.0.0.2", "127.0.0.1"),
+	} {
+		start := time.Now()
+		c, err := d.race("tcp", echo.Addr().String(), ips, port)
+		if err != nil {
+			t.Fatalf("%v: race: %v", ips, err)
+		}
+		c.Close()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("%v: fallback took %v", ips, elapsed)
+		}
+	}
+
+	if _, err := d.race("tcp", "", ipList("127.0.0.2"), port); err == nil {
+		t.Fatal("race should fail if all attempts fail")
+	}
+}
+
+func TestDefaultPolicyFallback(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	d, err := NewDirect(&DirectOptions{FallbackDelay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("new direct: %v", err)
+	}
+	// a hanging first address does not stall the dial
+	start := time.Now()
+	c, err := d.(IPDialer).DialIPs("tcp", echo.Addr().String(), ipList("192.0.2.1", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("fallback took %v", elapsed)
+	}
+}
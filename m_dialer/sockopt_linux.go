@@ -0,0 +1,23 @@
+package m_dialer
+
+import (
+	"syscall"
+)
+
+func checkSockopts() error {
+	return nil
+}
+
+func setSockopts(fd uintptr, iface string, mark int) error {
+	if iface != "" {
+		if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface); err != nil {
+			return err
+		}
+	}
+	if mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package m_dialer
+
+import (
+	"errors"
+)
+
+var errSockoptsNotSupported = errors.New("dialer: interface binding and mark are only supported on linux")
+
+func checkSockopts() error {
+	return errSockoptsNotSupported
+}
+
+func setSockopts(fd uintptr, iface string, mark int) error {
+	return errSockoptsNotSupported
+}
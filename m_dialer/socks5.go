@@ -0,0 +1,108 @@
+package m_dialer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+var (
+	ErrNoAcceptableMethod = errors.New("dialer: no acceptable socks5 auth method")
+	ErrAuthFailed         = errors.New("dialer: socks5 auth failed")
+)
+
+// socks5Proxy connects through SOCKS5 proxy, with username/password auth
+// if user is given
+type socks5Proxy struct {
+	addr    string
+	user    string
+	pass    string
+	forward Dialer
+}
+
+func (d *socks5Proxy) Dial(network, addr string) (net.Conn, error) {
+	tgt := m_socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, ErrBadAddr
+	}
+
+	c, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err = d.connect(c, tgt); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (d *socks5Proxy) connect(c net.Conn, tgt m_socks.Addr) error {
+	methods := []byte{m_socks.MethodNone}
+	if d.user != "" {
+		methods = append(methods, m_socks.MethodUsernamePassword)
+	}
+	req := append([]byte{m_socks.Ver, byte(len(methods))}, methods...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	var buf [3]byte
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	switch buf[1] {
+	case m_socks.MethodNone:
+	case m_socks.MethodUsernamePassword:
+		if err := d.auth(c); err != nil {
+			return err
+		}
+	default:
+		return ErrNoAcceptableMethod
+	}
+
+	req = append([]byte{m_socks.Ver, m_socks.CmdConnect, 0}, tgt...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, buf[:]); err != nil {
+		return err
+	}
+	if buf[1] != m_socks.RepSuccess {
+		return m_socks.Error(buf[1])
+	}
+	// bound address
+	_, err := m_socks.ReadAddr(c)
+	return err
+}
+
+// auth authenticates with username and password, see RFC 1929
+func (d *socks5Proxy) auth(c net.Conn) error {
+	if d.user == "" || len(d.user) > 255 || len(d.pass) > 255 {
+		return ErrNoAcceptableMethod
+	}
+	req := []byte{m_socks.UserPassVer, byte(len(d.user))}
+	req = append(req, d.user...)
+	req = append(req, byte(len(d.pass)))
+	req = append(req, d.pass...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != m_socks.UserPassStatusSuccess {
+		return ErrAuthFailed
+	}
+	return nil
+}
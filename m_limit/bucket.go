@@ -0,0 +1,122 @@
+// Package m_limit implements token buckets to limit rate of events and
+// bandwidth of readers and writers.
+package m_limit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second, holding at
+// most burst tokens. A nil Bucket or a Bucket of rate 0 is unlimited.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// NewBucket creates a full bucket. burst less than 1 is taken as rate.
+func NewBucket(rate float64, burst int) *Bucket {
+	b := &Bucket{rate: rate, burst: burstOf(rate, burst), last: time.Now()}
+	b.tokens = b.burst
+	return b
+}
+
+func burstOf(rate float64, burst int) float64 {
+	b := float64(burst)
+	if b < 1 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return b
+}
+
+// SetRate changes rate and burst of bucket, tokens borrowed by waiters are
+// kept. A bucket becoming limited starts full.
+func (b *Bucket) SetRate(rate float64, burst int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	unlimited := b.rate <= 0
+	b.rate = rate
+	b.burst = burstOf(rate, burst)
+	if unlimited || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Limited reports whether bucket has a non-zero rate
+func (b *Bucket) Limited() bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate > 0
+}
+
+// refill adds tokens accumulated since last refill, with lock held
+func (b *Bucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// Allow takes a token if there is one, and reports whether it is taken.
+func (b *Bucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait takes n tokens, and blocks until the bucket is refilled if it runs
+// short. Tokens are borrowed, so n may be larger than burst and waiters
+// are served in order.
+func (b *Bucket) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	b.refill(now)
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Take waits for n tokens, it never fails.
+func (b *Bucket) Take(n int) error {
+	b.Wait(n)
+	return nil
+}
@@ -0,0 +1,56 @@
+package m_limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("token %d of burst should be allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("empty bucket should not allow")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("bucket should be refilled")
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	var b *Bucket
+	for i := 0; i < 100; i++ {
+		if !b.Allow() {
+			t.Fatal("nil bucket should be unlimited")
+		}
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	b := NewBucket(0, 0)
+	for i := 0; i < 100; i++ {
+		if !b.Allow() {
+			t.Fatal("bucket of rate 0 should be unlimited")
+		}
+	}
+
+	b.SetRate(10, 2)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("token %d of burst should be allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("empty bucket should not allow")
+	}
+
+	b.SetRate(0, 0)
+	if !b.Allow() {
+		t.Fatal("bucket should be unlimited after rate set to 0")
+	}
+}
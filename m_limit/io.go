@@ -0,0 +1,90 @@
+package m_limit
+
+import (
+	"io"
+)
+
+// Limiter takes n bytes passed by a Reader or Writer. An error stops the
+// Reader or Writer.
+type Limiter interface {
+	Take(n int) error
+}
+
+// maxChunk is the max bytes passed at once, so that tokens are taken
+// smoothly at low rate
+const maxChunk = 16 * 1024
+
+// Reader limits reading from an io.Reader by limiters.
+type Reader struct {
+	r        io.Reader
+	limiters []Limiter
+}
+
+// NewReader creates a Reader of r limited by all of limiters.
+func NewReader(r io.Reader, limiters ...Limiter) *Reader {
+	return &Reader{r: r, limiters: limiters}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if e := l.Take(n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// WriteTo keeps WriterTo fast path of underlying reader by limiting w
+// instead.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := r.r.(io.WriterTo); ok {
+		return wt.WriteTo(&Writer{w: w, limiters: r.limiters})
+	}
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+// Writer limits writing to an io.Writer by limiters.
+type Writer struct {
+	w        io.Writer
+	limiters []Limiter
+}
+
+// NewWriter creates a Writer of w limited by all of limiters.
+func NewWriter(w io.Writer, limiters ...Limiter) *Writer {
+	return &Writer{w: w, limiters: limiters}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		for _, l := range w.limiters {
+			if err := l.Take(len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom keeps ReaderFrom fast path of underlying writer by limiting r
+// instead.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(&Reader{r: r, limiters: w.limiters})
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
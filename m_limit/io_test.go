@@ -0,0 +1,54 @@
+package m_limit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// writerTo counts calls of its fast path
+type writerTo struct {
+	r     io.Reader
+	calls int
+}
+
+func (s *writerTo) Read(p []byte) (int, error) { return s.r.Read(p) }
+
+func (s *writerTo) WriteTo(w io.Writer) (int64, error) {
+	s.calls++
+	return io.Copy(w, s.r)
+}
+
+func TestReaderRate(t *testing.T) {
+	// burst of 10KB is passed at once, the next 10KB takes 100ms
+	b := NewBucket(100*1024, 10*1024)
+	src := bytes.NewReader(make([]byte, 20*1024))
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, NewReader(struct{ io.Reader }{src}, b))
+	if err != nil || n != 20*1024 {
+		t.Fatalf("copy: %d %v", n, err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond || d > time.Second {
+		t.Fatalf("copy took %v, want about 100ms", d)
+	}
+}
+
+func TestReaderKeepsWriterTo(t *testing.T) {
+	b := NewBucket(100*1024, 10*1024)
+	src := &writerTo{r: bytes.NewReader(make([]byte, 20*1024))}
+
+	start := time.Now()
+	var dst bytes.Buffer
+	n, err := io.Copy(&dst, NewReader(src, b))
+	if err != nil || n != 20*1024 {
+		t.Fatalf("copy: %d %v", n, err)
+	}
+	if src.calls != 1 {
+		t.Fatal("WriteTo of underlying reader should be used")
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("copy took %v, not limited", d)
+	}
+}
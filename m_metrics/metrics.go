@@ -0,0 +1,363 @@
+// Package m_metrics implements counters, gauges and histograms exported in
+// Prometheus text exposition format.
+//
+// Each metric keeps at most MaxSeries label sets, further label sets are
+// counted in one series with all labels set to OtherValue, so that labels
+// like user or upstream cannot blow up memory of server and Prometheus.
+package m_metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// OtherValue is the label value of series beyond MaxSeries
+const OtherValue = "_other"
+
+// DefaultMaxSeries is the default max label sets of a metric
+const DefaultMaxSeries = 100
+
+// DefBuckets are default buckets of histograms in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800}
+
+// Registry is a set of metrics written in order of registration
+type Registry struct {
+	MaxSeries int // max label sets of each metric, DefaultMaxSeries if 0
+
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates a registry with at most maxSeries label sets of each
+// metric.
+func NewRegistry(maxSeries int) *Registry {
+	return &Registry{MaxSeries: maxSeries}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) maxSeries() int {
+	if r.MaxSeries > 0 {
+		return r.MaxSeries
+	}
+	return DefaultMaxSeries
+}
+
+// WriteTo writes all metrics in text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc is name, help and label names of a metric with its series
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	max    int
+
+	lock   sync.Mutex
+	series map[string]interface{} // by joined label values
+	values map[string][]string
+}
+
+func newDesc(r *Registry, name, help, typ string, labels []string) *desc {
+	return &desc{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		max:    r.maxSeries(),
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+// get returns series of label values, created by newSeries if not exist
+func (d *desc) get(values []string, newSeries func() interface{}) interface{} {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if s, ok := d.series[key]; ok {
+		return s
+	}
+	if len(d.series) >= d.max {
+		values = make([]string, len(d.labels))
+		for i := range values {
+			values[i] = OtherValue
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok := d.series[key]; ok {
+			return s
+		}
+	}
+	s := newSeries()
+	d.series[key] = s
+	d.values[key] = append([]string(nil), values...)
+	return s
+}
+
+// each calls f with label pairs and series sorted by label values
+func (d *desc) each(f func(labels string, s interface{})) {
+	d.lock.Lock()
+	keys := make([]string, 0, len(d.series))
+	for key := range d.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type item struct {
+		labels string
+		s      interface{}
+	}
+	items := make([]item, len(keys))
+	for i, key := range keys {
+		items[i] = item{d.labelPairs(d.values[key]), d.series[key]}
+	}
+	d.lock.Unlock()
+
+	for _, it := range items {
+		f(it.labels, it.s)
+	}
+}
+
+func (d *desc) labelPairs(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = d.labels[i] + `="` + escape(v) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	n int64
+}
+
+// Add adds n to counter
+func (c *Counter) Add(n int64) { atomic.AddInt64(&c.n, n) }
+
+// Inc adds 1 to counter
+func (c *Counter) Inc() { c.Add(1) }
+
+// Value returns value of counter
+func (c *Counter) Value() int64 { return atomic.LoadInt64(&c.n) }
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	d *desc
+}
+
+// NewCounter registers a counter with label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{d: newDesc(r, name, help, "counter", labels)}
+	r.register(v)
+	return v
+}
+
+// With returns counter of label values
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.d.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.d.header(w)
+	v.d.each(func(labels string, s interface{}) {
+		writeSample(w, v.d.name, labels, float64(s.(*Counter).Value()))
+	})
+}
+
+// Gauge is a value going up and down
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets value of gauge
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+// Value returns value of gauge
+func (g *Gauge) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&g.bits)) }
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	d *desc
+}
+
+// NewGauge registers a gauge with label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{d: newDesc(r, name, help, "gauge", labels)}
+	r.register(v)
+	return v
+}
+
+// With returns gauge of label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.d.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.d.header(w)
+	v.d.each(func(labels string, s interface{}) {
+		writeSample(w, v.d.name, labels, s.(*Gauge).Value())
+	})
+}
+
+// funcMetric is a metric without labels whose value is read when written
+type funcMetric struct {
+	name, help, typ string
+	f               func() float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by f
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{name: name, help: help, typ: "counter", f: f})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{name: name, help: help, typ: "gauge", f: f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	d := desc{name: m.name, help: m.help, typ: m.typ}
+	d.header(w)
+	writeSample(w, m.name, "", m.f())
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	upper  []float64
+	lock   sync.Mutex
+	counts []int64 // not cumulative, the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+// Observe adds an observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.lock.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.lock.Unlock()
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	d     *desc
+	upper []float64
+}
+
+// NewHistogram registers a histogram of buckets with label names. Buckets
+// are sorted upper bounds, DefBuckets if nil.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	v := &HistogramVec{d: newDesc(r, name, help, "histogram", labels), upper: buckets}
+	r.register(v)
+	return v
+}
+
+// With returns histogram of label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.d.get(values, func() interface{} {
+		return &Histogram{upper: v.upper, counts: make([]int64, len(v.upper)+1)}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.d.header(w)
+	v.d.each(func(labels string, s interface{}) {
+		h := s.(*Histogram)
+		h.lock.Lock()
+		counts := append([]int64(nil), h.counts...)
+		sum, count := h.sum, h.count
+		h.lock.Unlock()
+
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+		var cum int64
+		for i, upper := range v.upper {
+			cum += counts[i]
+			writeSample(w, v.d.name+"_bucket", labels+sep+`le="`+formatFloat(upper)+`"`, float64(cum))
+		}
+		writeSample(w, v.d.name+"_bucket", labels+sep+`le="+Inf"`, float64(count))
+		writeSample(w, v.d.name+"_sum", labels, sum)
+		writeSample(w, v.d.name+"_count", labels, float64(count))
+	})
+}
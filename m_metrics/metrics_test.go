@@ -0,0 +1,59 @@
+package m_metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry(0)
+	c := r.NewCounter("test_bytes_total", "Bytes relayed.", "direction", "user")
+	c.With("in", "bob").Add(3)
+	c.With("in", `a"l\ice`).Add(5)
+	r.NewGaugeFunc("test_active", "Active connections.", func() float64 { return 2 })
+	h := r.NewHistogram("test_seconds", "Duration.", []float64{0.1, 1})
+	h.With().Observe(0.05)
+	h.With().Observe(0.5)
+	h.With().Observe(5)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := `# HELP test_bytes_total Bytes relayed.
+# TYPE test_bytes_total counter
+test_bytes_total{direction="in",user="a\"l\\ice"} 5
+test_bytes_total{direction="in",user="bob"} 3
+# HELP test_active Active connections.
+# TYPE test_active gauge
+test_active 2
+# HELP test_seconds Duration.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	r := NewRegistry(2)
+	c := r.NewCounter("test_total", "Test.", "user")
+	for _, u := range []string{"a", "b", "c", "d", "a"} {
+		c.With(u).Inc()
+	}
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	out := buf.String()
+	for _, line := range []string{`test_total{user="a"} 2`, `test_total{user="b"} 1`, `test_total{user="_other"} 2`} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out)
+		}
+	}
+}
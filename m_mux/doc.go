@@ -0,0 +1,25 @@
+/*
+Package m_mux implements a simple stream multiplexer which carries many
+logical streams over a single reliable connection, e.g. an enciphered
+stream of m_shadow.
+
+Every frame starts with a fixed 9 bytes header:
+
+	[type    1 byte]
+	[stream  4 bytes, big-endian]
+	[length  4 bytes, big-endian]
+
+For data frames length is the size of payload following the header, which
+is capped at MaxPayload so that a frame fits in one AEAD record. For window
+update frames length is the window increment, and for ping/pong frames it is
+an opaque value echoed back by the peer. Other frames carry no payload.
+
+Streams opened by client use odd ids and streams opened by server use even
+ids. Each stream has a receive window of Config.StreamWindow bytes; a sender
+never has more unacknowledged bytes in flight than the window, and the
+receiver returns window after the application consumes data.
+
+A stream is closed gracefully by sending FIN in both directions, or aborted
+by RST. GOAWAY tells the peer no more streams will be accepted on session.
+*/
+package m_mux
@@ -0,0 +1,174 @@
+package m_mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sessionPair(t testing.TB, config *Config) (*Session, *Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	ch := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return Client(c, config), Server(<-ch, config)
+}
+
+func TestStreamEcho(t *testing.T) {
+	client, server := sessionPair(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Errorf("open: %v", err)
+				return
+			}
+			defer st.Close()
+
+			// larger than stream window to exercise flow control
+			msg := make([]byte, 1024*1024)
+			rand.Read(msg)
+			go st.Write(msg)
+
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Errorf("read: %v", err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("stream %d: echo mismatch", st.ID())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := sessionPair(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	st.Write([]byte("bye"))
+	st.Close()
+
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	b, err := io.ReadAll(ss)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("read: %q %v", b, err)
+	}
+	ss.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("client streams: got %d, want 0", n)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Errorf("server streams: got %d, want 0", n)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	client, server := sessionPair(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	st, _ := client.Open()
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read: got %v, want deadline exceeded", err)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxStreams = 2
+	client, server := sessionPair(t, config)
+	defer client.Close()
+	defer server.Close()
+
+	client.Open()
+	client.Open()
+	if client.Available() {
+		t.Error("session should not be available")
+	}
+	if _, err := client.Open(); err != ErrTooManyStreams {
+		t.Errorf("open: got %v, want %v", err, ErrTooManyStreams)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := sessionPair(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	server.GoAway()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := client.Open(); err != ErrGoAway {
+		t.Errorf("open: got %v, want %v", err, ErrGoAway)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepAliveInterval = 10 * time.Millisecond
+	config.KeepAliveTimeout = 50 * time.Millisecond
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		// peer accepts but never speaks mux
+		c, _ := l.Accept()
+		io.Copy(io.Discard, c)
+	}()
+	c, _ := net.Dial("tcp", l.Addr().String())
+	sess := Client(c, config)
+
+	select {
+	case <-sess.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed after keepalive timeout")
+	}
+}
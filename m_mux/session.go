@@ -0,0 +1,357 @@
+package m_mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	typeOpen   byte = 0x00 // open a new stream
+	typeData   byte = 0x01 // payload of stream
+	typeWindow byte = 0x02 // increase send window of stream
+	typeFin    byte = 0x03 // half close of stream
+	typeRst    byte = 0x04 // abort stream
+	typePing   byte = 0x05 // keepalive request
+	typePong   byte = 0x06 // keepalive response
+	typeGoAway byte = 0x07 // no more new streams on session
+)
+
+const (
+	headerSize = 1 + 4 + 4
+
+	// MaxPayload is the maximum payload size of a data frame, so that a frame
+	// fits in one record (0x3FFF) of m_shadow stream.
+	MaxPayload = 0x3FFF - headerSize
+)
+
+var (
+	ErrSessionClosed  = errors.New("mux: session closed")
+	ErrGoAway         = errors.New("mux: session going away")
+	ErrTooManyStreams = errors.New("mux: too many streams")
+	ErrStreamClosed   = errors.New("mux: stream closed")
+	ErrStreamReset    = errors.New("mux: stream reset by peer")
+	ErrProtocol       = errors.New("mux: protocol error")
+)
+
+// Config is the settings of a session
+type Config struct {
+	MaxStreams        int           // maximum concurrent streams in session
+	AcceptBacklog     int           // maximum streams waiting for Accept
+	StreamWindow      uint32        // initial receive window of stream, in bytes
+	KeepAliveInterval time.Duration // interval of sending ping
+	KeepAliveTimeout  time.Duration // session closed if nothing received in timeout
+}
+
+// DefaultConfig returns config with default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		MaxStreams:        128,
+		AcceptBacklog:     256,
+		StreamWindow:      256 * 1024,
+		KeepAliveInterval: 30 * time.Second,
+		KeepAliveTimeout:  90 * time.Second,
+	}
+}
+
+// Session multiplexes streams over conn
+type Session struct {
+	conn   net.Conn
+	config *Config
+
+	nextId uint32 // next id of stream opened locally
+
+	lock       sync.Mutex
+	streams    map[uint32]*Stream
+	goAway     bool // GOAWAY sent by us
+	peerGoAway bool // GOAWAY received from peer
+
+	acceptCh chan *Stream
+
+	writeLock sync.Mutex
+	wbuf      []byte
+
+	lastRecv int64 // unix nano of last frame received
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+}
+
+// Client creates the session of side which dialed conn.
+func Client(conn net.Conn, config *Config) *Session { return newSession(conn, config, 1) }
+
+// Server creates the session of side which accepted conn.
+func Server(conn net.Conn, config *Config) *Session { return newSession(conn, config, 2) }
+
+func newSession(conn net.Conn, config *Config, firstId uint32) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		nextId:   firstId,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, config.AcceptBacklog),
+		wbuf:     make([]byte, headerSize+MaxPayload),
+		lastRecv: time.Now().UnixNano(),
+		closed:   make(chan struct{}),
+	}
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// Open opens a new stream to peer.
+func (s *Session) Open() (*Stream, error) {
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if s.goAway || s.peerGoAway {
+		s.lock.Unlock()
+		return nil, ErrGoAway
+	}
+	if len(s.streams) >= s.config.MaxStreams {
+		s.lock.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	id := s.nextId
+	s.nextId += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(typeOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.closed:
+		return nil, s.closeErr
+	}
+}
+
+// NumStreams returns the number of active streams.
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// Available reports whether a new stream may be opened on session.
+func (s *Session) Available() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.IsClosed() && !s.goAway && !s.peerGoAway && len(s.streams) < s.config.MaxStreams
+}
+
+// GoAway tells peer no more streams will be accepted. Existing streams
+// continue until they are closed.
+func (s *Session) GoAway() error {
+	s.lock.Lock()
+	s.goAway = true
+	s.lock.Unlock()
+	return s.writeFrame(typeGoAway, 0, 0, nil)
+}
+
+// IsClosed reports whether session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan returns a channel closed when session is closed.
+func (s *Session) CloseChan() <-chan struct{} { return s.closed }
+
+// Close closes session and all its streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.closeErr = err
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+// LocalAddr returns local address of underlying conn.
+func (s *Session) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+
+// RemoteAddr returns remote address of underlying conn.
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *Session) writeFrame(typ byte, id uint32, length uint32, payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+
+	b := s.wbuf[:headerSize+len(payload)]
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], id)
+	binary.BigEndian.PutUint32(b[5:9], length)
+	copy(b[headerSize:], payload)
+
+	if _, err := s.conn.Write(b); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) recvLoop() {
+	var hdr [headerSize]byte
+	buf := make([]byte, MaxPayload)
+
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.closeWithError(err)
+			break
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+
+		var err error
+		switch typ {
+		case typeOpen:
+			err = s.handleOpen(id)
+		case typeData:
+			if length > MaxPayload {
+				err = ErrProtocol
+				break
+			}
+			if _, err = io.ReadFull(s.conn, buf[:length]); err != nil {
+				break
+			}
+			if st := s.getStream(id); st != nil {
+				err = st.pushData(buf[:length])
+			}
+		case typeWindow:
+			if st := s.getStream(id); st != nil {
+				st.incSendWindow(length)
+			}
+		case typeFin:
+			if st := s.getStream(id); st != nil {
+				st.remoteClose()
+			}
+		case typeRst:
+			if st := s.getStream(id); st != nil {
+				st.remoteReset()
+			}
+		case typePing:
+			go s.writeFrame(typePong, 0, length, nil)
+		case typePong:
+		case typeGoAway:
+			s.lock.Lock()
+			s.peerGoAway = true
+			s.lock.Unlock()
+		default:
+			err = ErrProtocol
+		}
+
+		if err != nil {
+			s.closeWithError(err)
+			break
+		}
+	}
+
+	// wake up all streams blocked in read or write
+	s.lock.Lock()
+	for _, st := range s.streams {
+		st.notify()
+	}
+	s.lock.Unlock()
+}
+
+func (s *Session) handleOpen(id uint32) error {
+	s.lock.Lock()
+	if _, ok := s.streams[id]; ok || id%2 == s.nextId%2 {
+		s.lock.Unlock()
+		return ErrProtocol
+	}
+	if s.goAway || len(s.streams) >= s.config.MaxStreams {
+		s.lock.Unlock()
+		return s.writeFrame(typeRst, id, 0, nil)
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	select {
+	case s.acceptCh <- st:
+		return nil
+	default:
+		s.removeStream(id)
+		return s.writeFrame(typeRst, id, 0, nil)
+	}
+}
+
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+
+	var seq uint32
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+			if s.config.KeepAliveTimeout > 0 && time.Since(last) > s.config.KeepAliveTimeout {
+				s.closeWithError(errKeepAliveTimeout)
+				return
+			}
+			seq++
+			if err := s.writeFrame(typePing, 0, seq, nil); err != nil {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: keepalive timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return false }
+
+var errKeepAliveTimeout error = timeoutError{}
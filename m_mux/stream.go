@@ -0,0 +1,259 @@
+package m_mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection in session, it implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	lock       sync.Mutex
+	recvBuf    bytes.Buffer
+	consumed   uint32 // bytes read but not yet returned to peer as window
+	sendWindow uint32
+
+	localClosed  bool // FIN sent
+	remoteClosed bool // FIN received
+	reset        bool // RST received
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readCh  chan struct{} // notify readers of data, close or deadline change
+	writeCh chan struct{} // notify writers of window, close or deadline change
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: sess.config.StreamWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+// ID returns id of stream in session.
+func (st *Stream) ID() uint32 { return st.id }
+
+// Read reads data received from peer.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.lock.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(b)
+			st.consumed += uint32(n)
+			var inc uint32
+			if st.consumed >= st.sess.config.StreamWindow/2 && !st.localClosed {
+				inc, st.consumed = st.consumed, 0
+			}
+			st.lock.Unlock()
+
+			if inc > 0 {
+				st.sess.writeFrame(typeWindow, st.id, inc, nil)
+			}
+			return n, nil
+		}
+		if st.reset {
+			st.lock.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.remoteClosed {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		if st.localClosed {
+			st.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		deadline := st.readDeadline
+		st.lock.Unlock()
+
+		if err := st.wait(st.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b to peer, blocking while send window is exhausted.
+func (st *Stream) Write(b []byte) (int, error) {
+	var total int
+	for len(b) > 0 {
+		st.lock.Lock()
+		if st.reset {
+			st.lock.Unlock()
+			return total, ErrStreamReset
+		}
+		if st.localClosed {
+			st.lock.Unlock()
+			return total, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+			if err := st.wait(st.writeCh, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := len(b)
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.lock.Unlock()
+
+		if err := st.sess.writeFrame(typeData, st.id, uint32(n), b[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// wait blocks until ch is notified, session is closed or deadline exceeded.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-st.sess.closed:
+		// data received before close is still readable
+		st.lock.Lock()
+		buffered := st.recvBuf.Len()
+		st.lock.Unlock()
+		if buffered > 0 && ch == st.readCh {
+			return nil
+		}
+		return st.sess.closeErr
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *Stream) notify() {
+	select {
+	case st.readCh <- struct{}{}:
+	default:
+	}
+	select {
+	case st.writeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes stream gracefully. Peer reads io.EOF after data sent before.
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed || st.reset
+	st.lock.Unlock()
+	st.notify()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	if st.reset {
+		return nil
+	}
+	return st.sess.writeFrame(typeFin, st.id, 0, nil)
+}
+
+func (st *Stream) pushData(b []byte) error {
+	st.lock.Lock()
+	if st.localClosed {
+		// nobody reads any more, drop data
+		st.lock.Unlock()
+		return nil
+	}
+	if uint32(st.recvBuf.Len()+len(b)) > st.sess.config.StreamWindow {
+		st.lock.Unlock()
+		return ErrProtocol
+	}
+	st.recvBuf.Write(b)
+	st.lock.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) incSendWindow(n uint32) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.lock.Unlock()
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.lock.Unlock()
+	st.notify()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.lock.Lock()
+	st.reset = true
+	st.lock.Unlock()
+	st.notify()
+	st.sess.removeStream(st.id)
+}
+
+// LocalAddr returns local address of session.
+func (st *Stream) LocalAddr() net.Addr { return st.sess.LocalAddr() }
+
+// RemoteAddr returns remote address of session.
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.RemoteAddr() }
+
+// SetDeadline sets both read and write deadline of stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets read deadline of stream.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	st.notify()
+	return nil
+}
+
+// SetWriteDeadline sets write deadline of stream.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	st.notify()
+	return nil
+}
@@ -0,0 +1,216 @@
+// Package m_plugin runs SIP003 plugins, e.g. simple-obfs and v2ray-plugin,
+// as supervised child processes.
+//
+// See https://shadowsocks.org/doc/sip003.html
+package m_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+)
+
+const (
+	stopTimeout   = 5 * time.Second  // time for plugin to exit after SIGTERM
+	stableRunTime = 10 * time.Second // backoff is reset if plugin ran longer
+	maxBackoff    = 10 * time.Second
+)
+
+// terminateSignal asks plugin to exit
+var terminateSignal os.Signal = syscall.SIGTERM
+
+// Plugin is a supervised SIP003 plugin process. Plugin accepts connections
+// on local address and forwards them to remote address.
+type Plugin struct {
+	Path   string // executable of plugin
+	Opts   string // SS_PLUGIN_OPTIONS
+	Remote string // SS_REMOTE_HOST:SS_REMOTE_PORT
+	Local  string // SS_LOCAL_HOST:SS_LOCAL_PORT
+
+	env     []string // environment of plugin process
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	done    chan struct{} // closed when supervisor exits
+}
+
+// Start launches plugin and restarts it whenever it exits, until Stop.
+func Start(path, opts, remote, local string) (*Plugin, error) {
+	p := &Plugin{
+		Path:   path,
+		Opts:   opts,
+		Remote: remote,
+		Local:  local,
+		done:   make(chan struct{}),
+	}
+
+	var err error
+	if p.env, err = p.environ(); err != nil {
+		return nil, err
+	}
+	cmd, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervise(cmd)
+	return p, nil
+}
+
+// environ returns environment of current process with SIP003 variables
+func (p *Plugin) environ() ([]string, error) {
+	rhost, rport, err := net.SplitHostPort(p.Remote)
+	if err != nil {
+		return nil, err
+	}
+	lhost, lport, err := net.SplitHostPort(p.Local)
+	if err != nil {
+		return nil, err
+	}
+	return append(os.Environ(),
+		"SS_REMOTE_HOST="+rhost,
+		"SS_REMOTE_PORT="+rport,
+		"SS_LOCAL_HOST="+lhost,
+		"SS_LOCAL_PORT="+lport,
+		"SS_PLUGIN_OPTIONS="+p.Opts,
+	), nil
+}
+
+func (p *Plugin) start() (*exec.Cmd, error) {
+	cmd := exec.Command(p.Path)
+	cmd.Env = p.env
+	w := &logWriter{name: p.Path}
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return nil, fmt.Errorf("plugin: %s stopped", p.Path)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin: start %s: %v", p.Path, err)
+	}
+	p.cmd = cmd
+	log.Logger.Info("plugin: %s[pid:%d] started, %s <-> %s", p.Path, cmd.Process.Pid, p.Local, p.Remote)
+	return cmd, nil
+}
+
+func (p *Plugin) supervise(cmd *exec.Cmd) {
+	defer close(p.done)
+
+	var backoff time.Duration
+	for {
+		start := time.Now()
+		err := cmd.Wait()
+
+		p.lock.Lock()
+		stopped := p.stopped
+		p.lock.Unlock()
+		if stopped {
+			return
+		}
+
+		if time.Since(start) > stableRunTime {
+			backoff = 0
+		}
+		backoff = nextBackoff(backoff)
+		log.Logger.Warn("plugin: %s[pid:%d] exited: %v; restarting in %v", p.Path, cmd.Process.Pid, err, backoff)
+		time.Sleep(backoff)
+
+		for {
+			if cmd, err = p.start(); err == nil {
+				break
+			}
+			p.lock.Lock()
+			stopped = p.stopped
+			p.lock.Unlock()
+			if stopped {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			log.Logger.Warn("%v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+		}
+	}
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return 100 * time.Millisecond
+	}
+	if d *= 2; d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Pid returns pid of current plugin process.
+func (p *Plugin) Pid() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+// Stop terminates plugin and stops restarting it. Plugin is killed if it
+// does not exit in time after SIGTERM.
+func (p *Plugin) Stop() {
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return
+	}
+	p.stopped = true
+	cmd := p.cmd
+	p.lock.Unlock()
+
+	cmd.Process.Signal(terminateSignal)
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		<-p.done
+	}
+	log.Logger.Info("plugin: %s[pid:%d] stopped", p.Path, cmd.Process.Pid)
+}
+
+// FreeLoopback returns a loopback address with a free port for plugin.
+func FreeLoopback() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Addr().(*net.TCPAddr).Port)), nil
+}
+
+// logWriter logs output of plugin line by line
+type logWriter struct {
+	name string
+	buf  []byte
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Logger.Info("plugin: %s: %s", w.name, w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(b), nil
+}
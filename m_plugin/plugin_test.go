@@ -0,0 +1,162 @@
+package m_plugin
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// stubEnv makes test binary run as a stub plugin, which forwards
+// connections from SS_LOCAL to SS_REMOTE like a plugin on local side.
+const stubEnv = "M_PLUGIN_STUB"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(stubEnv) == "1" {
+		runStub()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runStub() {
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	if os.Getenv("SS_PLUGIN_OPTIONS") != "obfs=none" {
+		os.Exit(2)
+	}
+
+	l, err := net.Listen("tcp", local)
+	if err != nil {
+		os.Exit(1)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		go func() {
+			defer c.Close()
+			rc, err := net.Dial("tcp", remote)
+			if err != nil {
+				return
+			}
+			defer rc.Close()
+			go io.Copy(rc, c)
+			io.Copy(c, rc)
+		}()
+	}
+}
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// dialEcho dials addr, retrying while plugin is starting, and checks echo.
+func dialEcho(t *testing.T, addr string) {
+	var c net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial plugin: %v", err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("echo through plugin: %q %v", b, err)
+	}
+}
+
+func startStub(t *testing.T, remote string) (*Plugin, string) {
+	os.Setenv(stubEnv, "1")
+	defer os.Unsetenv(stubEnv)
+
+	local, err := FreeLoopback()
+	if err != nil {
+		t.Fatalf("free port: %v", err)
+	}
+	p, err := Start(os.Args[0], "obfs=none", remote, local)
+	if err != nil {
+		t.Fatalf("start plugin: %v", err)
+	}
+	return p, local
+}
+
+func TestPluginForward(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	p, local := startStub(t, echo.Addr().String())
+	defer p.Stop()
+
+	dialEcho(t, local)
+}
+
+func TestPluginRestart(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	p, local := startStub(t, echo.Addr().String())
+	defer p.Stop()
+	dialEcho(t, local)
+
+	pid := p.Pid()
+	p.cmd.Process.Kill()
+	for i := 0; i < 100 && p.Pid() == pid; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if p.Pid() == pid {
+		t.Fatal("plugin not restarted")
+	}
+	dialEcho(t, local)
+}
+
+func TestPluginStop(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	p, local := startStub(t, echo.Addr().String())
+	dialEcho(t, local)
+	p.Stop()
+
+	select {
+	case <-p.done:
+	default:
+		t.Fatal("supervisor still running after stop")
+	}
+	if c, err := net.Dial("tcp", local); err == nil {
+		c.Close()
+		t.Fatal("plugin still listening after stop")
+	}
+}
+
+func TestPluginNotFound(t *testing.T) {
+	if _, err := Start("/nonexistent/plugin", "", "127.0.0.1:1", "127.0.0.1:2"); err == nil {
+		t.Fatal("start should fail for missing executable")
+	}
+}
@@ -0,0 +1,214 @@
+// Package m_quota accounts traffic of users and ports, enforces byte quotas
+// and persists counters to a JSON file.
+package m_quota
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_limit"
+	"github.com/zyong/miniproxygo/m_util"
+)
+
+// ErrExceeded means quota of an account is used up
+var ErrExceeded = errors.New("quota exceeded")
+
+// Account counts bytes in both directions against a limit
+type Account struct {
+	up    int64
+	down  int64
+	limit int64 // limit of up and down in bytes, 0 for no limit
+	cut   int32 // 1 if connections are cut when exceeded
+}
+
+// SetLimit sets limit of account in bytes, 0 for no limit. If cut is
+// true, traffic after exceeded fails with ErrExceeded.
+func (a *Account) SetLimit(limit int64, cut bool) {
+	atomic.StoreInt64(&a.limit, limit)
+	var c int32
+	if cut {
+		c = 1
+	}
+	atomic.StoreInt32(&a.cut, c)
+}
+
+// Up returns bytes from client to target
+func (a *Account) Up() int64 { return atomic.LoadInt64(&a.up) }
+
+// Down returns bytes from target to client
+func (a *Account) Down() int64 { return atomic.LoadInt64(&a.down) }
+
+// Limit returns limit of account in bytes, 0 for no limit
+func (a *Account) Limit() int64 { return atomic.LoadInt64(&a.limit) }
+
+// Exceeded reports whether bytes of both directions reach limit
+func (a *Account) Exceeded() bool {
+	limit := a.Limit()
+	return limit > 0 && a.Up()+a.Down() >= limit
+}
+
+func (a *Account) reset() {
+	atomic.StoreInt64(&a.up, 0)
+	atomic.StoreInt64(&a.down, 0)
+}
+
+// meter counts bytes of one direction of account
+type meter struct {
+	a *Account
+	n *int64
+}
+
+func (m *meter) Take(n int) error {
+	atomic.AddInt64(m.n, int64(n))
+	if atomic.LoadInt32(&m.a.cut) == 1 && m.a.Exceeded() {
+		return ErrExceeded
+	}
+	return nil
+}
+
+// UpMeter returns limiter counting bytes from client to target
+func (a *Account) UpMeter() m_limit.Limiter { return &meter{a: a, n: &a.up} }
+
+// DownMeter returns limiter counting bytes from target to client
+func (a *Account) DownMeter() m_limit.Limiter { return &meter{a: a, n: &a.down} }
+
+// Book is a set of accounts, reset at start of each period of schedule
+type Book struct {
+	path     string
+	schedule Schedule
+	start    time.Time // start of current period
+	accounts map[string]*Account
+	lock     sync.Mutex
+	detached int32 // 1 if file is handed to another process
+}
+
+// record is the persisted form of Book
+type record struct {
+	Start    time.Time           `json:"start"`
+	Accounts map[string][2]int64 `json:"accounts"` // up and down bytes
+}
+
+// Open opens book persisted in path, which is created on first Save. Empty
+// path keeps book in memory only.
+func Open(path string, schedule Schedule) (*Book, error) {
+	b := &Book{
+		path:     path,
+		schedule: schedule,
+		start:    schedule.Start(time.Now()),
+		accounts: make(map[string]*Account),
+	}
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec record
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	b.start = rec.Start
+	for key, n := range rec.Accounts {
+		b.accounts[key] = &Account{up: n[0], down: n[1]}
+	}
+	b.CheckReset(time.Now())
+	return b, nil
+}
+
+// Account returns account of key, created if not exist
+func (b *Book) Account(key string) *Account {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	a, ok := b.accounts[key]
+	if !ok {
+		a = &Account{}
+		b.accounts[key] = a
+	}
+	return a
+}
+
+// Accounts returns a snapshot of up and down bytes of accounts
+func (b *Book) Accounts() map[string][2]int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	m := make(map[string][2]int64, len(b.accounts))
+	for key, a := range b.accounts {
+		m[key] = [2]int64{a.Up(), a.Down()}
+	}
+	return m
+}
+
+// CheckReset resets all accounts if a new period has started by now, and
+// reports whether they are reset.
+func (b *Book) CheckReset(now time.Time) bool {
+	start := b.schedule.Start(now)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !start.After(b.start) {
+		return false
+	}
+	for _, a := range b.accounts {
+		a.reset()
+	}
+	b.start = start
+	return true
+}
+
+// Detach stops saving book to its path, e.g. after the file is handed to
+// a new process on upgrade, which saves it from then on.
+func (b *Book) Detach() {
+	atomic.StoreInt32(&b.detached, 1)
+}
+
+// Save writes book to its path atomically, unless it is detached
+func (b *Book) Save() error {
+	if b.path == "" || atomic.LoadInt32(&b.detached) == 1 {
+		return nil
+	}
+	b.lock.Lock()
+	start := b.start
+	b.lock.Unlock()
+
+	data, err := json.MarshalIndent(record{Start: start, Accounts: b.Accounts()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return m_util.WriteFileAtomic(b.path, data, 0644)
+}
+
+// Run resets and saves book every interval until stop is closed, and saves
+// it at last.
+func (b *Book) Run(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if b.CheckReset(time.Now()) {
+				log.Logger.Info("quota: accounts reset for new period")
+			}
+		case <-stop:
+			if err := b.Save(); err != nil {
+				log.Logger.Warn("quota: failed to save %s: %v", b.path, err)
+			}
+			return
+		}
+		if err := b.Save(); err != nil {
+			log.Logger.Warn("quota: failed to save %s: %v", b.path, err)
+		}
+	}
+}
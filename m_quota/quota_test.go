@@ -0,0 +1,97 @@
+package m_quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleStart(t *testing.T) {
+	now := time.Date(2024, 3, 14, 15, 9, 26, 0, time.Local) // Thursday
+	for _, c := range []struct {
+		period string
+		day    int
+		want   time.Time
+	}{
+		{PeriodDaily, 0, time.Date(2024, 3, 14, 0, 0, 0, 0, time.Local)},
+		{PeriodWeekly, 0, time.Date(2024, 3, 11, 0, 0, 0, 0, time.Local)},
+		{PeriodMonthly, 0, time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		{PeriodMonthly, 20, time.Date(2024, 2, 20, 0, 0, 0, 0, time.Local)},
+		{PeriodNever, 0, time.Time{}},
+	} {
+		s, err := ParseSchedule(c.period, c.day)
+		if err != nil {
+			t.Fatalf("parse %s: %v", c.period, err)
+		}
+		if got := s.Start(now); !got.Equal(c.want) {
+			t.Fatalf("%s day %d: got %v, want %v", c.period, c.day, got, c.want)
+		}
+	}
+
+	if _, err := ParseSchedule("yearly", 0); err == nil {
+		t.Fatal("unknown period should fail")
+	}
+}
+
+func TestMeterCut(t *testing.T) {
+	var a Account
+	a.SetLimit(100, false)
+	if err := a.UpMeter().Take(150); err != nil || !a.Exceeded() {
+		t.Fatalf("exceeded account without cut: %v %v", err, a.Exceeded())
+	}
+
+	a.SetLimit(100, true)
+	if err := a.DownMeter().Take(1); err != ErrExceeded {
+		t.Fatalf("got %v, want %v", err, ErrExceeded)
+	}
+	if a.Up() != 150 || a.Down() != 1 {
+		t.Fatalf("bytes counted: %d %d", a.Up(), a.Down())
+	}
+}
+
+func TestBookPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, _ := ParseSchedule(PeriodMonthly, 1)
+
+	b, err := Open(path, s)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	b.Account("user:alice").UpMeter().Take(10)
+	b.Account("user:alice").DownMeter().Take(20)
+	if err = b.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	b, err = Open(path, s)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if a := b.Account("user:alice"); a.Up() != 10 || a.Down() != 20 {
+		t.Fatalf("loaded bytes: %d %d", a.Up(), a.Down())
+	}
+
+	// a new period resets accounts
+	if !b.CheckReset(time.Now().AddDate(0, 1, 0)) || b.Account("user:alice").Up() != 0 {
+		t.Fatal("accounts should be reset in next month")
+	}
+}
+
+func TestBookDetach(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, _ := ParseSchedule(PeriodMonthly, 1)
+
+	b, err := Open(path, s)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	b.Detach()
+	b.Account("user:alice").UpMeter().Take(10)
+	if err = b.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("detached book should not be saved: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package m_quota
+
+import (
+	"fmt"
+	"time"
+)
+
+// periods of resetting quota
+const (
+	PeriodNever   = "never"
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+)
+
+// Schedule is when accounts are reset, at 00:00 local time of each day, of
+// each Monday, or of Day of each month.
+type Schedule struct {
+	Period string
+	Day    int // day of month of monthly period, 1 to 28
+}
+
+// ParseSchedule checks period and day of month. Empty period is monthly
+// and day 0 is the first day.
+func ParseSchedule(period string, day int) (Schedule, error) {
+	switch period {
+	case "":
+		period = PeriodMonthly
+	case PeriodNever, PeriodDaily, PeriodWeekly, PeriodMonthly:
+	default:
+		return Schedule{}, fmt.Errorf("quota: unknown reset period %q", period)
+	}
+	if day == 0 {
+		day = 1
+	}
+	if day < 1 || day > 28 {
+		return Schedule{}, fmt.Errorf("quota: reset day %d not in 1-28", day)
+	}
+	return Schedule{Period: period, Day: day}, nil
+}
+
+// Start returns start of the period now is in, zero time if never reset.
+func (s Schedule) Start(now time.Time) time.Time {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	switch s.Period {
+	case PeriodDaily:
+		return today
+	case PeriodWeekly:
+		days := (int(today.Weekday()) + 6) % 7 // days since Monday
+		return today.AddDate(0, 0, -days)
+	case PeriodMonthly:
+		start := time.Date(y, m, s.Day, 0, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	}
+	return time.Time{}
+}
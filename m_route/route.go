@@ -0,0 +1,114 @@
+// Package m_route decides how local routes a target: through an upstream
+// server, directly, or not at all.
+//
+// In rule mode, targets are routed by an ordered list of rules like
+//
+//	direct 192.168.0.0/16
+//	direct example.cn
+//	block ads.example.com
+//	proxy *
+//
+// whose matchers are those of m_acl. The first rule matching a target
+// decides, and targets matching no rule are proxied. Domains are not
+// resolved for routing, so rules of CIDR only match IP targets.
+package m_route
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_acl"
+)
+
+// Mode is the routing mode of local
+type Mode string
+
+const (
+	ModeGlobal Mode = "global" // proxy all targets
+	ModeRule   Mode = "rule"   // route targets by rules
+	ModeDirect Mode = "direct" // connect to all targets directly
+)
+
+// ParseMode parses mode, global if s is empty.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(s)); m {
+	case "":
+		return ModeGlobal, nil
+	case ModeGlobal, ModeRule, ModeDirect:
+		return m, nil
+	}
+	return "", fmt.Errorf("route: bad mode %q", s)
+}
+
+// Action is how a target is routed
+type Action string
+
+const (
+	Proxy  Action = "proxy"  // through upstream server
+	Direct Action = "direct" // connect to target directly
+	Block  Action = "block"  // refuse target
+)
+
+// Rule routes targets matched by its matcher
+type Rule struct {
+	Action Action
+	Text   string
+	m      *m_acl.Matcher
+}
+
+// Rules is an ordered list of rules
+type Rules []Rule
+
+// Parse parses rules of form "proxy|direct|block matcher", empty lines and
+// lines starting with # are skipped.
+func Parse(lines []string) (Rules, error) {
+	var rules Rules
+	for _, s := range lines {
+		fields := strings.Fields(s)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("route: bad rule %q", s)
+		}
+		a := Action(strings.ToLower(fields[0]))
+		if a != Proxy && a != Direct && a != Block {
+			return nil, fmt.Errorf("route: bad action of rule %q", s)
+		}
+		m, err := m_acl.ParseMatcher(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("route: %v of rule %q", err, s)
+		}
+		rules = append(rules, Rule{Action: a, Text: strings.Join(fields, " "), m: m})
+	}
+	return rules, nil
+}
+
+// Lines returns text of rules
+func (rules Rules) Lines() []string {
+	lines := make([]string, len(rules))
+	for i, r := range rules {
+		lines[i] = r.Text
+	}
+	return lines
+}
+
+// Decide returns action of target host:port in mode, with text of the rule
+// deciding it, empty if no rule applies.
+func (rules Rules) Decide(mode Mode, host string, port int) (Action, string) {
+	switch mode {
+	case ModeDirect:
+		return Direct, ""
+	case ModeRule:
+		ip := net.ParseIP(host)
+		for _, r := range rules {
+			if r.m.Match(host, ip, port) {
+				return r.Action, r.Text
+			}
+		}
+	}
+	return Proxy, ""
+}
@@ -0,0 +1,64 @@
+package m_route
+
+import (
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	rules, err := Parse([]string{
+		"# private ranges",
+		"direct 192.168.0.0/16",
+		"",
+		"Direct example.cn",
+		"block ads.example.com",
+		"proxy :443",
+		"direct *",
+	})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(rules) != 5 || rules[1].Text != "Direct example.cn" {
+		t.Fatalf("unexpected rules: %v", rules.Lines())
+	}
+
+	cases := []struct {
+		host   string
+		port   int
+		action Action
+	}{
+		{"192.168.1.1", 80, Direct},
+		{"www.example.cn", 443, Direct},
+		{"ads.example.com", 80, Block},
+		{"example.com", 443, Proxy},
+		{"example.com", 80, Direct},
+	}
+	for _, c := range cases {
+		if a, _ := rules.Decide(ModeRule, c.host, c.port); a != c.action {
+			t.Errorf("%s:%d: got %s, want %s", c.host, c.port, a, c.action)
+		}
+	}
+
+	if a, _ := rules.Decide(ModeGlobal, "192.168.1.1", 80); a != Proxy {
+		t.Errorf("global: got %s", a)
+	}
+	if a, _ := rules.Decide(ModeDirect, "example.com", 443); a != Direct {
+		t.Errorf("direct: got %s", a)
+	}
+	if a, _ := Rules(nil).Decide(ModeRule, "example.com", 443); a != Proxy {
+		t.Errorf("no rules: got %s", a)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"proxy", "allow *", "direct 10.0.0.0/33", "block :70000"} {
+		if _, err := Parse([]string{s}); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+	if _, err := ParseMode("fast"); err == nil {
+		t.Error("bad mode should fail")
+	}
+	if m, err := ParseMode(""); err != nil || m != ModeGlobal {
+		t.Errorf("empty mode: got %s, %v", m, err)
+	}
+}
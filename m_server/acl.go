@@ -0,0 +1,75 @@
+package m_server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_dialer"
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+// resolveTimeout is the max time of resolving domain of target
+const resolveTimeout = 10 * time.Second
+
+// dialTarget connects to tgt if it is allowed by ACL of user u. Domain of
+// tgt is resolved here and only allowed IPs are dialed, so a domain
+// resolving to denied ranges is not reachable. Through outbound proxies,
+// targets are resolved by proxy and only IP literals are checked by IP.
+// Targets are dialed with source IP, interface and mark of u if it sets
+// them.
+func (srv *Server) dialTarget(tgt m_socks.Addr, u *user) (net.Conn, error) {
+	addr := tgt.String()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	dialer := srv.dialer
+	if u.dialer != nil {
+		dialer = u.dialer
+	}
+	d, ok := dialer.(m_dialer.IPDialer)
+	if !ok {
+		if err = u.acl.Check(host, net.ParseIP(host), port); err != nil {
+			log.Logger.Warn("acl: user %s: %v", u.name, err)
+			return nil, err
+		}
+		return dialer.Dial("tcp", addr)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		srv.metrics.dnsDuration.With().Observe(time.Since(start).Seconds())
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	allowed := ips[:0:0]
+	for _, ip := range ips {
+		if err = u.acl.Check(host, ip, port); err != nil {
+			log.Logger.Warn("acl: user %s: %v", u.name, err)
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		return nil, err
+	}
+	return d.DialIPs("tcp", addr, allowed)
+}
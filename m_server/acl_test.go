@@ -0,0 +1,114 @@
+package m_server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+// startUser starts local of user with password connected to server of sc,
+// returns address of local.
+func startUser(t *testing.T, sc m_config.Conf, password string) string {
+	_, lc := testConfigs(t)
+	lc.Server.RemoteServer = fmt.Sprintf("127.0.0.1:%d", sc.Server.Port)
+	lc.Server.Password = password
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	return fmt.Sprintf("127.0.0.1:%d", lc.Server.Port)
+}
+
+// checkDenied checks connection to target through local is closed
+func checkDenied(t *testing.T, local, target string) {
+	c, err := socksDial(local, target)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := io.ReadFull(c, make([]byte, 5)); err == nil {
+		t.Fatalf("%s should be denied, read %d bytes", target, n)
+	}
+}
+
+func TestUserACL(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, _ := testConfigs(t)
+	sc.Server.AclDenyPrivate = true
+	sc.User = map[string]*m_config.ConfigUser{
+		"alice": {Password: "alice-secret", Acl: []string{"allow 127.0.0.1"}},
+		"bob":   {Password: "bob-secret"},
+	}
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	alice := startUser(t, sc, "alice-secret")
+	c, err := socksDial(alice, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c, "hello")
+	c.Close()
+
+	// loopback is denied by default and domain is checked after resolved
+	bob := startUser(t, sc, "bob-secret")
+	checkDenied(t, bob, echo.Addr().String())
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	checkDenied(t, bob, "localhost:"+port)
+
+	// unknown user is drained
+	checkDenied(t, startUser(t, sc, "wrong"), echo.Addr().String())
+}
+
+func TestUserBind(t *testing.T) {
+	// target replies with source IP of client
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			c.Write([]byte(host))
+			c.Close()
+		}
+	}()
+
+	sc, _ := testConfigs(t)
+	sc.User = map[string]*m_config.ConfigUser{
+		"alice": {Password: "alice-secret", BindIp: "127.0.0.2"},
+		"bob":   {Password: "bob-secret"},
+	}
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	for _, c := range []struct{ password, want string }{
+		{"alice-secret", "127.0.0.2"},
+		{"bob-secret", "127.0.0.1"},
+	} {
+		conn, err := socksDial(startUser(t, sc, c.password), l.Addr().String())
+		if err != nil {
+			t.Fatalf("socks dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, len(c.want))
+		io.ReadFull(conn, b)
+		conn.Close()
+		if string(b) != c.want {
+			t.Errorf("source of %s: got %q, want %q", c.password, b, c.want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package m_server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+)
+
+// adminAuth wraps h to require AdminToken as bearer token. Admin API is
+// disabled if AdminToken is empty.
+func (srv *Server) adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := srv.Config.Server.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !bearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// bearer reports whether r carries token as bearer token
+func bearer(r *http.Request, token string) bool {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// serveConns serves connection table:
+//
+//	GET    /admin/conns       list relays, filtered by query client, user, target, upstream
+//	GET    /admin/conns/{id}  get a relay
+//	DELETE /admin/conns/{id}  terminate a relay
+func (srv *Server) serveConns(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/conns"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		writeJSON(w, srv.conns.list(&connFilter{
+			Client:   q.Get("client"),
+			User:     q.Get("user"),
+			Target:   q.Get("target"),
+			Upstream: q.Get("upstream"),
+		}))
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(path, "/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	e := srv.conns.get(id)
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, e.info())
+	case http.MethodDelete:
+		e.kill()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// userInfo is a user with its usage in admin API, password is only shown
+// when it is created or rotated.
+type userInfo struct {
+	Name         string   `json:"name"`
+	Password     string   `json:"password,omitempty"`
+	Acl          []string `json:"acl,omitempty"`
+	Disabled     bool     `json:"disabled"`
+	UploadRate   int      `json:"upload_rate"`
+	DownloadRate int      `json:"download_rate"`
+	Quota        int      `json:"quota"`
+
+	BindIp        string `json:"bind_ip,omitempty"`
+	BindInterface string `json:"bind_interface,omitempty"`
+	SoMark        int    `json:"so_mark,omitempty"`
+
+	Up    int64 `json:"up"`    // bytes from clients in current period
+	Down  int64 `json:"down"`  // bytes to clients in current period
+	Limit int64 `json:"limit"` // quota in bytes, 0 for no limit
+	Conns int   `json:"conns"` // client connections open
+}
+
+func (u *user) info() userInfo {
+	info := userInfo{
+		Name:         u.name,
+		Acl:          u.spec.Acl,
+		Disabled:     u.spec.Disabled,
+		UploadRate:   u.spec.UploadRate,
+		DownloadRate: u.spec.DownloadRate,
+		Quota:        u.spec.Quota,
+		Conns:        u.conns.len(),
+
+		BindIp:        u.spec.BindIp,
+		BindInterface: u.spec.BindInterface,
+		SoMark:        u.spec.SoMark,
+	}
+	if u.account != nil {
+		info.Up, info.Down, info.Limit = u.account.Up(), u.account.Down(), u.account.Limit()
+	}
+	return info
+}
+
+// userPatch is the changes of a user, nil fields are not changed
+type userPatch struct {
+	Password     *string   `json:"password"`
+	Acl          *[]string `json:"acl"`
+	Disabled     *bool     `json:"disabled"`
+	UploadRate   *int      `json:"upload_rate"`
+	DownloadRate *int      `json:"download_rate"`
+	Quota        *int      `json:"quota"`
+
+	BindIp        *string `json:"bind_ip"`
+	BindInterface *string `json:"bind_interface"`
+	SoMark        *int    `json:"so_mark"`
+}
+
+func (p *userPatch) apply(spec *userSpec) error {
+	if p.Password != nil {
+		if *p.Password == "" {
+			return errors.New("empty password")
+		}
+		spec.Password = *p.Password
+	}
+	if p.Acl != nil {
+		spec.Acl = *p.Acl
+	}
+	if p.Disabled != nil {
+		spec.Disabled = *p.Disabled
+	}
+	if p.UploadRate != nil {
+		spec.UploadRate = *p.UploadRate
+	}
+	if p.DownloadRate != nil {
+		spec.DownloadRate = *p.DownloadRate
+	}
+	if p.Quota != nil {
+		spec.Quota = *p.Quota
+	}
+	if p.BindIp != nil {
+		spec.BindIp = *p.BindIp
+	}
+	if p.BindInterface != nil {
+		spec.BindInterface = *p.BindInterface
+	}
+	if p.SoMark != nil {
+		spec.SoMark = *p.SoMark
+	}
+	if spec.UploadRate < 0 || spec.DownloadRate < 0 || spec.Quota < 0 {
+		return errors.New("negative rate or quota")
+	}
+	return nil
+}
+
+// serveUsers manages users of server, changes are persisted to
+// UserStateFile and applied to new connections at once:
+//
+//	GET    /admin/users             list users with usage
+//	POST   /admin/users             create a user, password is generated if empty
+//	GET    /admin/users/{name}      get a user
+//	PATCH  /admin/users/{name}      change password, acl, disabled, rates, quota or egress
+//	DELETE /admin/users/{name}      remove a user
+//	POST   /admin/users/{name}/key  rotate password to a generated one
+//
+// Connections of a user are closed when it is removed, disabled or its
+// password changes, connections of other users are not affected.
+func (srv *Server) serveUsers(w http.ResponseWriter, r *http.Request) {
+	if srv.Config.Server.Local {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			users := srv.userList()
+			infos := make([]userInfo, len(users))
+			for i, u := range users {
+				infos[i] = u.info()
+			}
+			writeJSON(w, infos)
+		case http.MethodPost:
+			srv.createUser(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	name, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	users := srv.userList()
+	i, found := findUser(users, name)
+	if !found || (action != "" && action != "key") {
+		http.NotFound(w, r)
+		return
+	}
+	u := users[i]
+
+	switch {
+	case action == "key" && r.Method == http.MethodPost:
+		password, err := newPassword()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		spec := u.spec
+		spec.Password = password
+		srv.updateUser(w, spec, true)
+	case action == "key":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == http.MethodGet:
+		writeJSON(w, u.info())
+	case r.Method == http.MethodPatch:
+		var p userPatch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec := u.spec
+		if err := p.apply(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		srv.updateUser(w, spec, false)
+	case r.Method == http.MethodDelete:
+		found, err := srv.deleteUser(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		log.Logger.Info("admin: user %s removed", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (srv *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var spec userSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if spec.Name == "" || strings.Contains(spec.Name, "/") {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	if spec.UploadRate < 0 || spec.DownloadRate < 0 || spec.Quota < 0 {
+		http.Error(w, "negative rate or quota", http.StatusBadRequest)
+		return
+	}
+	if spec.Password == "" {
+		password, err := newPassword()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		spec.Password = password
+	}
+
+	u, err := srv.putUser(spec, false)
+	switch {
+	case err == errUserExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Logger.Info("admin: user %s created", spec.Name)
+	info := u.info()
+	info.Password = spec.Password
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, info)
+}
+
+// updateUser replaces user of spec.Name, with password in response if
+// showPassword is set.
+func (srv *Server) updateUser(w http.ResponseWriter, spec userSpec, showPassword bool) {
+	u, err := srv.putUser(spec, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Logger.Info("admin: user %s updated", spec.Name)
+	info := u.info()
+	if showPassword {
+		info.Password = spec.Password
+	}
+	writeJSON(w, info)
+}
+
+// serveReload reloads config file:
+//
+//	POST /admin/reload  apply changes of config, or report why it is invalid
+func (srv *Server) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	change, err := srv.reload()
+	if err != nil {
+		log.Logger.Warn("admin: failed to reload config: %v", err)
+		code := http.StatusBadRequest
+		if err == errShuttingDown {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, change)
+}
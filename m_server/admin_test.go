@@ -0,0 +1,220 @@
+package m_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+func adminRequest(t *testing.T, method, url, token string) *http.Response {
+	return adminRequestBody(t, method, url, token, "")
+}
+
+func adminRequestBody(t *testing.T, method, url, token, body string) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	return resp
+}
+
+func TestAdminConns(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	lc.Server.MonitorPort = freePort(t)
+	lc.Server.AdminToken = "secret"
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+
+	base := fmt.Sprintf("http://127.0.0.1:%d/admin/conns", lc.Server.MonitorPort)
+	resp := adminRequest(t, "GET", base, "wrong")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong token: got %d", resp.StatusCode)
+	}
+
+	resp = adminRequest(t, "GET", base+"?target="+echo.Addr().String(), "secret")
+	var conns []connInfo
+	json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if len(conns) != 1 || conns[0].Target != echo.Addr().String() || conns[0].Up != 5 || conns[0].Down != 5 {
+		t.Fatalf("unexpected conns: %+v", conns)
+	}
+
+	url := fmt.Sprintf("%s/%d", base, conns[0].ID)
+	resp = adminRequest(t, "DELETE", url, "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kill: got %d", resp.StatusCode)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(c, make([]byte, 1)); err == nil {
+		t.Fatal("connection should be closed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	resp = adminRequest(t, "GET", url, "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("killed conn: got %d", resp.StatusCode)
+	}
+}
+
+func decodeUser(t *testing.T, resp *http.Response, status int) userInfo {
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("got %d, want %d", resp.StatusCode, status)
+	}
+	var info userInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("decode user: %v", err)
+	}
+	return info
+}
+
+func TestAdminUsers(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, _ := testConfigs(t)
+	sc.Server.MonitorPort = freePort(t)
+	sc.Server.AdminToken = "secret"
+	sc.Server.UserStateFile = filepath.Join(t.TempDir(), "users.json")
+	sc.User = map[string]*m_config.ConfigUser{"alice": {Password: "alice-secret"}}
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	base := fmt.Sprintf("http://127.0.0.1:%d/admin/users", sc.Server.MonitorPort)
+
+	bob := decodeUser(t, adminRequestBody(t, "POST", base, "secret", `{"name":"bob","quota":10}`), http.StatusCreated)
+	if bob.Password == "" || bob.Quota != 10 || bob.Limit != 10<<20 {
+		t.Fatalf("unexpected user: %+v", bob)
+	}
+	resp := adminRequestBody(t, "POST", base, "secret", `{"name":"bob"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("duplicate user: got %d", resp.StatusCode)
+	}
+
+	aliceLocal := startUser(t, sc, "alice-secret")
+	bobLocal := startUser(t, sc, bob.Password)
+	ac, err := socksDial(aliceLocal, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer ac.Close()
+	checkEcho(t, ac, "hello")
+	bc, err := socksDial(bobLocal, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer bc.Close()
+	checkEcho(t, bc, "hello")
+
+	// disabling bob closes its connections only
+	info := decodeUser(t, adminRequestBody(t, "PATCH", base+"/bob", "secret", `{"disabled":true}`), http.StatusOK)
+	if !info.Disabled {
+		t.Fatalf("bob should be disabled: %+v", info)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if info = decodeUser(t, adminRequest(t, "GET", base+"/bob", "secret"), http.StatusOK); info.Conns != 0 {
+		t.Fatalf("connections of bob should be closed: %+v", info)
+	}
+	checkEcho(t, ac, "still alive")
+	checkDenied(t, bobLocal, echo.Addr().String())
+
+	// rotated key replaces the old one
+	info = decodeUser(t, adminRequest(t, "POST", base+"/alice/key", "secret"), http.StatusOK)
+	if info.Password == "" || info.Password == "alice-secret" {
+		t.Fatalf("password should be rotated: %+v", info)
+	}
+	checkDenied(t, aliceLocal, echo.Addr().String())
+	c, err := socksDial(startUser(t, sc, info.Password), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c, "hello")
+	c.Close()
+
+	resp = adminRequest(t, "GET", base, "secret")
+	var users []userInfo
+	json.NewDecoder(resp.Body).Decode(&users)
+	resp.Body.Close()
+	if len(users) != 2 || users[0].Name != "alice" || users[0].Up < 10 || users[1].Name != "bob" {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+
+	// state file overrides config
+	srv := NewServer(sc, "", "test")
+	if err = srv.loadUsers(); err != nil {
+		t.Fatalf("load users: %v", err)
+	}
+	loaded := srv.userList()
+	if len(loaded) != 2 || loaded[0].spec.Password != info.Password || !loaded[1].spec.Disabled {
+		t.Fatalf("unexpected users in state file: %+v, %+v", loaded[0].spec, loaded[1].spec)
+	}
+
+	resp = adminRequest(t, "DELETE", base+"/bob", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %d", resp.StatusCode)
+	}
+	resp = adminRequest(t, "GET", base+"/bob", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleted user: got %d", resp.StatusCode)
+	}
+}
+
+func TestUsersStreamCipher(t *testing.T) {
+	sc, _ := testConfigs(t)
+	sc.Server.Cipher = "DUMMY"
+	sc.User = map[string]*m_config.ConfigUser{
+		"alice": {Password: "alice-secret"},
+		"bob":   {Password: "bob-secret"},
+	}
+	srv := NewServer(sc, "", "test")
+	if err := srv.loadUsers(); !errors.Is(err, errUsersCipher) {
+		t.Fatalf("two users of stream cipher: got %v", err)
+	}
+
+	cfg := sc
+	cfg.User = map[string]*m_config.ConfigUser{"alice": {Password: "alice-secret"}}
+	srv = NewServer(cfg, "", "test")
+	if err := srv.loadUsers(); err != nil {
+		t.Fatalf("one user of stream cipher: %v", err)
+	}
+	if err := srv.reloadUsers(&sc); !errors.Is(err, errUsersCipher) {
+		t.Fatalf("reload two users of stream cipher: got %v", err)
+	}
+	if _, err := srv.putUser(userSpec{Name: "bob", Password: "bob-secret"}, false); err != errUsersCipher {
+		t.Fatalf("add user of stream cipher: got %v", err)
+	}
+	if users := srv.userList(); len(users) != 1 || users[0].name != "alice" {
+		t.Fatalf("users changed: %d users", len(users))
+	}
+}
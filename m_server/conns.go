@@ -0,0 +1,152 @@
+package m_server
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_route"
+)
+
+// connEntry is an active relay in connection table
+type connEntry struct {
+	id       uint64
+	client   string
+	user     string
+	target   string
+	upstream string         // upstream on local, address of target dialed on server
+	route    m_route.Action // routing decision on local
+	rule     string         // rule deciding route, empty for mode
+	start    time.Time
+
+	up         int64 // bytes from client
+	down       int64 // bytes to client
+	lastActive int64 // unix nano of last transfer
+
+	left, right net.Conn
+}
+
+// connInfo is a snapshot of connEntry
+type connInfo struct {
+	ID         uint64         `json:"id"`
+	Client     string         `json:"client"`
+	User       string         `json:"user"`
+	Target     string         `json:"target"`
+	Upstream   string         `json:"upstream"`
+	Route      m_route.Action `json:"route,omitempty"`
+	Rule       string         `json:"rule,omitempty"`
+	Start      time.Time      `json:"start"`
+	Up         int64          `json:"up"`
+	Down       int64          `json:"down"`
+	LastActive time.Time      `json:"last_active"`
+}
+
+func (e *connEntry) info() connInfo {
+	return connInfo{
+		ID:         e.id,
+		Client:     e.client,
+		User:       e.user,
+		Target:     e.target,
+		Upstream:   e.upstream,
+		Route:      e.route,
+		Rule:       e.rule,
+		Start:      e.start,
+		Up:         atomic.LoadInt64(&e.up),
+		Down:       atomic.LoadInt64(&e.down),
+		LastActive: time.Unix(0, atomic.LoadInt64(&e.lastActive)),
+	}
+}
+
+// kill terminates relay by closing both sides
+func (e *connEntry) kill() {
+	e.left.Close()
+	e.right.Close()
+}
+
+// activity counts bytes of one direction of relay
+type activity struct {
+	e *connEntry
+	n *int64
+}
+
+func (a activity) Take(n int) error {
+	atomic.AddInt64(a.n, int64(n))
+	atomic.StoreInt64(&a.e.lastActive, time.Now().UnixNano())
+	return nil
+}
+
+// connTable is the registry of active relays
+type connTable struct {
+	lock   sync.Mutex
+	nextID uint64
+	conns  map[uint64]*connEntry
+}
+
+func newConnTable() *connTable {
+	return &connTable{conns: make(map[uint64]*connEntry)}
+}
+
+// add registers relay between left of client and right of target
+func (t *connTable) add(e *connEntry) *connEntry {
+	now := time.Now()
+	e.start = now
+	e.lastActive = now.UnixNano()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nextID++
+	e.id = t.nextID
+	t.conns[e.id] = e
+	return e
+}
+
+func (t *connTable) remove(e *connEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, e.id)
+}
+
+func (t *connTable) get(id uint64) *connEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conns[id]
+}
+
+// connFilter selects relays whose fields contain the non-empty ones
+type connFilter struct {
+	Client   string
+	User     string
+	Target   string
+	Upstream string
+}
+
+func (f *connFilter) match(e *connEntry) bool {
+	return strings.Contains(e.client, f.Client) &&
+		(f.User == "" || e.user == f.User) &&
+		strings.Contains(e.target, f.Target) &&
+		strings.Contains(e.upstream, f.Upstream)
+}
+
+// list returns relays selected by f sorted by ID
+func (t *connTable) list(f *connFilter) []connInfo {
+	t.lock.Lock()
+	entries := make([]*connEntry, 0, len(t.conns))
+	for _, e := range t.conns {
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	t.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	infos := make([]connInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e.info()
+	}
+	return infos
+}
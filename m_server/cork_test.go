@@ -0,0 +1,115 @@
+package m_server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writesConn records writes to it
+type writesConn struct {
+	net.Conn
+	lock   sync.Mutex
+	writes [][]byte
+}
+
+func (c *writesConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *writesConn) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.writes)
+}
+
+func TestCorkTimer(t *testing.T) {
+	var stats Stats
+	wc := &writesConn{}
+	c := timedCork(wc, 20*time.Millisecond, 1280, 0, &stats)
+	c.Write([]byte("salt"))
+	c.Write([]byte("addr"))
+	c.Write([]byte("data"))
+	if wc.count() != 0 {
+		t.Fatalf("writes flushed before delay")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if wc.count() != 1 || string(wc.writes[0]) != "saltaddrdata" {
+		t.Fatalf("unexpected writes: %q", wc.writes)
+	}
+	if atomic.LoadInt64(&stats.CorkTimerFlush) != 1 {
+		t.Fatalf("timer flush not counted: %+v", stats)
+	}
+	c.Write([]byte("more"))
+	if wc.count() != 2 {
+		t.Fatalf("write after flush is held")
+	}
+}
+
+func TestCorkBuffer(t *testing.T) {
+	var stats Stats
+	wc := &writesConn{}
+	c := timedCork(wc, time.Hour, 16, 0, &stats)
+	c.Write([]byte("salt"))
+	c.Write(make([]byte, 32))
+	if wc.count() == 0 || stats.CorkBufferFlush != 1 {
+		t.Fatalf("full buffer not flushed: %d writes, %+v", wc.count(), stats)
+	}
+}
+
+func TestCorkAdaptive(t *testing.T) {
+	var stats Stats
+	wc := &writesConn{}
+	c := timedCork(wc, time.Hour, 1280, 3, &stats)
+	c.Write([]byte("salt"))
+	c.Write([]byte("addr"))
+	if wc.count() != 0 {
+		t.Fatalf("header flushed before payload")
+	}
+	c.Write([]byte("data"))
+	if wc.count() != 1 || string(wc.writes[0]) != "saltaddrdata" || stats.CorkEarlyFlush != 1 {
+		t.Fatalf("unexpected writes: %q, %+v", wc.writes, stats)
+	}
+}
+
+func TestCorkListeners(t *testing.T) {
+	sc, lc := testConfigs(t)
+	lc.Server.CorkDelay = 10
+	lc.Server.SocksCorkBufSize = 16
+	lc.Server.ReverseCorkDelay = -1
+	srv := NewServer(lc, "", "test")
+
+	// socks listener corks with buffer of its own and global delay
+	wc := &writesConn{}
+	c := srv.cork(wc, "socks", 1)
+	c.Write([]byte("salt"))
+	if wc.count() != 0 {
+		t.Fatal("socks stream not corked")
+	}
+	c.Write(make([]byte, 32))
+	if wc.count() == 0 || srv.stats.CorkBufferFlush != 1 {
+		t.Fatalf("buffer of socks listener not flushed: %d writes", wc.count())
+	}
+
+	// reverse tunnel disables cork
+	wc = &writesConn{}
+	if c = srv.cork(wc, "reverse", 2); c != net.Conn(wc) {
+		t.Fatal("reverse stream corked")
+	}
+
+	// both fall back to global settings
+	srv = NewServer(sc, "", "test")
+	for _, name := range []string{"socks", "reverse"} {
+		wc = &writesConn{}
+		c = srv.cork(wc, name, 1)
+		c.Write(make([]byte, 32))
+		if wc.count() != 0 {
+			t.Fatalf("%s: stream not corked by global settings", name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package m_server
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_route"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardAuth wraps h to require AdminToken as bearer token if it is
+// set. Without AdminToken dashboard is read only, open to whoever reaches
+// monitor, which listens on loopback by default. Requests from pages of
+// other sites, e.g. by DNS rebinding, are refused.
+func (srv *Server) dashboardAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.sameOrigin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		token := srv.Config.Server.AdminToken
+		if token == "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read only without AdminToken", http.StatusForbidden)
+			return
+		}
+		if token != "" && !bearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// sameOrigin reports whether r is sent to monitor by address, localhost or
+// MonitorHost, and from page of the same origin if it has Origin.
+func (srv *Server) sameOrigin(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	if net.ParseIP(host) == nil && host != "localhost" && host != srv.Config.Server.MonitorHost {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+// routeInfo is the routing settings with upstreams to choose from
+type routeInfo struct {
+	routeState
+	Upstreams []string `json:"upstreams"`
+}
+
+// routePatch is the changes of routing, nil fields are not changed
+type routePatch struct {
+	Mode     *m_route.Mode `json:"mode"`
+	Upstream *string       `json:"upstream"`
+	Rules    *[]string     `json:"rules"`
+}
+
+// serveRoute serves routing of local:
+//
+//	GET /dashboard/api/route  get mode, upstream and rules
+//	PUT /dashboard/api/route  change mode, upstream or rules
+func (srv *Server) serveRoute(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var p routePatch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state := srv.route.state()
+		if p.Mode != nil {
+			state.Mode = *p.Mode
+		}
+		if p.Upstream != nil {
+			state.Upstream = *p.Upstream
+		}
+		if p.Rules != nil {
+			state.Rules = *p.Rules
+		}
+		if err := srv.setRoute(state); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Logger.Info("dashboard: route set to mode %s, upstream %s, %d rules",
+			state.Mode, state.Upstream, len(state.Rules))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, routeInfo{routeState: srv.route.state(), Upstreams: srv.route.upstreamList()})
+}
+
+// dashboardHandler returns handler of dashboard of local, the embedded web
+// UI on /dashboard/ and API used by it on /dashboard/api/.
+func (srv *Server) dashboardHandler() http.Handler {
+	mux := http.NewServeMux()
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(files))))
+	mux.HandleFunc("/dashboard/api/route", srv.dashboardAuth(srv.serveRoute))
+	mux.HandleFunc("/dashboard/api/stats", srv.dashboardAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.status())
+	}))
+	mux.HandleFunc("/dashboard/api/conns", srv.dashboardAuth(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		writeJSON(w, srv.conns.list(&connFilter{Client: q.Get("client"), Target: q.Get("target")}))
+	}))
+	return mux
+}
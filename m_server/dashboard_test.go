@@ -0,0 +1,170 @@
+package m_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_plugin"
+	"github.com/zyong/miniproxygo/m_route"
+)
+
+func TestDashboard(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	sc, lc := testConfigs(t)
+	lc.Server.MonitorPort = freePort(t)
+	lc.Server.AdminToken = "secret"
+	lc.Server.Upstream = []string{"127.0.0.1:1"}
+	lc.Server.RouteStateFile = filepath.Join(t.TempDir(), "route.json")
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	local := fmt.Sprintf("127.0.0.1:%d", lc.Server.Port)
+	base := fmt.Sprintf("http://127.0.0.1:%d/dashboard/", lc.Server.MonitorPort)
+
+	resp, err := http.Get(base)
+	if err != nil {
+		t.Fatalf("get dashboard: %v", err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "/dashboard/api/") {
+		t.Fatalf("dashboard page: got %d", resp.StatusCode)
+	}
+	resp = adminRequest(t, "GET", base+"api/route", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("route without token: got %d", resp.StatusCode)
+	}
+
+	setRoute := func(body string, status int) routeInfo {
+		resp := adminRequestBody(t, "PUT", base+"api/route", "secret", body)
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("set route %s: got %d, want %d", body, resp.StatusCode, status)
+		}
+		var info routeInfo
+		json.NewDecoder(resp.Body).Decode(&info)
+		return info
+	}
+	// checkRoute checks a connection to echo is routed by action
+	checkRoute := func(action m_route.Action) {
+		c, err := socksDial(local, echo.Addr().String())
+		if err != nil {
+			t.Fatalf("socks dial: %v", err)
+		}
+		defer c.Close()
+		checkEcho(t, c, "hello")
+
+		resp := adminRequest(t, "GET", base+"api/conns?target="+echo.Addr().String(), "secret")
+		var conns []connInfo
+		json.NewDecoder(resp.Body).Decode(&conns)
+		resp.Body.Close()
+		// relays of earlier connections may linger until client closes
+		if len(conns) == 0 || conns[len(conns)-1].Route != action {
+			t.Fatalf("conns routed by %s: %+v", action, conns)
+		}
+	}
+
+	checkRoute(m_route.Proxy)
+
+	info := setRoute(`{"mode":"direct"}`, http.StatusOK)
+	if info.Mode != m_route.ModeDirect || len(info.Upstreams) != 2 {
+		t.Fatalf("unexpected route: %+v", info)
+	}
+	checkRoute(m_route.Direct)
+
+	setRoute(`{"mode":"rule","rules":["block :`+echoPort+`"]}`, http.StatusOK)
+	checkDenied(t, local, echo.Addr().String())
+	setRoute(`{"rules":["bad"]}`, http.StatusBadRequest)
+
+	setRoute(`{"mode":"global","upstream":"127.0.0.1:2"}`, http.StatusBadRequest)
+	info = setRoute(`{"mode":"global","upstream":"127.0.0.1:1"}`, http.StatusOK)
+	if info.Upstream != "127.0.0.1:1" || info.Rules[0] != "block :"+echoPort {
+		t.Fatalf("unexpected route: %+v", info)
+	}
+	checkDenied(t, local, echo.Addr().String())
+
+	// state file overrides config
+	srv := NewServer(lc, "", "test")
+	if err = srv.loadRoute(); err != nil {
+		t.Fatalf("load route: %v", err)
+	}
+	if st := srv.route.state(); st.Mode != m_route.ModeGlobal || st.Upstream != "127.0.0.1:1" || len(st.Rules) != 1 {
+		t.Fatalf("unexpected route in state file: %+v", st)
+	}
+}
+
+func TestDashboardReadOnly(t *testing.T) {
+	_, lc := testConfigs(t)
+	srv := NewServer(lc, "", "test")
+	if err := srv.loadRoute(); err != nil {
+		t.Fatalf("load route: %v", err)
+	}
+	h := srv.dashboardHandler()
+
+	for _, c := range []struct {
+		method, host, origin string
+		status               int
+	}{
+		{"GET", "127.0.0.1:9000", "", http.StatusOK},
+		{"GET", "localhost:9000", "http://localhost:9000", http.StatusOK},
+		{"GET", "[::1]:9000", "", http.StatusOK},
+		// without AdminToken route can not be changed
+		{"PUT", "127.0.0.1:9000", "", http.StatusForbidden},
+		// DNS rebinding and pages of other sites
+		{"GET", "evil.example:9000", "", http.StatusForbidden},
+		{"GET", "127.0.0.1:9000", "http://evil.example", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(c.method, "/dashboard/api/route", strings.NewReader(`{"mode":"direct"}`))
+		req.Host = c.host
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s from %s %s: got %d, want %d", c.method, c.host, c.origin, w.Code, c.status)
+		}
+	}
+	if st := srv.route.state(); st.Mode != m_route.ModeGlobal {
+		t.Fatalf("route changed without AdminToken: %+v", st)
+	}
+}
+
+func TestDashboardPlugin(t *testing.T) {
+	_, lc := testConfigs(t)
+	srv := NewServer(lc, "", "test")
+	// plugin replaced RemoteServer with its own address
+	remote := srv.Config.Server.RemoteServer
+	srv.plugin = &m_plugin.Plugin{Remote: remote}
+	srv.Config.Server.RemoteServer = "127.0.0.1:1"
+	if err := srv.loadRoute(); err != nil {
+		t.Fatalf("load route: %v", err)
+	}
+	if up := srv.route.upstreamList(); len(up) != 1 || up[0] != remote || srv.route.current() != remote {
+		t.Fatalf("upstreams shown: %v", up)
+	}
+	if addr := srv.upstreamAddr(remote); addr != "127.0.0.1:1" {
+		t.Fatalf("RemoteServer dialed at %s, not through plugin", addr)
+	}
+
+	lc.Server.Plugin = "obfs-local"
+	lc.Server.Upstream = []string{"127.0.0.1:2"}
+	if err := checkConfig(&lc.Server); err == nil {
+		t.Fatal("Upstream should be refused with Plugin")
+	}
+}
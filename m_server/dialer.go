@@ -0,0 +1,56 @@
+package m_server
+
+import (
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_dialer"
+)
+
+// PickDialer creates outbound dialer according to config, which dials
+// RemoteServer on local and targets on server.
+func (srv *Server) PickDialer() (m_dialer.Dialer, error) {
+	cfg := &srv.Config.Server
+	return srv.newDialer(cfg.BindIp, cfg.BindInterface, cfg.SoMark)
+}
+
+// userDialer creates dialer of targets bound to source IP, interface and
+// mark of spec, falling back to those of server. It returns nil if spec
+// sets none of them, and dialer of server is used.
+func (srv *Server) userDialer(spec *userSpec) (m_dialer.Dialer, error) {
+	if spec.BindIp == "" && spec.BindInterface == "" && spec.SoMark == 0 {
+		return nil, nil
+	}
+	cfg := &srv.Config.Server
+	ip, iface, mark := spec.BindIp, spec.BindInterface, spec.SoMark
+	if ip == "" {
+		ip = cfg.BindIp
+	}
+	if iface == "" {
+		iface = cfg.BindInterface
+	}
+	if mark == 0 {
+		mark = cfg.SoMark
+	}
+	return srv.newDialer(ip, iface, mark)
+}
+
+// newDialer creates outbound dialer bound to source ip, interface iface
+// and mark, with policy and proxies of config.
+func (srv *Server) newDialer(ip, iface string, mark int) (m_dialer.Dialer, error) {
+	cfg := &srv.Config.Server
+
+	direct, err := m_dialer.NewDirect(&m_dialer.DirectOptions{
+		LocalIP:   ip,
+		Interface: iface,
+		Mark:      mark,
+
+		Policy:        cfg.DialPolicy,
+		FallbackDelay: time.Duration(cfg.DialFallbackDelay) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m_dialer.Chain(direct, cfg.OutboundProxy)
+}
@@ -0,0 +1,167 @@
+package m_server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_acl"
+	"github.com/zyong/miniproxygo/m_limit"
+)
+
+const (
+	maxRejectDrains    = 256             // max rejected connections drained at once
+	rejectDrainTimeout = 5 * time.Second // max time to drain a rejected connection
+)
+
+var (
+	errTooManyConns      = errors.New("too many connections")
+	errTooManyConnsPerIp = errors.New("too many connections from ip")
+	errAcceptRate        = errors.New("accept rate exceeded")
+)
+
+// clientCount counts concurrent client connections of all listeners
+type clientCount struct {
+	total int
+	perIp map[string]int
+	lock  sync.Mutex
+}
+
+func newClientCount() *clientCount {
+	return &clientCount{perIp: make(map[string]int)}
+}
+
+// acquire counts a connection from ip unless caps are reached, 0 for no cap
+func (cc *clientCount) acquire(ip string, max, maxPerIp int) error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if max > 0 && cc.total >= max {
+		return errTooManyConns
+	}
+	if maxPerIp > 0 && cc.perIp[ip] >= maxPerIp {
+		return errTooManyConnsPerIp
+	}
+	cc.total++
+	cc.perIp[ip]++
+	return nil
+}
+
+func (cc *clientCount) release(ip string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.total--
+	if cc.perIp[ip]--; cc.perIp[ip] <= 0 {
+		delete(cc.perIp, ip)
+	}
+}
+
+// guardListener rejects connections of clients denied by ACL, beyond
+// connection caps or accept rate.
+type guardListener struct {
+	net.Listener
+	srv    *Server
+	acl    atomic.Value // *m_acl.ACL, replaced on reload
+	bucket *m_limit.Bucket
+}
+
+// guard wraps listener l with ACL of client rules and limits of config.
+func (srv *Server) guard(l net.Listener, rules []string) (net.Listener, error) {
+	cfg := &srv.Config.Server
+
+	acl, err := m_acl.Parse(rules)
+	if err != nil {
+		return nil, err
+	}
+	g := &guardListener{Listener: l, srv: srv}
+	g.acl.Store(acl)
+	if cfg.AcceptRate > 0 {
+		g.bucket = m_limit.NewBucket(float64(cfg.AcceptRate), cfg.AcceptBurst)
+	}
+	return g, nil
+}
+
+func (l *guardListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		gc, err := l.admit(c)
+		if err == nil {
+			return gc, nil
+		}
+		atomic.AddInt64(&l.srv.stats.RejectedConns, 1)
+		l.srv.metrics.errors.With(errClassRejected).Inc()
+		log.Logger.Warn("guard: reject %v: %v", c.RemoteAddr(), err)
+		l.srv.reject(c)
+	}
+}
+
+func (l *guardListener) admit(c net.Conn) (net.Conn, error) {
+	cfg := &l.srv.Config.Server
+
+	ip := net.IPv4zero
+	port := 0
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	if err := l.acl.Load().(*m_acl.ACL).Check(ip.String(), ip, port); err != nil {
+		return nil, err
+	}
+	if !l.bucket.Allow() {
+		return nil, errAcceptRate
+	}
+
+	key := ip.String()
+	if err := l.srv.clients.acquire(key, cfg.MaxConns, cfg.MaxConnsPerIp); err != nil {
+		return nil, err
+	}
+	return &guardedConn{Conn: c, release: func() { l.srv.clients.release(key) }}, nil
+}
+
+// reject closes c, or drains it until client closes or rejectDrainTimeout
+// passes if RejectDrain is set, so that rejection is not told from a bad
+// request. c is closed at once if maxRejectDrains connections are being
+// drained.
+func (srv *Server) reject(c net.Conn) {
+	if !srv.Config.Server.RejectDrain {
+		c.Close()
+		return
+	}
+	select {
+	case srv.drains <- struct{}{}:
+	default:
+		c.Close()
+		return
+	}
+	go func() {
+		defer func() { <-srv.drains }()
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(rejectDrainTimeout))
+		io.Copy(ioutil.Discard, c)
+	}()
+}
+
+// guardedConn releases its count when closed
+type guardedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *guardedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// ReadFrom keeps fast path of underlying conn in io.Copy
+func (c *guardedConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
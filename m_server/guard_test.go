@@ -0,0 +1,151 @@
+package m_server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+// guardedServer listens with guard of rules and config of cfg, and holds
+// accepted connections open until they are closed by client.
+func guardedServer(t *testing.T, cfg m_config.ConfigServer, rules []string) (*Server, net.Listener) {
+	srv := NewServer(m_config.Conf{Server: cfg}, "", "test")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	gl, err := srv.guard(l, rules)
+	if err != nil {
+		t.Fatalf("guard: %v", err)
+	}
+	go func() {
+		for {
+			c, err := gl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return srv, gl
+}
+
+// accepted reports whether a connection to l is served
+func accepted(t *testing.T, l net.Listener) (net.Conn, bool) {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("x"))
+	_, err = io.ReadFull(c, make([]byte, 1))
+	return c, err == nil
+}
+
+func TestGuardACL(t *testing.T) {
+	_, l := guardedServer(t, m_config.ConfigServer{}, []string{"deny 127.0.0.0/8"})
+	defer l.Close()
+	c, ok := accepted(t, l)
+	c.Close()
+	if ok {
+		t.Fatal("client should be denied")
+	}
+
+	_, l = guardedServer(t, m_config.ConfigServer{}, []string{"allow 127.0.0.1", "deny *"})
+	defer l.Close()
+	c, ok = accepted(t, l)
+	c.Close()
+	if !ok {
+		t.Fatal("client should be allowed")
+	}
+}
+
+func TestGuardMaxConnsPerIp(t *testing.T) {
+	srv, l := guardedServer(t, m_config.ConfigServer{MaxConnsPerIp: 2}, nil)
+	defer l.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, ok := accepted(t, l)
+		if !ok {
+			t.Fatalf("conn %d should be accepted", i)
+		}
+		conns = append(conns, c)
+	}
+	c, ok := accepted(t, l)
+	c.Close()
+	if ok {
+		t.Fatal("conn beyond cap should be rejected")
+	}
+	if srv.GetStats().RejectedConns != 1 {
+		t.Fatalf("rejected conns: %d", srv.GetStats().RejectedConns)
+	}
+
+	// closing a conn frees its slot
+	conns[0].Close()
+	time.Sleep(50 * time.Millisecond)
+	c, ok = accepted(t, l)
+	c.Close()
+	conns[1].Close()
+	if !ok {
+		t.Fatal("conn should be accepted after one closed")
+	}
+}
+
+func TestGuardAcceptRate(t *testing.T) {
+	_, l := guardedServer(t, m_config.ConfigServer{AcceptRate: 1, AcceptBurst: 2}, nil)
+	defer l.Close()
+
+	n := 0
+	for i := 0; i < 4; i++ {
+		c, ok := accepted(t, l)
+		c.Close()
+		if ok {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Fatalf("accepted %d conns, want burst 2", n)
+	}
+}
+
+func TestGuardRejectDrain(t *testing.T) {
+	srv := NewServer(m_config.Conf{Server: m_config.ConfigServer{RejectDrain: true}}, "", "test")
+
+	// rejected connections are drained up to maxRejectDrains
+	var clients []net.Conn
+	for i := 0; i < maxRejectDrains; i++ {
+		c, s := net.Pipe()
+		srv.reject(s)
+		clients = append(clients, c)
+	}
+	c := clients[0]
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatalf("drained conn should be open: %v", err)
+	}
+
+	// and closed at once beyond it
+	c, s := net.Pipe()
+	srv.reject(s)
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("conn beyond drain limit: got %v, want closed", err)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(srv.drains); n != 0 {
+		t.Fatalf("drains: got %d after clients closed", n)
+	}
+}
@@ -0,0 +1,127 @@
+package m_server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_acl"
+	"github.com/zyong/miniproxygo/m_dialer"
+)
+
+// reasons of dial failures
+const (
+	dialACL         = "acl"
+	dialDNS         = "dns"
+	dialTimeout     = "timeout"
+	dialRefused     = "refused"
+	dialUnreachable = "unreachable"
+	dialProxy       = "proxy"
+	dialOther       = "other"
+)
+
+// dialReason classifies error of dial
+func dialReason(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, m_acl.ErrDenied):
+		return dialACL
+	case errors.As(err, &dnsErr):
+		return dialDNS
+	case isTimeout(err):
+		return dialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return dialUnreachable
+	case errors.Is(err, m_dialer.ErrAuthFailed), errors.Is(err, m_dialer.ErrNoAcceptableMethod):
+		return dialProxy
+	}
+	return dialOther
+}
+
+// upstreamHealth is the state of dials to an upstream
+type upstreamHealth struct {
+	Addr                string    `json:"addr"`
+	Healthy             bool      `json:"healthy"`
+	Dials               int64     `json:"dials"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int64     `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	IdleConns           int       `json:"idle_conns"`
+}
+
+// health records dial failures by reason and state of upstreams
+type health struct {
+	lock      sync.Mutex
+	failures  map[string]int64
+	upstreams map[string]*upstreamHealth
+}
+
+func newHealth() *health {
+	return &health{
+		failures:  make(map[string]int64),
+		upstreams: make(map[string]*upstreamHealth),
+	}
+}
+
+// dialed records result of dialing addr, which is an upstream or a target
+// of proxy.
+func (h *health) dialed(addr string, upstream bool, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err != nil {
+		h.failures[dialReason(err)]++
+	}
+	if !upstream {
+		return
+	}
+
+	u, ok := h.upstreams[addr]
+	if !ok {
+		u = &upstreamHealth{Addr: addr}
+		h.upstreams[addr] = u
+	}
+	u.Dials++
+	if err != nil {
+		u.Failures++
+		u.ConsecutiveFailures++
+		u.LastError = err.Error()
+		u.LastFailure = time.Now()
+	} else {
+		u.ConsecutiveFailures = 0
+		u.LastSuccess = time.Now()
+	}
+	u.Healthy = u.ConsecutiveFailures == 0
+}
+
+// snapshot returns dial failures by reason and state of upstreams sorted
+// by address
+func (h *health) snapshot() (map[string]int64, []upstreamHealth) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	failures := make(map[string]int64, len(h.failures))
+	for reason, n := range h.failures {
+		failures[reason] = n
+	}
+	upstreams := make([]upstreamHealth, 0, len(h.upstreams))
+	for _, u := range h.upstreams {
+		upstreams = append(upstreams, *u)
+	}
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Addr < upstreams[j].Addr })
+	return failures, upstreams
+}
+
+// dialed records result of dialing addr started at start in health and
+// metrics.
+func (srv *Server) dialed(addr string, upstream bool, start time.Time, err error) {
+	srv.health.dialed(addr, upstream, err)
+	srv.metrics.dialed(addr, upstream, start, err)
+}
@@ -0,0 +1,240 @@
+package m_server
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_upgrade"
+)
+
+// forceCloseWait is the max time to wait for connections to finish after
+// they are closed by force.
+const forceCloseWait = 5 * time.Second
+
+// listen listens on addr and registers the listener by name, so that it
+// is closed on shutdown. Listener registered already by name, or passed on
+// upgrade for addr, is used instead of a new one.
+func (srv *Server) listen(name, addr string) (net.Listener, error) {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	if l, ok := srv.listeners[name]; ok {
+		return l, nil
+	}
+
+	l := srv.inherit(name, addr)
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			log.Logger.Warn("%s: failed to listen to %s: %v", name, addr, err)
+			return nil, err
+		}
+	}
+	srv.listeners[name] = l
+	return l, nil
+}
+
+// listenAll opens listeners before serving, so that readiness is reported
+// after all of them are open. Proxy keeps serving without monitor.
+func (srv *Server) listenAll() error {
+	defer srv.closeInherited()
+	for _, name := range listenerNames {
+		addr := srv.runningAddr(name)
+		if addr == "" {
+			continue
+		}
+		if _, err := srv.listen(name, addr); err != nil && name != "monitor" {
+			srv.closeListeners()
+			return err
+		}
+	}
+	return nil
+}
+
+// hasListener reports whether listener of name is registered
+func (srv *Server) hasListener(name string) bool {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	_, ok := srv.listeners[name]
+	return ok
+}
+
+func (srv *Server) closeListeners() {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	for name, l := range srv.listeners {
+		if err := l.Close(); err != nil {
+			log.Logger.Error("closeListeners(): %s: %s, %s", name, err, l.Addr())
+		}
+	}
+}
+
+// listening reports whether l, or the listener guarded by l, is the
+// listener registered by name. It is not after l is replaced on reload.
+func (srv *Server) listening(name string, l net.Listener) bool {
+	if g, ok := l.(*guardListener); ok {
+		l = g.Listener
+	}
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	return srv.listeners[name] == l
+}
+
+// serve accepts connections on l and handles each in a new goroutine,
+// which is waited for on graceful shutdown. It returns nil when l is closed
+// by shutdown or replaced on reload.
+func (srv *Server) serve(l net.Listener, name string, handle func(c net.Conn)) error {
+	if g, ok := l.(*guardListener); ok {
+		// client ACL of guard is replaced on reload
+		srv.listenerLock.Lock()
+		if srv.listeners[name] == g.Listener {
+			srv.guards[name] = g
+		}
+		srv.listenerLock.Unlock()
+	}
+	srv.setAccepting(l, true)
+	defer srv.stopAccepting(l)
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if srv.CheckGracefulShutdown() || !srv.listening(name, l) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				tempDelay = delayCalc(tempDelay)
+				log.Logger.Error("%s: Accept error: %v; retrying in %v", name, err, tempDelay)
+				srv.setAccepting(l, false)
+				time.Sleep(tempDelay)
+				srv.setAccepting(l, true)
+				continue
+			}
+			log.Logger.Error("%s: Accept error: %v", name, err)
+			return err
+		}
+		tempDelay = 0
+
+		if !srv.track(c) {
+			c.Close()
+			continue
+		}
+		go func() {
+			defer srv.connWaitGroup.Done()
+			defer srv.active.remove(c)
+			handle(c)
+		}()
+	}
+}
+
+// track counts c in connections waited for on shutdown, it returns false
+// if server is shutting down.
+func (srv *Server) track(c net.Conn) bool {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	if srv.CheckGracefulShutdown() {
+		return false
+	}
+	srv.connWaitGroup.Add(1)
+	srv.active.add(c)
+	return true
+}
+
+// handleSignals shuts down server gracefully on SIGTERM, SIGQUIT or
+// SIGINT, reloads config on SIGHUP and upgrades on m_upgrade.Signal.
+func (srv *Server) handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGHUP)
+	if m_upgrade.Signal != nil {
+		signal.Notify(ch, m_upgrade.Signal)
+	}
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case sig := <-ch:
+			switch sig {
+			case syscall.SIGHUP:
+				if err := srv.Reload(); err != nil {
+					log.Logger.Warn("get signal %s, failed to reload config: %v", sig, err)
+				}
+			case m_upgrade.Signal:
+				go func() {
+					if err := srv.Upgrade(); err != nil {
+						log.Logger.Warn("get signal %s, failed to upgrade: %v", sig, err)
+					}
+				}()
+			default:
+				go srv.ShutdownHandler(sig)
+			}
+		case <-srv.doneCh:
+			return
+		}
+	}
+}
+
+// ShutdownHandler is signal handler for QUIT
+func (srv *Server) ShutdownHandler(sig os.Signal) {
+	log.Logger.Info("get signal %s, graceful shutdown in %v", sig, srv.GracefulShutdownTimeout)
+	srv.Shutdown()
+}
+
+// Shutdown stops accepting connections, waits for connections in progress
+// to finish up to GracefulShutdownTimeout, and then closes them by force.
+// It returns when shutdown finishes, and it is safe to call more than once.
+func (srv *Server) Shutdown() {
+	srv.shutdownOnce.Do(srv.shutdown)
+	<-srv.doneCh
+}
+
+func (srv *Server) shutdown() {
+	if atomic.LoadInt32(&srv.upgraded) == 0 {
+		// service goes on with new process after upgrade
+		srv.notify("STOPPING=1\nSTATUS=graceful shutdown")
+	}
+
+	// notify that server is in graceful shutdown state, no connection is
+	// tracked after it
+	srv.listenerLock.Lock()
+	close(srv.CloseNotifyCh)
+	srv.listenerLock.Unlock()
+
+	// close server listeners
+	srv.closeListeners()
+	srv.closePools(nil)
+
+	// waits server conns to finish
+	connFinCh := make(chan bool)
+	go func() {
+		srv.connWaitGroup.Wait()
+		close(connFinCh)
+	}()
+
+	select {
+	case <-connFinCh:
+		log.Logger.Info("graceful shutdown success.")
+	case <-time.After(srv.GracefulShutdownTimeout):
+		log.Logger.Info("graceful shutdown timeout, close connections by force.")
+		atomic.StoreInt32(&srv.forceClosed, 1)
+		srv.active.closeAll()
+		select {
+		case <-connFinCh:
+		case <-time.After(forceCloseWait):
+			log.Logger.Warn("connections not finished after closed by force")
+		}
+	}
+
+	// save accounts of traffic, unless new process owns them after upgrade
+	if srv.quota != nil && atomic.LoadInt32(&srv.upgraded) == 0 {
+		if err := srv.quota.Save(); err != nil {
+			log.Logger.Warn("quota: failed to save: %v", err)
+		}
+	}
+	close(srv.doneCh)
+}
@@ -0,0 +1,166 @@
+package m_server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	lc.Server.GracefulShutdownTimeout = 1
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	local := NewServer(lc, "", "test")
+	done := make(chan error, 1)
+	go func() { done <- local.Run() }()
+	time.Sleep(100 * time.Millisecond)
+	addr := fmt.Sprintf("127.0.0.1:%d", lc.Server.Port)
+
+	c, err := socksDial(addr, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+
+	start := time.Now()
+	go local.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	// in-flight relay keeps working until timeout, new ones are refused
+	checkEcho(t, c, "draining")
+	if c2, err := socksDial(addr, echo.Addr().String()); err == nil {
+		c2.Close()
+		t.Fatal("listener should be closed")
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run should return after shutdown")
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("shutdown should wait for relay, took %v", d)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(c, make([]byte, 1)); err == nil {
+		t.Fatal("relay should be closed by force")
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	sc, _ := testConfigs(t)
+	srv := NewServer(sc, "", "test")
+	done := make(chan error, 1)
+	go func() { done <- srv.Run() }()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	srv.Shutdown()
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown without connections took %v", d)
+	}
+	srv.Shutdown()
+}
+
+func TestServedAfterShutdown(t *testing.T) {
+	sc, _ := testConfigs(t)
+	srv := NewServer(sc, "", "test")
+	srv.Shutdown()
+
+	// result of a listener ending after Run returns is dropped
+	done := make(chan struct{})
+	go func() {
+		srv.served(fmt.Errorf("listener closed"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve goroutine blocked after shutdown")
+	}
+}
+
+func TestReload(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	root := t.TempDir()
+	port := freePort(t)
+	writeConf := func(extra string) {
+		conf := fmt.Sprintf(`[Server]
+Port = %d
+Cipher = "AEAD_AES_128_GCM"
+AclDenyPrivate = false
+[User "alice"]
+Password = "alice-secret"
+%s`, port, extra)
+		if err := ioutil.WriteFile(filepath.Join(root, m_config.ConfFile), []byte(conf), 0644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	writeConf("")
+	sc, err := m_config.ConfigLoad(filepath.Join(root, m_config.ConfFile), root, m_config.SetDefaultConfig)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	srv := NewServer(sc, root, "test")
+	go srv.Run()
+	defer srv.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	alice := startUser(t, sc, "alice-secret")
+	c, err := socksDial(alice, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+	bob := startUser(t, sc, "bob-secret")
+	checkDenied(t, bob, echo.Addr().String())
+
+	writeConf("[User \"bob\"]\nPassword = \"bob-secret\"\n")
+	if err = srv.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	c2, err := socksDial(bob, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c2, "hello")
+	c2.Close()
+	checkEcho(t, c, "still alive")
+
+	// invalid config keeps running settings
+	writeConf("[User \"bob\"]\nPassword = \"bob-secret\"\nAcl = \"deny 10.0.0.0/99\"\n")
+	if err = srv.Reload(); err == nil {
+		t.Fatal("reload of invalid config should fail")
+	}
+	writeConf("Bogus = 1\n")
+	if err = srv.Reload(); err == nil {
+		t.Fatal("reload of unparsable config should fail")
+	}
+	c2, err = socksDial(bob, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c2, "hello")
+	c2.Close()
+}
@@ -0,0 +1,104 @@
+package m_server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_metrics"
+)
+
+// classes of errors besides dial failures
+const (
+	errClassHandshake = "handshake"
+	errClassReplay    = "replay"
+	errClassRelay     = "relay"
+	errClassQuota     = "quota"
+	errClassRejected  = "rejected"
+)
+
+// metrics are exported on /metrics of monitor
+type metrics struct {
+	registry *m_metrics.Registry
+
+	connDuration      *m_metrics.HistogramVec // by user
+	dialDuration      *m_metrics.HistogramVec // by kind of target or upstream
+	dnsDuration       *m_metrics.HistogramVec
+	handshakeDuration *m_metrics.HistogramVec
+	bytes             *m_metrics.CounterVec // by direction and user
+	errors            *m_metrics.CounterVec // by class
+	upstreamDials     *m_metrics.CounterVec // by upstream and result
+	upstreamHealthy   *m_metrics.GaugeVec   // by upstream
+}
+
+func (srv *Server) newMetrics() *metrics {
+	r := m_metrics.NewRegistry(srv.Config.Server.MetricsMaxSeries)
+	stat := func(n *int64) func() float64 {
+		return func() float64 { return float64(atomic.LoadInt64(n)) }
+	}
+
+	r.NewGaugeFunc("miniproxy_connections_active", "Client connections open.", stat(&srv.stats.CoNum))
+	r.NewCounterFunc("miniproxy_connections_total", "Client connections accepted.", stat(&srv.stats.ConnTotal))
+	r.NewCounterFunc("miniproxy_requests_total", "Proxy requests served.", stat(&srv.stats.ReqNum))
+	r.NewCounterFunc("miniproxy_salt_rejections_total", "Connections rejected for repeated salt.", stat(&srv.stats.ReplayRejected))
+	r.NewGaugeFunc("miniproxy_uptime_seconds", "Seconds since server started.", func() float64 {
+		return time.Since(srv.startTime).Seconds()
+	})
+
+	m := &metrics{registry: r}
+	m.connDuration = r.NewHistogram("miniproxy_connection_duration_seconds",
+		"Duration of proxied connections.", nil, "user")
+	m.dialDuration = r.NewHistogram("miniproxy_dial_duration_seconds",
+		"Time to connect to target or upstream.", nil, "kind")
+	m.dnsDuration = r.NewHistogram("miniproxy_dns_duration_seconds",
+		"Time to resolve domain of target.", nil)
+	m.handshakeDuration = r.NewHistogram("miniproxy_handshake_duration_seconds",
+		"Time from accepting connection to reading target address.", nil)
+	m.bytes = r.NewCounter("miniproxy_bytes_total",
+		"Bytes relayed, in is from clients and out is to clients.", "direction", "user")
+	m.errors = r.NewCounter("miniproxy_errors_total",
+		"Errors by class, dial failures are classified by reason.", "class")
+	m.upstreamDials = r.NewCounter("miniproxy_upstream_dials_total",
+		"Dials to upstreams by result.", "upstream", "result")
+	m.upstreamHealthy = r.NewGauge("miniproxy_upstream_healthy",
+		"1 if the last dial to upstream succeeded.", "upstream")
+	return m
+}
+
+// dialed records result of dialing addr started at start
+func (m *metrics) dialed(addr string, upstream bool, start time.Time, err error) {
+	kind := "target"
+	if upstream {
+		kind = "upstream"
+	}
+	m.dialDuration.With(kind).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.With("dial_" + dialReason(err)).Inc()
+	}
+	if !upstream {
+		return
+	}
+
+	if err != nil {
+		m.upstreamDials.With(addr, "fail").Inc()
+		m.upstreamHealthy.With(addr).Set(0)
+	} else {
+		m.upstreamDials.With(addr, "ok").Inc()
+		m.upstreamHealthy.With(addr).Set(1)
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.registry.WriteTo(w)
+}
+
+// userLabel returns label of user u, which is nil on local
+func userLabel(u *user) string {
+	if u == nil {
+		return ""
+	}
+	return u.name
+}
@@ -0,0 +1,129 @@
+package m_server
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+)
+
+// status is the JSON served by monitor
+type status struct {
+	Version   string    `json:"version"`
+	Local     bool      `json:"local"`
+	StartTime time.Time `json:"start_time"`
+	Uptime    int64     `json:"uptime"` // in seconds
+
+	Connections struct {
+		Current  int64 `json:"current"`
+		Total    int64 `json:"total"`
+		Rejected int64 `json:"rejected"`
+	} `json:"connections"`
+	Requests int64 `json:"requests"`
+	Bytes    struct {
+		In  int64 `json:"in"`
+		Out int64 `json:"out"`
+	} `json:"bytes"`
+
+	DialFailures      map[string]int64 `json:"dial_failures"`
+	HandshakeFailures int64            `json:"handshake_failures"`
+	ReplayRejections  int64            `json:"replay_rejections"`
+
+	Upstreams []upstreamHealth        `json:"upstreams"`
+	Mux       *muxState               `json:"mux,omitempty"`
+	Accounts  map[string]accountState `json:"accounts,omitempty"`
+}
+
+// accountState is traffic of an account in bytes
+type accountState struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// status collects live stats of server
+func (srv *Server) status() *status {
+	stats := srv.GetStats()
+	st := &status{
+		Version:   srv.Version,
+		Local:     srv.Config.Server.Local,
+		StartTime: srv.startTime,
+		Uptime:    int64(time.Since(srv.startTime).Seconds()),
+	}
+	st.Connections.Current = stats.CoNum
+	st.Connections.Total = stats.ConnTotal
+	st.Connections.Rejected = stats.RejectedConns
+	st.Requests = stats.ReqNum
+	st.Bytes.In = stats.BytesIn
+	st.Bytes.Out = stats.BytesOut
+	st.HandshakeFailures = stats.HandshakeFail
+	st.ReplayRejections = stats.ReplayRejected
+
+	st.DialFailures, st.Upstreams = srv.health.snapshot()
+	srv.poolLock.Lock()
+	for i := range st.Upstreams {
+		if p, ok := srv.pools[st.Upstreams[i].Addr]; ok {
+			st.Upstreams[i].IdleConns = p.Len()
+		}
+	}
+	srv.poolLock.Unlock()
+
+	if srv.Config.Server.Local && srv.Config.Server.Mux {
+		mux := srv.mux.state()
+		st.Mux = &mux
+	}
+	if srv.quota != nil {
+		st.Accounts = make(map[string]accountState)
+		for key, n := range srv.quota.Accounts() {
+			st.Accounts[key] = accountState{Up: n[0], Down: n[1]}
+		}
+	}
+	return st
+}
+
+// monitorHandler returns handler of monitor endpoints
+func (srv *Server) monitorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", srv.metrics)
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.status())
+	})
+	mux.HandleFunc("/admin/conns", srv.adminAuth(srv.serveConns))
+	mux.HandleFunc("/admin/conns/", srv.adminAuth(srv.serveConns))
+	mux.HandleFunc("/admin/users", srv.adminAuth(srv.serveUsers))
+	mux.HandleFunc("/admin/users/", srv.adminAuth(srv.serveUsers))
+	mux.HandleFunc("/admin/reload", srv.adminAuth(srv.serveReload))
+	if srv.Config.Server.Local {
+		mux.Handle("/dashboard/", srv.dashboardHandler())
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			http.Redirect(w, r, "/dashboard/", http.StatusFound)
+		})
+	}
+	return mux
+}
+
+// ServeMonitor serves monitor endpoints on MonitorHost:MonitorPort, JSON
+// stats on /stats, Prometheus metrics on /metrics, admin API on /admin/
+// and dashboard of local on /dashboard/.
+func (srv *Server) ServeMonitor() error {
+	l, err := srv.listen("monitor", srv.runningAddr("monitor"))
+	if err != nil {
+		return err
+	}
+	return srv.serveMonitor(l)
+}
+
+func (srv *Server) serveMonitor(l net.Listener) error {
+	log.Logger.Info("Start: monitor %s", l.Addr())
+	err := http.Serve(l, srv.monitorHandler())
+	if srv.CheckGracefulShutdown() || !srv.listening("monitor", l) {
+		return nil
+	}
+	return err
+}
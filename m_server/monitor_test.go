@@ -0,0 +1,106 @@
+package m_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, port int) *status {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/stats", port))
+	if err != nil {
+		t.Fatalf("get stats: %v", err)
+	}
+	defer resp.Body.Close()
+	st := &status{}
+	if err = json.NewDecoder(resp.Body).Decode(st); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	return st
+}
+
+func TestMonitor(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.MonitorPort = freePort(t)
+	lc.Server.MonitorPort = freePort(t)
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	local := fmt.Sprintf("127.0.0.1:%d", lc.Server.Port)
+
+	c, err := socksDial(local, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c, "hello")
+	c.Close()
+
+	// target refusing connection
+	c, err = socksDial(local, fmt.Sprintf("127.0.0.1:%d", freePort(t)))
+	if err == nil {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		c.Read(make([]byte, 1))
+		c.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	st := getStatus(t, lc.Server.MonitorPort)
+	if !st.Local || st.Version != "test" || st.Connections.Total != 2 || st.Bytes.In != 5 || st.Bytes.Out != 5 {
+		t.Fatalf("unexpected local stats: %+v", st)
+	}
+	if len(st.Upstreams) != 1 || st.Upstreams[0].Addr != lc.Server.RemoteServer || !st.Upstreams[0].Healthy {
+		t.Fatalf("unexpected upstreams: %+v", st.Upstreams)
+	}
+
+	st = getStatus(t, sc.Server.MonitorPort)
+	if st.Local || st.Requests != 1 || st.DialFailures[dialRefused] != 1 {
+		t.Fatalf("unexpected server stats: %+v", st)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.MonitorPort = freePort(t)
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c, "hello")
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", sc.Server.MonitorPort))
+	if err != nil {
+		t.Fatalf("get metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		"# TYPE miniproxy_connection_duration_seconds histogram",
+		`miniproxy_bytes_total{direction="in",user=""} 5`,
+		`miniproxy_bytes_total{direction="out",user=""} 5`,
+		`miniproxy_dial_duration_seconds_count{kind="target"} 1`,
+		"miniproxy_handshake_duration_seconds_count 1",
+		"miniproxy_connections_total 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("missing %q in metrics:\n%s", line, body)
+		}
+	}
+}
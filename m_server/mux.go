@@ -0,0 +1,233 @@
+package m_server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_mux"
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+// cmdMux is sent as the first byte of enciphered stream, followed by mux
+// version, to negotiate a mux session. Server acknowledges with the version.
+const cmdMux byte = 0xF2
+
+const (
+	muxVersion      byte = 0x01
+	muxNegoTimeout       = 5 * time.Second // time for server to acknowledge mux
+	muxRetryBackoff      = time.Minute     // time to use plain connections after mux refused
+)
+
+var (
+	errMuxDisabled = errors.New("mux: disabled")
+	errMuxVersion  = errors.New("mux: unsupported version")
+)
+
+// muxConfig returns settings of mux session according to config.
+func (srv *Server) muxConfig() *m_mux.Config {
+	cfg := m_mux.DefaultConfig()
+	if srv.Config.Server.MuxMaxStreams > 0 {
+		cfg.MaxStreams = srv.Config.Server.MuxMaxStreams
+	}
+	return cfg
+}
+
+// muxPool keeps mux sessions to upstreams on local side
+type muxPool struct {
+	lock          sync.Mutex
+	config        *m_mux.Config
+	dial          func(addr string) (net.Conn, error)
+	sessions      []muxSession
+	pending       map[string]*muxDial // sessions being dialed by addr
+	disabledUntil time.Time           // mux not negotiated with server before it
+}
+
+// muxSession is a mux session to upstream addr
+type muxSession struct {
+	*m_mux.Session
+	addr string
+}
+
+// muxDial is a session being dialed, done is closed when dial finishes
+// with err
+type muxDial struct {
+	done chan struct{}
+	err  error
+}
+
+func newMuxPool(config *m_mux.Config, dial func(string) (net.Conn, error)) *muxPool {
+	return &muxPool{config: config, dial: dial, pending: make(map[string]*muxDial)}
+}
+
+// open opens a stream on an available session to addr, dialing a new
+// session when all sessions are full. Idle sessions to other upstreams are
+// closed, those carrying streams are kept until their streams end. Lock is
+// not held while dialing, callers of the same addr wait for the dial in
+// progress instead of dialing their own.
+func (p *muxPool) open(addr string, shadow func(net.Conn) net.Conn) (net.Conn, error) {
+	p.lock.Lock()
+	for {
+		if time.Now().Before(p.disabledUntil) {
+			p.lock.Unlock()
+			return nil, errMuxDisabled
+		}
+		if st := p.openAvailable(addr); st != nil {
+			p.lock.Unlock()
+			return st, nil
+		}
+		d, ok := p.pending[addr]
+		if !ok {
+			break
+		}
+		p.lock.Unlock()
+		<-d.done
+		if d.err != nil {
+			return nil, d.err
+		}
+		p.lock.Lock()
+	}
+
+	d := &muxDial{done: make(chan struct{})}
+	p.pending[addr] = d
+	p.lock.Unlock()
+
+	sess, err := p.dialSession(addr, shadow)
+
+	p.lock.Lock()
+	delete(p.pending, addr)
+	if err == nil {
+		p.sessions = append(p.sessions, muxSession{sess, addr})
+	}
+	d.err = err
+	close(d.done)
+	p.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return sess.Open()
+}
+
+// openAvailable opens a stream on an available session to addr, nil if
+// there is none, with lock held. Closed sessions are dropped.
+func (p *muxPool) openAvailable(addr string) net.Conn {
+	sessions := p.sessions[:0]
+	for _, sess := range p.sessions {
+		if sess.addr != addr && sess.NumStreams() == 0 {
+			sess.Close()
+		}
+		if !sess.IsClosed() {
+			sessions = append(sessions, sess)
+		}
+	}
+	p.sessions = sessions
+
+	for _, sess := range p.sessions {
+		if sess.addr != addr || !sess.Available() {
+			continue
+		}
+		if st, err := sess.Open(); err == nil {
+			return st
+		}
+	}
+	return nil
+}
+
+// muxState is the state of mux sessions to RemoteServer
+type muxState struct {
+	Sessions int  `json:"sessions"`
+	Streams  int  `json:"streams"`
+	Disabled bool `json:"disabled"` // server did not negotiate mux recently
+}
+
+func (p *muxPool) state() muxState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	st := muxState{Disabled: time.Now().Before(p.disabledUntil)}
+	for _, sess := range p.sessions {
+		if !sess.IsClosed() {
+			st.Sessions++
+			st.Streams += sess.NumStreams()
+		}
+	}
+	return st
+}
+
+func (p *muxPool) dialSession(addr string, shadow func(net.Conn) net.Conn) (*m_mux.Session, error) {
+	c, err := p.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	sc := shadow(c)
+
+	if _, err = sc.Write([]byte{cmdMux, muxVersion}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// server without mux support drains the stream and never answers
+	var ack [1]byte
+	sc.SetReadDeadline(time.Now().Add(muxNegoTimeout))
+	_, err = io.ReadFull(sc, ack[:])
+	sc.SetReadDeadline(time.Time{})
+	if err == nil && ack[0] != muxVersion {
+		err = errMuxVersion
+	}
+	if err != nil {
+		c.Close()
+		p.lock.Lock()
+		p.disabledUntil = time.Now().Add(muxRetryBackoff)
+		p.lock.Unlock()
+		return nil, err
+	}
+
+	log.Logger.Info("mux: new session to %s", addr)
+	return m_mux.Client(sc, p.config), nil
+}
+
+// serveMux negotiates mux on enciphered stream sc and serves its streams.
+func (srv *Server) serveMux(sc net.Conn, u *user) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(sc, ver[:]); err != nil {
+		return err
+	}
+	if !srv.Config.Server.Mux {
+		return errMuxDisabled
+	}
+	if ver[0] != muxVersion {
+		return errMuxVersion
+	}
+	if _, err := sc.Write(ver[:]); err != nil {
+		return err
+	}
+
+	log.Logger.Info("mux: session from %v", sc.RemoteAddr())
+	sess := m_mux.Server(sc, srv.muxConfig())
+	defer sess.Close()
+
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			log.Logger.Info("mux: session from %v closed: %v", sc.RemoteAddr(), err)
+			return nil
+		}
+		go srv.serveMuxStream(st, u)
+	}
+}
+
+func (srv *Server) serveMuxStream(st *m_mux.Stream, u *user) {
+	defer st.Close()
+
+	tgt, err := m_socks.ReadAddr(st)
+	if err != nil {
+		log.Logger.Warn("mux: failed to get target address from %v: %v", st.RemoteAddr(), err)
+		return
+	}
+	srv.proxyTarget(st, tgt, u)
+}
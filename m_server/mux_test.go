@@ -0,0 +1,192 @@
+package m_server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_mux"
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+// socksDial connects to target through SOCKS5 proxy at addr.
+func socksDial(addr, target string) (net.Conn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2+10)
+	req := append([]byte{5, 1, 0, 5, 1, 0}, m_socks.ParseAddr(target)...)
+	if _, err = c.Write(req); err == nil {
+		_, err = io.ReadFull(c, buf) // method reply and connect reply
+	}
+	if err == nil && buf[3] != m_socks.RepSuccess {
+		err = fmt.Errorf("socks reply %d", buf[3])
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startProxy starts server and local, returns address of local.
+func startProxy(t testing.TB, mux bool) string {
+	sc, lc := testConfigs(t)
+	sc.Server.Mux = mux
+	lc.Server.Mux = mux
+
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	return fmt.Sprintf("127.0.0.1:%d", lc.Server.Port)
+}
+
+func TestMuxProxy(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	local := startProxy(t, true)
+
+	for i := 0; i < 8; i++ {
+		c, err := socksDial(local, echo.Addr().String())
+		if err != nil {
+			t.Fatalf("socks dial: %v", err)
+		}
+		checkEcho(t, c, fmt.Sprintf("hello %d", i))
+		c.Close()
+	}
+}
+
+func TestMuxFallback(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	// server refuses mux, local falls back to plain connections
+	sc, lc := testConfigs(t)
+	lc.Server.Mux = true
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+}
+
+// BenchmarkLatency measures time to set up a proxied connection and get
+// the first byte echoed back.
+func BenchmarkLatency(b *testing.B) {
+	for _, mux := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mux=%v", mux), func(b *testing.B) {
+			echo := echoServer(b)
+			defer echo.Close()
+			local := startProxy(b, mux)
+
+			buf := make([]byte, 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, err := socksDial(local, echo.Addr().String())
+				if err != nil {
+					b.Fatalf("socks dial: %v", err)
+				}
+				c.Write(buf)
+				if _, err = io.ReadFull(c, buf); err != nil {
+					b.Fatalf("read: %v", err)
+				}
+				c.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkThroughput measures bytes echoed through a proxied connection.
+func BenchmarkThroughput(b *testing.B) {
+	const size = 1024 * 1024
+	for _, mux := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mux=%v", mux), func(b *testing.B) {
+			echo := echoServer(b)
+			defer echo.Close()
+			local := startProxy(b, mux)
+
+			c, err := socksDial(local, echo.Addr().String())
+			if err != nil {
+				b.Fatalf("socks dial: %v", err)
+			}
+			defer c.Close()
+
+			wbuf := make([]byte, size)
+			rbuf := make([]byte, size)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				go c.Write(wbuf)
+				if _, err = io.ReadFull(c, rbuf); err != nil {
+					b.Fatalf("read: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMuxPoolDial(t *testing.T) {
+	var dials int32
+	release := make(chan struct{})
+	dial := func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		c, s := net.Pipe()
+		go func() {
+			// server acknowledging mux
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(s, b); err != nil {
+				return
+			}
+			s.Write(b[1:])
+			m_mux.Server(s, m_mux.DefaultConfig())
+		}()
+		return c, nil
+	}
+	p := newMuxPool(m_mux.DefaultConfig(), dial)
+	plain := func(c net.Conn) net.Conn { return c }
+
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			st, err := p.open("upstream", plain)
+			if err == nil {
+				st.Close()
+			}
+			results <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// pool is not locked while a session is dialed
+	done := make(chan muxState)
+	go func() { done <- p.state() }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pool locked while dialing")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("open: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("dials: got %d, want 1 shared by callers", n)
+	}
+}
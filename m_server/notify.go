@@ -0,0 +1,71 @@
+package m_server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_systemd"
+)
+
+// notify sends state to systemd if process is its service
+func (srv *Server) notify(state string) {
+	if err := m_systemd.Notify(state); err != nil {
+		log.Logger.Warn("systemd: failed to notify: %v", err)
+	}
+}
+
+// statusLine is the status shown by systemctl status
+func (srv *Server) statusLine() string {
+	st := srv.GetStats()
+	return fmt.Sprintf("STATUS=%d connections open, %d accepted", st.CoNum, st.ConnTotal)
+}
+
+// setAccepting marks whether accept loop of l is healthy, which is not
+// while it backs off on accept errors.
+func (srv *Server) setAccepting(l net.Listener, ok bool) {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	srv.accepting[l] = ok
+}
+
+// stopAccepting forgets accept loop of l, which returns
+func (srv *Server) stopAccepting(l net.Listener) {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	delete(srv.accepting, l)
+}
+
+// acceptHealthy reports whether accept loops are running and healthy
+func (srv *Server) acceptHealthy() bool {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	for _, ok := range srv.accepting {
+		if !ok {
+			return false
+		}
+	}
+	return len(srv.accepting) > 0
+}
+
+// runWatchdog keeps systemd watchdog alive while accept loops are
+// healthy, so that systemd restarts proxy stuck in accept errors.
+func (srv *Server) runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.acceptHealthy() {
+				log.Logger.Warn("systemd: accept loops not healthy, skip watchdog")
+				continue
+			}
+			srv.notify("WATCHDOG=1\n" + srv.statusLine())
+		case <-srv.CloseNotifyCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package m_server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextNotify returns the next state sent to fake notify socket c, or empty
+// if none is sent in d.
+func nextNotify(c *net.UnixConn, d time.Duration) string {
+	b := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(d))
+	n, err := c.Read(b)
+	if err != nil {
+		return ""
+	}
+	return string(b[:n])
+}
+
+func TestNotifySystemd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	nc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer nc.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "200000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	sc, _ := testConfigs(t)
+	srv := NewServer(sc, "", "test")
+	done := make(chan error, 1)
+	go func() { done <- srv.Run() }()
+
+	if got := nextNotify(nc, 5*time.Second); !strings.HasPrefix(got, "READY=1\nSTATUS=") {
+		t.Fatalf("ready: got %q", got)
+	}
+	if got := nextNotify(nc, time.Second); !strings.HasPrefix(got, "WATCHDOG=1\n") {
+		t.Fatalf("watchdog: got %q", got)
+	}
+
+	// watchdog stops while an accept loop backs off on errors
+	stuck := &net.TCPListener{}
+	srv.setAccepting(stuck, false)
+	nextNotify(nc, 150*time.Millisecond) // sent before marked
+	if got := nextNotify(nc, 300*time.Millisecond); got != "" {
+		t.Fatalf("watchdog of unhealthy accept loop: got %q", got)
+	}
+	srv.stopAccepting(stuck)
+	if got := nextNotify(nc, time.Second); !strings.HasPrefix(got, "WATCHDOG=1\n") {
+		t.Fatalf("watchdog: got %q", got)
+	}
+
+	go srv.Shutdown()
+	for {
+		got := nextNotify(nc, 5*time.Second)
+		if got == "" {
+			t.Fatal("no STOPPING=1 on shutdown")
+		}
+		if strings.HasPrefix(got, "STOPPING=1\n") {
+			break
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
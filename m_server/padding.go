@@ -0,0 +1,68 @@
+package m_server
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_shadow"
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+// serverFirstPorts are ports of protocols whose clients wait for greeting of
+// server before sending anything, initial payload is not waited for them.
+var serverFirstPorts = map[int]bool{
+	21:   true, // ftp
+	25:   true, // smtp
+	110:  true, // pop3
+	143:  true, // imap
+	587:  true, // smtp submission
+	3306: true, // mysql
+}
+
+// localShadow returns the wrapper enciphering streams dialed by local. The
+// first records of streams are padded if configured.
+func (srv *Server) localShadow() func(net.Conn) net.Conn {
+	cfg := &srv.Config.Server
+	if cfg.PaddingRecords <= 0 {
+		return srv.Cipher.StreamConn
+	}
+
+	opts := &m_shadow.PaddingOptions{
+		Records:      cfg.PaddingRecords,
+		MinSize:      cfg.PaddingMinSize,
+		MaxSize:      cfg.PaddingMaxSize,
+		Distribution: cfg.PaddingDist,
+	}
+	return func(c net.Conn) net.Conn {
+		return m_shadow.WithPadding(srv.Cipher.StreamConn(c), opts)
+	}
+}
+
+// readInitial appends initial payload of client c to target address tgt,
+// so that they are sent in one padded record. It returns as soon as
+// payload arrives, and waits for it at most wait, not at all for targets
+// of server-first protocols.
+func readInitial(c net.Conn, tgt m_socks.Addr, wait time.Duration) []byte {
+	req := []byte(tgt)
+	if wait <= 0 || serverFirstPorts[targetPort(tgt)] {
+		return req
+	}
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(wait))
+	n, _ := c.Read(buf)
+	c.SetReadDeadline(time.Time{})
+	return append(req, buf[:n]...)
+}
+
+// targetPort returns port of tgt, 0 if it is invalid
+func targetPort(tgt m_socks.Addr) int {
+	_, port, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
@@ -0,0 +1,43 @@
+package m_server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_socks"
+)
+
+func TestReadInitial(t *testing.T) {
+	web := m_socks.ParseAddr("127.0.0.1:80")
+	smtp := m_socks.ParseAddr("127.0.0.1:25")
+	for _, c := range []struct {
+		name    string
+		tgt     m_socks.Addr
+		wait    time.Duration
+		payload string
+		max     time.Duration // max time to return
+	}{
+		{"payload", web, time.Second, "GET /", 500 * time.Millisecond},
+		{"no payload", web, 100 * time.Millisecond, "", 500 * time.Millisecond},
+		{"no wait", web, 0, "", 50 * time.Millisecond},
+		{"server first", smtp, time.Second, "", 50 * time.Millisecond},
+	} {
+		client, c2 := net.Pipe()
+		if c.payload != "" {
+			go client.Write([]byte(c.payload))
+		}
+		start := time.Now()
+		req := readInitial(c2, c.tgt, c.wait)
+		if d := time.Since(start); d > c.max {
+			t.Errorf("%s: returned in %v", c.name, d)
+		}
+		if want := string(c.tgt) + c.payload; string(req) != want {
+			t.Errorf("%s: got %q, want %q", c.name, req, want)
+		}
+		client.Close()
+		c2.Close()
+	}
+}
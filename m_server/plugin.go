@@ -0,0 +1,48 @@
+package m_server
+
+import (
+	"net"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_plugin"
+)
+
+// StartPlugin launches SIP003 plugin and rewires addresses through it.
+// Local connects to the plugin instead of RemoteServer; server listens on
+// loopback and the plugin takes over the public port.
+func (srv *Server) StartPlugin() error {
+	cfg := &srv.Config.Server
+
+	local, err := m_plugin.FreeLoopback()
+	if err != nil {
+		return err
+	}
+
+	var remote string
+	if cfg.Local {
+		remote = cfg.RemoteServer
+	} else {
+		host, port, err := net.SplitHostPort(srv.Addr)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			host = "0.0.0.0"
+		}
+		remote = net.JoinHostPort(host, port)
+	}
+
+	p, err := m_plugin.Start(cfg.Plugin, cfg.PluginOpts, remote, local)
+	if err != nil {
+		return err
+	}
+	srv.plugin = p
+
+	if cfg.Local {
+		cfg.RemoteServer = local
+	} else {
+		srv.Addr = local
+	}
+	return nil
+}
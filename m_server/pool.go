@@ -0,0 +1,277 @@
+package m_server
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+)
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time // time when conn was put into pool
+}
+
+// connPool keeps pre-dialed connections to an upstream, wrapped by
+// transport. Salt and target address are written lazily by enciphered
+// stream, so a connection can be dialed before it is needed and enciphered
+// at checkout.
+type connPool struct {
+	addr    string
+	dial    func(addr string) (net.Conn, error)
+	maxIdle int
+	idleTTL time.Duration
+
+	lock    sync.Mutex
+	idle    []idleConn // oldest first
+	filling bool
+	closed  bool
+	done    chan struct{} // closed on Close to stop janitor
+}
+
+func newConnPool(addr string, dial func(string) (net.Conn, error), maxIdle int, idleTTL time.Duration) *connPool {
+	p := &connPool{
+		addr:    addr,
+		dial:    dial,
+		maxIdle: maxIdle,
+		idleTTL: idleTTL,
+		done:    make(chan struct{}),
+	}
+	if idleTTL > 0 {
+		go p.janitor()
+	}
+	return p
+}
+
+// Get returns a live connection from pool, or dials a new one if pool is
+// empty. Pool is refilled in background.
+func (p *connPool) Get() (net.Conn, error) {
+	defer p.fill()
+
+	for {
+		p.lock.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.lock.Unlock()
+			break
+		}
+		// use the newest one, which is least likely to be closed by peer
+		ic := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+
+		if p.expired(ic) || !isAlive(ic.conn) {
+			ic.conn.Close()
+			continue
+		}
+		return ic.conn, nil
+	}
+
+	return p.dial(p.addr)
+}
+
+// Len returns the number of idle connections in pool.
+func (p *connPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.idle)
+}
+
+// Close closes all idle connections and stops refilling.
+func (p *connPool) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	close(p.done)
+	p.lock.Unlock()
+
+	for _, ic := range idle {
+		ic.conn.Close()
+	}
+}
+
+func (p *connPool) expired(ic idleConn) bool {
+	return p.idleTTL > 0 && time.Since(ic.since) > p.idleTTL
+}
+
+// fill dials connections in background until pool has maxIdle ones.
+func (p *connPool) fill() {
+	p.lock.Lock()
+	if p.filling || p.closed || len(p.idle) >= p.maxIdle {
+		p.lock.Unlock()
+		return
+	}
+	p.filling = true
+	p.lock.Unlock()
+
+	go func() {
+		defer func() {
+			p.lock.Lock()
+			p.filling = false
+			p.lock.Unlock()
+		}()
+
+		for {
+			p.lock.Lock()
+			full := p.closed || len(p.idle) >= p.maxIdle
+			p.lock.Unlock()
+			if full {
+				return
+			}
+
+			c, err := p.dial(p.addr)
+			if err != nil {
+				log.Logger.Warn("pool: failed to connect to %s: %v", p.addr, err)
+				return
+			}
+
+			p.lock.Lock()
+			if p.closed || len(p.idle) >= p.maxIdle {
+				p.lock.Unlock()
+				c.Close()
+				return
+			}
+			p.idle = append(p.idle, idleConn{conn: c, since: time.Now()})
+			p.lock.Unlock()
+		}
+	}()
+}
+
+// janitor closes idle connections exceeding idleTTL.
+func (p *connPool) janitor() {
+	ticker := time.NewTicker(p.idleTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		p.lock.Lock()
+		var expired []net.Conn
+		idle := p.idle[:0]
+		for _, ic := range p.idle {
+			if p.expired(ic) {
+				expired = append(expired, ic.conn)
+			} else {
+				idle = append(idle, ic)
+			}
+		}
+		p.idle = idle
+		p.lock.Unlock()
+
+		for _, c := range expired {
+			c.Close()
+		}
+	}
+}
+
+// liveCheckTimeout is how long isAlive waits for a read if socket can not
+// be peeked. A deadline already passed fails the read before checking the
+// socket, so it must be positive.
+const liveCheckTimeout = time.Millisecond
+
+// isAlive checks whether an idle connection is still usable by peeking its
+// socket under transport. Peer sends nothing before us but records of
+// transport, e.g. TLS session tickets, so only EOF or error means the
+// connection is closed or broken.
+func isAlive(c net.Conn) bool {
+	nc := c
+	for {
+		u, ok := nc.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		nc = u.NetConn()
+	}
+	if sc, ok := nc.(syscall.Conn); ok {
+		if alive, ok := peekAlive(sc); ok {
+			return alive
+		}
+	}
+
+	// read through transport, a read which does not time out means the
+	// connection is closed or broken
+	var b [1]byte
+	c.SetReadDeadline(time.Now().Add(liveCheckTimeout))
+	_, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	return isTimeout(err)
+}
+
+// getPool returns connection pool to upstream addr, creating it on first use.
+// It returns nil after pools are closed on shutdown.
+func (srv *Server) getPool(addr string) *connPool {
+	srv.poolLock.Lock()
+	defer srv.poolLock.Unlock()
+
+	if srv.pools == nil {
+		return nil
+	}
+	p, ok := srv.pools[addr]
+	if !ok {
+		p = newConnPool(addr, srv.dialPooled, srv.Config.Server.MaxIdle, srv.IdleConnTimeout)
+		srv.pools[addr] = p
+	}
+	return p
+}
+
+// dialUpstream returns a connection to upstream addr wrapped by transport,
+// taken from connection pool if it is enabled.
+func (srv *Server) dialUpstream(addr string) (net.Conn, error) {
+	if srv.Config.Server.MaxIdle > 0 {
+		if p := srv.getPool(addr); p != nil {
+			return p.Get()
+		}
+	}
+	return srv.dialTransport(addr)
+}
+
+// closePools closes pools to upstreams other than addrs with their idle
+// connections, all pools if addrs is nil and no pool is created after.
+func (srv *Server) closePools(addrs []string) {
+	srv.poolLock.Lock()
+	var closed []*connPool
+	for addr, p := range srv.pools {
+		if !contains(addrs, addr) {
+			closed = append(closed, p)
+			delete(srv.pools, addr)
+		}
+	}
+	if addrs == nil {
+		srv.pools = nil
+	}
+	srv.poolLock.Unlock()
+
+	for _, p := range closed {
+		p.Close()
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTCP connects to upstream addr with outbound dialer.
+func (srv *Server) dialTCP(addr string) (net.Conn, error) {
+	start := time.Now()
+	c, err := srv.dialer.Dial("tcp", addr)
+	srv.dialed(addr, true, start, err)
+	return c, err
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package m_server
+
+import (
+	"syscall"
+)
+
+// peekAlive is not supported, connections are checked by reading.
+func peekAlive(c syscall.Conn) (alive bool, ok bool) {
+	return false, false
+}
@@ -0,0 +1,188 @@
+package m_server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_dialer"
+	"github.com/zyong/miniproxygo/m_transport"
+)
+
+func dialTCP(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func waitPool(p *connPool, n int) bool {
+	for i := 0; i < 100; i++ {
+		if p.Len() == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestConnPoolFill(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	p := newConnPool(echo.Addr().String(), dialTCP, 4, time.Minute)
+	defer p.Close()
+
+	p.fill()
+	if !waitPool(p, 4) {
+		t.Fatalf("pool not filled: got %d", p.Len())
+	}
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+
+	// refilled after checkout
+	if !waitPool(p, 4) {
+		t.Fatalf("pool not refilled: got %d", p.Len())
+	}
+}
+
+func TestConnPoolDeadConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		// close the first connection, echo the others
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 64)
+				n, _ := c.Read(b)
+				c.Write(b[:n])
+			}()
+		}
+	}()
+
+	p := newConnPool(l.Addr().String(), dialTCP, 1, time.Minute)
+	defer p.Close()
+	p.fill()
+	if !waitPool(p, 1) {
+		t.Fatal("pool not filled")
+	}
+	time.Sleep(50 * time.Millisecond) // wait for peer close
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "alive")
+}
+
+func TestConnPoolIdleTTL(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	p := newConnPool(echo.Addr().String(), dialTCP, 2, 40*time.Millisecond)
+	defer p.Close()
+	p.fill()
+	if !waitPool(p, 2) {
+		t.Fatal("pool not filled")
+	}
+	if !waitPool(p, 0) {
+		t.Fatalf("idle connections not expired: got %d", p.Len())
+	}
+}
+
+func TestPoolProxy(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	lc.Server.MaxIdle = 4
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 8; i++ {
+		c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+		if err != nil {
+			t.Fatalf("socks dial: %v", err)
+		}
+		checkEcho(t, c, fmt.Sprintf("hello %d", i))
+		c.Close()
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	other := echoServer(t)
+	defer other.Close()
+
+	_, lc := testConfigs(t)
+	lc.Server.MaxIdle = 2
+	lc.Server.RemoteServer = echo.Addr().String()
+	lc.Server.Upstream = []string{other.Addr().String()}
+	srv := NewServer(lc, "", "test")
+	srv.Transport = m_transport.Raw
+	srv.dialer = m_dialer.Direct
+	if err := srv.loadRoute(); err != nil {
+		t.Fatalf("load route: %v", err)
+	}
+
+	remote, upstream := srv.getPool(echo.Addr().String()), srv.getPool(other.Addr().String())
+	for _, p := range []*connPool{remote, upstream} {
+		p.fill()
+		if !waitPool(p, 2) {
+			t.Fatalf("pool of %s not filled", p.addr)
+		}
+	}
+
+	// pool of upstream removed on reload is torn down
+	cfg := srv.Config
+	cfg.Server.Upstream = nil
+	if err := srv.reloadRoute(&cfg); err != nil {
+		t.Fatalf("reload route: %v", err)
+	}
+	if upstream.Len() != 0 || !isClosed(upstream.done) {
+		t.Fatal("pool of removed upstream not closed")
+	}
+	if remote.Len() != 2 || isClosed(remote.done) {
+		t.Fatal("pool of RemoteServer closed")
+	}
+
+	// all pools are torn down on shutdown, and no pool is created after
+	srv.Shutdown()
+	if remote.Len() != 0 || !isClosed(remote.done) {
+		t.Fatal("pool not closed on shutdown")
+	}
+	if srv.getPool(echo.Addr().String()) != nil {
+		t.Fatal("pool created after shutdown")
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package m_server
+
+import (
+	"syscall"
+)
+
+// peekAlive peeks socket of c without blocking. ok is false if the socket
+// can not be peeked.
+func peekAlive(c syscall.Conn) (alive bool, ok bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	var b [1]byte
+	var n int
+	var perr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, perr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true // never wait for socket to be readable
+	})
+	if err != nil {
+		return false, false
+	}
+	switch {
+	case perr == syscall.EAGAIN || perr == syscall.EWOULDBLOCK:
+		return true, true // nothing to read
+	case perr != nil:
+		return false, true
+	}
+	// pending bytes, or EOF if nothing is read
+	return n > 0, true
+}
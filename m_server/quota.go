@@ -0,0 +1,86 @@
+package m_server
+
+import (
+	"fmt"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_quota"
+)
+
+// accounting reports whether traffic is accounted according to config
+func (srv *Server) accounting() bool {
+	cfg := &srv.Config.Server
+	if cfg.QuotaFile != "" || cfg.UserQuota > 0 || cfg.PortQuota > 0 {
+		return true
+	}
+	// usage and quotas of users are managed by admin API
+	if !cfg.Local && cfg.AdminToken != "" {
+		return true
+	}
+	for _, u := range srv.Config.User {
+		if u.Quota > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mb converts quota in MB to bytes
+func mb(n int) int64 {
+	return int64(n) << 20
+}
+
+// loadQuota opens book of accounts, and sets up account of port. Accounts
+// of users are set up by loadUsers.
+func (srv *Server) loadQuota() error {
+	cfg := &srv.Config.Server
+	if !srv.accounting() {
+		return nil
+	}
+
+	schedule, err := m_quota.ParseSchedule(cfg.QuotaReset, cfg.QuotaResetDay)
+	if err != nil {
+		return err
+	}
+	path := ""
+	if cfg.QuotaFile != "" {
+		path = srv.confPath(cfg.QuotaFile)
+	}
+	book, err := m_quota.Open(path, schedule)
+	if err != nil {
+		return fmt.Errorf("quota: open %s: %v", path, err)
+	}
+
+	srv.portAccount = book.Account(fmt.Sprintf("port:%d", cfg.Port))
+	srv.portAccount.SetLimit(mb(cfg.PortQuota), cfg.QuotaCut)
+	srv.quota = book
+	return nil
+}
+
+// runQuota saves book of accounts periodically until server shuts down
+func (srv *Server) runQuota() {
+	interval := time.Duration(srv.Config.Server.QuotaSaveInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	srv.quota.Run(interval, srv.CloseNotifyCh)
+}
+
+// overQuota reports whether quota of port or of user u is exceeded, u is
+// nil on local.
+func (srv *Server) overQuota(u *user) bool {
+	if srv.portAccount != nil && srv.portAccount.Exceeded() {
+		log.Logger.Warn("quota: port %d exceeded", srv.Config.Server.Port)
+		srv.metrics.errors.With(errClassQuota).Inc()
+		return true
+	}
+	if u != nil && u.account != nil && u.account.Exceeded() {
+		log.Logger.Warn("quota: user %s exceeded", u.name)
+		srv.metrics.errors.With(errClassQuota).Inc()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package m_server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestQuotaCut(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.UserQuota = 1
+	sc.Server.QuotaCut = true
+	lc.Server.ClientReadTimeout = 1 // local closes client soon after server cuts
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	local := fmt.Sprintf("127.0.0.1:%d", lc.Server.Port)
+
+	c, err := socksDial(local, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+
+	// 600KB echoed back makes 1.2MB, beyond quota of 1MB
+	msg := bytes.Repeat([]byte("x"), 600*1024)
+	go c.Write(msg)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, len(msg))); err == nil {
+		t.Fatal("connection should be cut when quota is exceeded")
+	}
+
+	checkDenied(t, local, echo.Addr().String())
+}
@@ -0,0 +1,311 @@
+package m_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_acl"
+	"github.com/zyong/miniproxygo/m_config"
+	"github.com/zyong/miniproxygo/m_shadow"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// listenerNames are names of listeners opened by server
+var listenerNames = []string{"socks", "reverse", "monitor"}
+
+// reloadable are settings of [Server] applied on reload, by mode they are
+// used in, "" for both. Other settings take effect after restart.
+var reloadable = map[string]string{
+	"Port":             "",
+	"MonitorPort":      "",
+	"MonitorHost":      "",
+	"ClientAcl":        "",
+	"ReversePort":      "server",
+	"ReverseClientAcl": "server",
+	"Acl":              "server",
+	"AclDenyPrivate":   "server",
+	"UserUploadRate":   "server",
+	"UserDownloadRate": "server",
+	"UserQuota":        "server",
+	"Upstream":         "local",
+	"RouteMode":        "local",
+	"RouteRule":        "local",
+}
+
+// configChange is the names of settings changed by reload
+type configChange struct {
+	Applied []string `json:"applied"` // applied to new connections
+	Restart []string `json:"restart"` // taking effect after restart
+}
+
+// Reload loads config file again and applies listeners and client ACLs,
+// users and ACL of targets on server, or upstreams and routing on local.
+// Running settings are kept if the new config is invalid, and relays in
+// progress keep settings they started with.
+func (srv *Server) Reload() error {
+	_, err := srv.reload()
+	return err
+}
+
+// reload reloads config and reports result as status of systemd
+func (srv *Server) reload() (*configChange, error) {
+	change, err := srv.reloadConfig()
+	if err != nil {
+		srv.notify(fmt.Sprintf("STATUS=failed to reload config: %v", err))
+	} else {
+		srv.notify(srv.statusLine())
+	}
+	return change, err
+}
+
+func (srv *Server) reloadConfig() (*configChange, error) {
+	srv.reloadLock.Lock()
+	defer srv.reloadLock.Unlock()
+
+	if srv.CheckGracefulShutdown() {
+		return nil, errShuttingDown
+	}
+	path := filepath.Join(srv.ConfRoot, m_config.ConfFile)
+	cfg, err := m_config.ConfigLoad(path, srv.ConfRoot, m_config.SetDefaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkConfig(&cfg.Server); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	change := srv.diffConfig(&cfg)
+
+	// listen to changed ports before anything is applied, so that a port
+	// in use fails the reload
+	opened, err := srv.openListeners(&cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	if srv.Config.Server.Local {
+		err = srv.reloadRoute(&cfg)
+	} else {
+		err = srv.reloadUsers(&cfg)
+	}
+	if err == nil {
+		err = srv.applyListeners(&cfg.Server, opened)
+	}
+	if err != nil {
+		for _, l := range opened {
+			if l != nil {
+				l.Close()
+			}
+		}
+		return nil, err
+	}
+
+	log.Logger.Info("config reloaded from %s, applied: %s", path, strings.Join(change.Applied, ", "))
+	if len(change.Restart) > 0 {
+		log.Logger.Warn("config: %s changed, restart to apply", strings.Join(change.Restart, ", "))
+	}
+	return change, nil
+}
+
+// checkConfig validates settings which are not checked when applied
+func checkConfig(cfg *m_config.ConfigServer) error {
+	if _, err := m_acl.Parse(cfg.ClientAcl); err != nil {
+		return fmt.Errorf("ClientAcl: %v", err)
+	}
+	if _, err := m_acl.Parse(cfg.ReverseClientAcl); err != nil {
+		return fmt.Errorf("ReverseClientAcl: %v", err)
+	}
+	if err := m_shadow.CheckPaddingDistribution(cfg.PaddingDist); err != nil {
+		return fmt.Errorf("PaddingDist: %v", err)
+	}
+	if cfg.Plugin != "" && len(cfg.Upstream) > 0 {
+		// plugin carries connections to RemoteServer only
+		return fmt.Errorf("Upstream: not supported with Plugin")
+	}
+	return nil
+}
+
+// diffConfig returns settings of cfg different from running ones
+func (srv *Server) diffConfig(cfg *m_config.Conf) *configChange {
+	mode := "server"
+	if srv.Config.Server.Local {
+		mode = "local"
+	}
+	cur := srv.Config.Server
+	if srv.plugin != nil && cur.Local {
+		// RemoteServer is replaced by address of plugin
+		cur.RemoteServer = srv.plugin.Remote
+	}
+
+	change := &configChange{Applied: []string{}, Restart: []string{}}
+	a, b := reflect.ValueOf(cur), reflect.ValueOf(cfg.Server)
+	for i := 0; i < a.NumField(); i++ {
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		name := a.Type().Field(i).Name
+		scope, ok := reloadable[name]
+		switch {
+		case name == "Port" && srv.plugin != nil && mode == "server":
+			// plugin listens on Port
+			change.Restart = append(change.Restart, name)
+		case ok && (scope == "" || scope == mode):
+			change.Applied = append(change.Applied, name)
+		case !ok:
+			change.Restart = append(change.Restart, name)
+		}
+	}
+	if mode == "server" && !reflect.DeepEqual(srv.Config.User, cfg.User) {
+		change.Applied = append(change.Applied, "User")
+	}
+	return change
+}
+
+// listenAddr returns address of listener by name in cfg, empty if it is
+// disabled.
+func (srv *Server) listenAddr(name string, cfg *m_config.ConfigServer) string {
+	switch name {
+	case "socks":
+		if srv.plugin != nil && !cfg.Local {
+			// plugin listens on Port and passes to Addr
+			return srv.Addr
+		}
+		return fmt.Sprintf(":%d", cfg.Port)
+	case "reverse":
+		if !cfg.Local && cfg.ReversePort > 0 {
+			return fmt.Sprintf(":%d", cfg.ReversePort)
+		}
+	case "monitor":
+		if cfg.MonitorPort > 0 {
+			return net.JoinHostPort(cfg.MonitorHost, fmt.Sprintf("%d", cfg.MonitorPort))
+		}
+	}
+	return ""
+}
+
+// runningAddr returns address of running listener by name, empty if it
+// is disabled.
+func (srv *Server) runningAddr(name string) string {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	return srv.listenAddr(name, &srv.Config.Server)
+}
+
+// clientRules returns rules of client ACL of listener by name
+func (srv *Server) clientRules(name string) []string {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	if name == "reverse" {
+		return srv.Config.Server.ReverseClientAcl
+	}
+	return srv.Config.Server.ClientAcl
+}
+
+// openListeners listens to addresses of cfg different from running ones.
+// It returns listeners by name, nil for listeners to be closed.
+func (srv *Server) openListeners(cfg *m_config.ConfigServer) (map[string]net.Listener, error) {
+	opened := make(map[string]net.Listener)
+	for _, name := range listenerNames {
+		addr := srv.listenAddr(name, cfg)
+		if addr == srv.listenAddr(name, &srv.Config.Server) {
+			continue
+		}
+		if addr == "" {
+			opened[name] = nil
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range opened {
+				if l != nil {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		opened[name] = l
+	}
+	return opened, nil
+}
+
+// applyListeners replaces client ACLs of guards and listeners by opened.
+// Connections accepted by replaced listeners are not affected.
+func (srv *Server) applyListeners(cfg *m_config.ConfigServer, opened map[string]net.Listener) error {
+	acls := make(map[string]*m_acl.ACL)
+	for name, rules := range map[string][]string{"socks": cfg.ClientAcl, "reverse": cfg.ReverseClientAcl} {
+		acl, err := m_acl.Parse(rules)
+		if err != nil {
+			return err
+		}
+		acls[name] = acl
+	}
+
+	srv.listenerLock.Lock()
+	if srv.CheckGracefulShutdown() {
+		srv.listenerLock.Unlock()
+		return errShuttingDown
+	}
+	cur := &srv.Config.Server
+	cur.Port, cur.ReversePort = cfg.Port, cfg.ReversePort
+	cur.MonitorPort, cur.MonitorHost = cfg.MonitorPort, cfg.MonitorHost
+	cur.ClientAcl, cur.ReverseClientAcl = cfg.ClientAcl, cfg.ReverseClientAcl
+	srv.Addr = srv.listenAddr("socks", cur)
+	for name, g := range srv.guards {
+		g.acl.Store(acls[name])
+	}
+
+	var closed []net.Listener
+	for name, l := range opened {
+		if old, ok := srv.listeners[name]; ok {
+			closed = append(closed, old)
+		}
+		delete(srv.guards, name)
+		if l == nil {
+			delete(srv.listeners, name)
+		} else {
+			srv.listeners[name] = l
+		}
+	}
+	srv.listenerLock.Unlock()
+
+	for _, l := range closed {
+		log.Logger.Info("reload: close listener %s", l.Addr())
+		l.Close()
+	}
+	for name, l := range opened {
+		if l != nil {
+			srv.goServe(name, l)
+		}
+	}
+	return nil
+}
+
+// goServe serves listener l opened on reload by name. Errors are reported
+// to Run, except those of monitor, without which proxy keeps serving.
+func (srv *Server) goServe(name string, l net.Listener) {
+	go func() {
+		var err error
+		switch name {
+		case "socks":
+			if srv.Config.Server.Local {
+				err = srv.ServeLocal(l, srv.localShadow(), handShake)
+			} else {
+				err = srv.ServeServer(l)
+			}
+		case "reverse":
+			err = srv.serveReversePublic(l)
+		case "monitor":
+			if err = srv.serveMonitor(l); err != nil {
+				log.Logger.Warn("monitor: %v", err)
+			}
+			return
+		}
+		srv.served(err)
+	}()
+}
@@ -0,0 +1,115 @@
+package m_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+func TestReloadListeners(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, _ := testConfigs(t)
+	go Start(sc, "test", "")
+
+	root := t.TempDir()
+	monitorPort := freePort(t)
+	writeConf := func(port int, extra string) {
+		conf := fmt.Sprintf(`[Server]
+Local = true
+Port = %d
+RemoteServer = "127.0.0.1:%d"
+Cipher = "AEAD_AES_128_GCM"
+Password = "test"
+MonitorPort = %d
+AdminToken = "secret"
+%s`, port, sc.Server.Port, monitorPort, extra)
+		if err := ioutil.WriteFile(filepath.Join(root, m_config.ConfFile), []byte(conf), 0644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	port1, port2 := freePort(t), freePort(t)
+	writeConf(port1, "")
+	lc, err := m_config.ConfigLoad(filepath.Join(root, m_config.ConfFile), root, m_config.SetDefaultConfig)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	local := NewServer(lc, root, "test")
+	go local.Run()
+	defer local.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	addr1 := fmt.Sprintf("127.0.0.1:%d", port1)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", port2)
+	c, err := socksDial(addr1, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+
+	// move to another port with a new upstream
+	writeConf(port2, "Upstream = \"127.0.0.1:1\"\nClientReadTimeout = 30\n")
+	reloadURL := fmt.Sprintf("http://127.0.0.1:%d/admin/reload", monitorPort)
+	resp := adminRequest(t, http.MethodPost, reloadURL, "secret")
+	var change configChange
+	err = json.NewDecoder(resp.Body).Decode(&change)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload: status %d, %v", resp.StatusCode, err)
+	}
+	if fmt.Sprint(change.Applied) != "[Port Upstream]" || fmt.Sprint(change.Restart) != "[ClientReadTimeout]" {
+		t.Fatalf("reload: got %+v", change)
+	}
+	if got := local.route.upstreamList(); len(got) != 2 {
+		t.Fatalf("upstreams: got %v", got)
+	}
+
+	checkEcho(t, c, "still alive")
+	if c2, err := socksDial(addr1, echo.Addr().String()); err == nil {
+		c2.Close()
+		t.Fatal("old port should be closed")
+	}
+	c2, err := socksDial(addr2, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial new port: %v", err)
+	}
+	checkEcho(t, c2, "hello")
+	c2.Close()
+
+	// client ACL applies to new connections only
+	writeConf(port2, "ClientAcl = \"deny 127.0.0.1\"\n")
+	if err = local.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if c2, err := socksDial(addr2, echo.Addr().String()); err == nil {
+		c2.Close()
+		t.Fatal("client should be denied")
+	}
+	checkEcho(t, c, "still alive")
+
+	// invalid config is reported and keeps running settings
+	writeConf(port1, "ClientAcl = \"deny 10.0.0.0/99\"\n")
+	resp = adminRequest(t, http.MethodPost, reloadURL, "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("reload of invalid config: status %d", resp.StatusCode)
+	}
+	if c2, err := socksDial(addr1, echo.Addr().String()); err == nil {
+		c2.Close()
+		t.Fatal("port should not change")
+	}
+	if c2, err := socksDial(addr2, echo.Addr().String()); err == nil {
+		c2.Close()
+		t.Fatal("client ACL should not change")
+	}
+}
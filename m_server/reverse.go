@@ -0,0 +1,328 @@
+package m_server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+)
+
+// Reverse tunnel commands. They are sent as the first byte of the enciphered
+// stream instead of a SOCKS address type, so they never collide with a
+// normal proxy request.
+const (
+	cmdReverseControl byte = 0xF0 // local keeps a control stream to server
+	cmdReverseDial    byte = 0xF1 // local dials back for an accepted public conn
+)
+
+const (
+	reverseKeepAlive   = 30 * time.Second // interval of keepalive on control stream
+	reverseDialTimeout = 10 * time.Second // time for local to dial back
+	reverseIdLen       = 8
+)
+
+// reverseHub keeps the state of reverse tunnel on server side
+type reverseHub struct {
+	lock    sync.Mutex
+	control net.Conn            // current control stream, nil if no local attached
+	owner   string              // user of current control stream
+	pending map[uint64]net.Conn // public conns waiting for local to dial back
+}
+
+func newReverseHub() *reverseHub {
+	return &reverseHub{pending: make(map[uint64]net.Conn)}
+}
+
+// attach replaces current control stream with c of user name. Control
+// stream of another user is not replaced.
+func (h *reverseHub) attach(c net.Conn, name string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.control != nil {
+		if h.owner != name {
+			return errReverseTaken
+		}
+		h.control.Close()
+	}
+	h.control, h.owner = c, name
+	return nil
+}
+
+// detach removes c if it is still the current control stream
+func (h *reverseHub) detach(c net.Conn) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.control == c {
+		h.control = nil
+	}
+}
+
+// send writes id on current control stream
+func (h *reverseHub) send(id uint64) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.control == nil {
+		return errReverseNoControl
+	}
+	var b [reverseIdLen]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	_, err := h.control.Write(b[:])
+	return err
+}
+
+// put registers public conn p and asks local to dial back for it
+func (h *reverseHub) put(p net.Conn) error {
+	var b [reverseIdLen]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint64(b[:])
+	if id == 0 { // zero is reserved for keepalive
+		id = 1
+	}
+
+	h.lock.Lock()
+	h.pending[id] = p
+	h.lock.Unlock()
+
+	if err := h.send(id); err != nil {
+		h.take(id)
+		return err
+	}
+
+	time.AfterFunc(reverseDialTimeout, func() {
+		if c := h.take(id); c != nil {
+			log.Logger.Warn("reverse: local did not dial back for %v", c.RemoteAddr())
+			c.Close()
+		}
+	})
+	return nil
+}
+
+// take removes and returns public conn with given id
+func (h *reverseHub) take(id uint64) net.Conn {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	c := h.pending[id]
+	delete(h.pending, id)
+	return c
+}
+
+type reverseError string
+
+func (e reverseError) Error() string { return "reverse: " + string(e) }
+
+var (
+	errReverseNoControl = reverseError("no local attached")
+	errReverseUnknownId = reverseError("unknown connection id")
+	errReverseTaken     = reverseError("attached by another user")
+	errReverseUser      = reverseError("user not allowed, see ReverseUser")
+)
+
+// ServeReverseServer opens the public listener of reverse tunnel. Each
+// accepted conn is carried to local through a dial back stream.
+func (srv *Server) ServeReverseServer() error {
+	l, err := srv.listen("reverse", srv.runningAddr("reverse"))
+	if err != nil {
+		return err
+	}
+	return srv.serveReversePublic(l)
+}
+
+// serveReversePublic passes public conns accepted on l to reverse tunnel.
+func (srv *Server) serveReversePublic(l net.Listener) error {
+	l, err := srv.guard(l, srv.clientRules("reverse"))
+	if err != nil {
+		return err
+	}
+	log.Logger.Info("Start: reverse tunnel public listener %s", l.Addr())
+
+	return srv.serve(l, "reverse", func(p net.Conn) {
+		if err := srv.reverse.put(p); err != nil {
+			log.Logger.Warn("reverse: drop public conn from %v: %v", p.RemoteAddr(), err)
+			p.Close()
+		}
+	})
+}
+
+// reverseAllowed reports whether user u may use reverse tunnel, which is
+// ReverseUser, or the only user if ReverseUser is not set.
+func (srv *Server) reverseAllowed(u *user) bool {
+	if name := srv.Config.Server.ReverseUser; name != "" {
+		return u.name == name
+	}
+	return len(srv.userList()) == 1
+}
+
+// serveReverseControl holds control stream sc of user u from local until
+// it is broken.
+func (srv *Server) serveReverseControl(sc net.Conn, u *user) error {
+	if !srv.reverseAllowed(u) {
+		return errReverseUser
+	}
+	if err := srv.reverse.attach(sc, u.name); err != nil {
+		return err
+	}
+	defer srv.reverse.detach(sc)
+	log.Logger.Info("reverse: local of user %s attached from %v", u.name, sc.RemoteAddr())
+
+	done := make(chan struct{})
+	go func() {
+		// local sends nothing after command, read returns when stream broken
+		io.Copy(ioutil.Discard, sc)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(reverseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			log.Logger.Info("reverse: local detached from %v", sc.RemoteAddr())
+			return nil
+		case <-ticker.C:
+			if err := srv.reverse.send(0); err != nil {
+				log.Logger.Warn("reverse: keepalive to %v error: %v", sc.RemoteAddr(), err)
+				return nil
+			}
+		}
+	}
+}
+
+// serveReverseDial relays dial back stream sc of user u with its public
+// conn.
+func (srv *Server) serveReverseDial(sc net.Conn, u *user) error {
+	if !srv.reverseAllowed(u) {
+		return errReverseUser
+	}
+	var b [reverseIdLen]byte
+	if _, err := io.ReadFull(sc, b[:]); err != nil {
+		return err
+	}
+	p := srv.reverse.take(binary.BigEndian.Uint64(b[:]))
+	if p == nil {
+		return errReverseUnknownId
+	}
+	defer p.Close()
+	if srv.overQuota(u) {
+		return nil
+	}
+
+	log.Logger.Info("reverse: proxy %s <-> %s", p.RemoteAddr(), sc.RemoteAddr())
+	e := srv.conns.add(&connEntry{
+		client: p.RemoteAddr().String(),
+		user:   userLabel(u),
+		target: sc.RemoteAddr().String(),
+		left:   p,
+		right:  sc,
+	})
+	defer srv.conns.remove(e)
+	return srv.relay(p, sc, srv.newThrottle(u, e))
+}
+
+// ServeReverseLocal keeps a control stream to RemoteServer, reconnecting
+// when it is broken, and dials back for every public conn on server. It
+// returns nil on shutdown.
+func (srv *Server) ServeReverseLocal(shadow func(net.Conn) net.Conn) error {
+	log.Logger.Info("Start: reverse tunnel %s <-> %s",
+		srv.Config.Server.RemoteServer, srv.Config.Server.ReverseTarget)
+
+	var tempDelay time.Duration
+	for {
+		start := time.Now()
+		err := srv.reverseControl(shadow)
+		if srv.CheckGracefulShutdown() {
+			return nil
+		}
+		if time.Since(start) > reverseKeepAlive {
+			tempDelay = 0
+		}
+		tempDelay = delayCalc(tempDelay)
+		log.Logger.Warn("reverse: control stream error: %v; retrying in %v", err, tempDelay)
+		time.Sleep(tempDelay)
+	}
+}
+
+func (srv *Server) reverseControl(shadow func(net.Conn) net.Conn) error {
+	rc, err := srv.dialTransport(srv.Config.Server.RemoteServer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	rc = shadow(rc)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-srv.CloseNotifyCh:
+			rc.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err = rc.Write([]byte{cmdReverseControl}); err != nil {
+		return err
+	}
+
+	var b [reverseIdLen]byte
+	for {
+		rc.SetReadDeadline(time.Now().Add(3 * reverseKeepAlive))
+		if _, err = io.ReadFull(rc, b[:]); err != nil {
+			return err
+		}
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			go srv.reverseDial(shadow, id)
+		}
+	}
+}
+
+func (srv *Server) reverseDial(shadow func(net.Conn) net.Conn, id uint64) {
+	rc, err := srv.dialUpstream(srv.Config.Server.RemoteServer)
+	if err != nil {
+		log.Logger.Warn("reverse: failed to connect to RemoteServer: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	rc = srv.cork(rc, "reverse", 2) // salt and id of dial back
+	rc = shadow(rc)
+
+	var b [1 + reverseIdLen]byte
+	b[0] = cmdReverseDial
+	binary.BigEndian.PutUint64(b[1:], id)
+	if _, err = rc.Write(b[:]); err != nil {
+		log.Logger.Warn("reverse: failed to send connection id: %v", err)
+		return
+	}
+
+	target := srv.Config.Server.ReverseTarget
+	start := time.Now()
+	lc, err := srv.dialer.Dial("tcp", target)
+	srv.dialed(target, false, start, err)
+	if err != nil {
+		log.Logger.Warn("reverse: failed to connect to ReverseTarget: %v", err)
+		return
+	}
+	defer lc.Close()
+
+	log.Logger.Info("reverse: proxy %s <-> %s", rc.RemoteAddr(), lc.RemoteAddr())
+	e := srv.conns.add(&connEntry{
+		client:   rc.RemoteAddr().String(),
+		target:   target,
+		upstream: srv.Config.Server.RemoteServer,
+		left:     rc,
+		right:    lc,
+	})
+	defer srv.conns.remove(e)
+	if err = srv.relay(rc, lc, srv.newThrottle(nil, e)); err != nil {
+		log.Logger.Warn("reverse: relay error: %v", err)
+	}
+}
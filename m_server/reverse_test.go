@@ -0,0 +1,176 @@
+package m_server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+func init() {
+	// local and server share salt filter in one process, disable it
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+}
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func echoServer(t testing.TB) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// testConfigs returns config of server and of local connected to it
+func testConfigs(t testing.TB) (m_config.Conf, m_config.Conf) {
+	var sc m_config.Conf
+	m_config.SetDefaultConfig(&sc)
+	sc.Server.Port = freePort(t)
+	sc.Server.Cipher = "AEAD_AES_128_GCM"
+	sc.Server.Password = "test"
+	sc.Server.AclDenyPrivate = false // echo servers are on loopback
+
+	lc := sc
+	lc.Server.Local = true
+	lc.Server.Port = freePort(t)
+	lc.Server.RemoteServer = fmt.Sprintf("127.0.0.1:%d", sc.Server.Port)
+	return sc, lc
+}
+
+func checkEcho(t *testing.T, c net.Conn, msg string) {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b) != msg {
+		t.Fatalf("echo: got %q, want %q", b, msg)
+	}
+}
+
+func TestReverseTunnel(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.ReversePort = freePort(t)
+	lc.Server.ReverseTarget = echo.Addr().String()
+
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", sc.Server.ReversePort))
+		if err != nil {
+			t.Fatalf("dial public port: %v", err)
+		}
+		checkEcho(t, c, fmt.Sprintf("hello %d", i))
+		c.Close()
+	}
+}
+
+func TestReverseAccounting(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.ReversePort = freePort(t)
+	lc.Server.ReverseTarget = echo.Addr().String()
+	server := NewServer(sc, "", "test")
+	go server.Run()
+	time.Sleep(100 * time.Millisecond)
+	local := NewServer(lc, "", "test")
+	go local.Run()
+	time.Sleep(200 * time.Millisecond)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", sc.Server.ReversePort))
+	if err != nil {
+		t.Fatalf("dial public port: %v", err)
+	}
+	defer c.Close()
+	checkEcho(t, c, "hello")
+
+	// open relays are listed and counted on both sides
+	for _, srv := range []*Server{server, local} {
+		conns := srv.conns.list(&connFilter{})
+		if len(conns) != 1 {
+			t.Fatalf("listed relays: %+v", conns)
+		}
+		if conns[0].Up != 5 || conns[0].Down != 5 {
+			t.Fatalf("bytes of relay: %+v", conns[0])
+		}
+	}
+	if server.stats.BytesIn != 5 || local.stats.BytesOut != 5 {
+		t.Fatalf("stats: server in %d, local out %d", server.stats.BytesIn, local.stats.BytesOut)
+	}
+}
+
+func TestReverseUser(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	other := echoServer(t)
+	defer other.Close()
+
+	sc, _ := testConfigs(t)
+	sc.Server.ReversePort = freePort(t)
+	sc.Server.ReverseUser = "alice"
+	sc.User = map[string]*m_config.ConfigUser{
+		"alice": {Password: "alice-secret"},
+		"bob":   {Password: "bob-secret"},
+	}
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	for _, u := range []struct{ password, target string }{
+		{"alice-secret", echo.Addr().String()},
+		// bob attaches later and must not take over public connections
+		{"bob-secret", "127.0.0.1:1"},
+	} {
+		_, lc := testConfigs(t)
+		lc.Server.RemoteServer = fmt.Sprintf("127.0.0.1:%d", sc.Server.Port)
+		lc.Server.Password = u.password
+		lc.Server.ReverseTarget = u.target
+		go Start(lc, "test", "")
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", sc.Server.ReversePort))
+		if err != nil {
+			t.Fatalf("dial public port: %v", err)
+		}
+		checkEcho(t, c, fmt.Sprintf("hello %d", i))
+		c.Close()
+	}
+}
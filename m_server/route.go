@@ -0,0 +1,216 @@
+package m_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_config"
+	"github.com/zyong/miniproxygo/m_route"
+	"github.com/zyong/miniproxygo/m_socks"
+	"github.com/zyong/miniproxygo/m_util"
+)
+
+// routeState is the routing settings of local, persisted to RouteStateFile
+// when changed on dashboard.
+type routeState struct {
+	Mode     m_route.Mode `json:"mode"`
+	Upstream string       `json:"upstream"`
+	Rules    []string     `json:"rules"`
+}
+
+// router routes targets of local to upstream or directly
+type router struct {
+	lock      sync.RWMutex
+	mode      m_route.Mode
+	upstream  string   // current upstream
+	upstreams []string // RemoteServer and Upstream of config
+	rules     m_route.Rules
+}
+
+// loadRoute sets up router from RouteStateFile if it exists, or else from
+// config.
+func (srv *Server) loadRoute() error {
+	r, err := srv.newRouter(&srv.Config)
+	if err != nil {
+		return err
+	}
+	srv.route = r
+	return nil
+}
+
+// reloadRoute applies upstreams and routing in cfg, or in RouteStateFile
+// if it exists. RemoteServer is not changed.
+func (srv *Server) reloadRoute(cfg *m_config.Conf) error {
+	srv.routeLock.Lock()
+	defer srv.routeLock.Unlock()
+
+	r, err := srv.newRouter(cfg)
+	if err != nil {
+		return err
+	}
+	srv.route.replace(r)
+
+	// pools to upstreams removed are closed
+	var addrs []string
+	for _, u := range r.upstreams {
+		addrs = append(addrs, srv.upstreamAddr(u))
+	}
+	srv.closePools(addrs)
+
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	cur := &srv.Config.Server
+	cur.Upstream, cur.RouteMode, cur.RouteRule = cfg.Server.Upstream, cfg.Server.RouteMode, cfg.Server.RouteRule
+	return nil
+}
+
+// newRouter creates router of upstreams and routing in cfg, overridden by
+// RouteStateFile if it exists.
+func (srv *Server) newRouter(cfg *m_config.Conf) (*router, error) {
+	remote := srv.remoteName()
+	r := &router{upstreams: []string{remote}}
+	for _, addr := range cfg.Server.Upstream {
+		if addr != remote {
+			r.upstreams = append(r.upstreams, addr)
+		}
+	}
+
+	state := routeState{Mode: m_route.Mode(cfg.Server.RouteMode), Upstream: remote, Rules: cfg.Server.RouteRule}
+	if path := srv.confPath(srv.Config.Server.RouteStateFile); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("route: %s: %v", path, err)
+		}
+	}
+	if !r.hasUpstream(state.Upstream) {
+		log.Logger.Warn("route: upstream %s not configured, use %s", state.Upstream, remote)
+		state.Upstream = remote
+	}
+	if err := r.set(state); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// remoteName returns RemoteServer of config. RemoteServer is replaced by
+// address of plugin if plugin is running.
+func (srv *Server) remoteName() string {
+	if srv.plugin != nil {
+		return srv.plugin.Remote
+	}
+	return srv.Config.Server.RemoteServer
+}
+
+// upstreamAddr returns address dialed for upstream, which is address of
+// plugin for RemoteServer if plugin is running.
+func (srv *Server) upstreamAddr(upstream string) string {
+	if srv.plugin != nil && upstream == srv.plugin.Remote {
+		return srv.Config.Server.RemoteServer
+	}
+	return upstream
+}
+
+// replace replaces settings of r with those of nr
+func (r *router) replace(nr *router) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mode, r.upstream, r.upstreams, r.rules = nr.mode, nr.upstream, nr.upstreams, nr.rules
+}
+
+// upstreamList returns upstreams to choose from
+func (r *router) upstreamList() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.upstreams
+}
+
+// hasUpstream reports whether addr is an upstream, with lock held or
+// before r is shared
+func (r *router) hasUpstream(addr string) bool {
+	for _, u := range r.upstreams {
+		if u == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// set validates state and applies it
+func (r *router) set(state routeState) error {
+	mode, err := m_route.ParseMode(string(state.Mode))
+	if err != nil {
+		return err
+	}
+	if !r.hasUpstream(state.Upstream) {
+		return fmt.Errorf("route: unknown upstream %s", state.Upstream)
+	}
+	rules, err := m_route.Parse(state.Rules)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mode, r.upstream, r.rules = mode, state.Upstream, rules
+	return nil
+}
+
+func (r *router) state() routeState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return routeState{Mode: r.mode, Upstream: r.upstream, Rules: r.rules.Lines()}
+}
+
+// current returns current upstream
+func (r *router) current() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.upstream
+}
+
+// decide returns action of tgt with text of the rule deciding it
+func (r *router) decide(tgt m_socks.Addr) (m_route.Action, string) {
+	host, portStr, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return m_route.Proxy, ""
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.rules.Decide(r.mode, host, port)
+}
+
+// setRoute applies state and persists it to RouteStateFile
+func (srv *Server) setRoute(state routeState) error {
+	srv.routeLock.Lock()
+	defer srv.routeLock.Unlock()
+
+	// validate before saving
+	check := &router{upstreams: srv.route.upstreamList()}
+	if err := check.set(state); err != nil {
+		return err
+	}
+	state = check.state()
+	if path := srv.confPath(srv.Config.Server.RouteStateFile); path != "" {
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = m_util.WriteFileAtomic(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return srv.route.set(state)
+}
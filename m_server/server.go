@@ -3,43 +3,108 @@ package m_server
 import (
 	"fmt"
 	"net"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 import (
 	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_acl"
 	"github.com/zyong/miniproxygo/m_config"
 	"github.com/zyong/miniproxygo/m_core"
+	"github.com/zyong/miniproxygo/m_dialer"
+	"github.com/zyong/miniproxygo/m_limit"
+	"github.com/zyong/miniproxygo/m_plugin"
+	"github.com/zyong/miniproxygo/m_quota"
+	"github.com/zyong/miniproxygo/m_route"
 	"github.com/zyong/miniproxygo/m_socks"
+	"github.com/zyong/miniproxygo/m_systemd"
+	"github.com/zyong/miniproxygo/m_transport"
+	"github.com/zyong/miniproxygo/m_upgrade"
 )
 
 type Stats struct {
-	ReqNum	int64
-	CoNum	int64
+	ReqNum	int64 // proxy requests served
+	CoNum	int64 // client connections open
+
+	ConnTotal      int64 // client connections accepted
+	BytesIn        int64 // bytes relayed from clients
+	BytesOut       int64 // bytes relayed to clients
+	HandshakeFail  int64 // connections failed before target address is read
+	ReplayRejected int64 // connections with repeated salt
+
+	// triggers of flushing corked connections
+	CorkTimerFlush  int64 // delay passed
+	CorkBufferFlush int64 // buffer is full
+	CorkEarlyFlush  int64 // the first payload follows header in adaptive mode
+
+	RejectedConns int64 // client connections rejected by guard of listeners
 }
 
 type Server struct {
 	Addr                    string
 	Cipher                  m_core.Cipher
+	Transport               m_transport.Transport // transport between local and server
 	ReadTimeout             time.Duration // maximum duration before timing out read of the request
 	WriteTimeout            time.Duration // maximum duration before timing out write of the response
 	TlsHandshakeTimeout     time.Duration // maximum duration before timing out handshake
 	GracefulShutdownTimeout time.Duration // maximum duration before timing out graceful shutdown
+	IdleConnTimeout         time.Duration // maximum duration of a connection idle in pool
 
 	// CloseNotifyCh allow detecting when the server in graceful shutdown state
 	CloseNotifyCh chan bool
 
-	listener net.Listener
+	listeners    map[string]net.Listener   // by name: socks, reverse or monitor
+	guards       map[string]*guardListener // guards of listeners by name
+	inherited    map[string]net.Listener   // passed on upgrade or by systemd, taken by listen
+	accepting    map[net.Listener]bool     // health of accept loops by listeners
+	listenerLock sync.Mutex
+	serveErr     chan error // results of serving listeners, nil if replaced on reload
+	reloadLock   sync.Mutex // serializes reloads of config
 
 	connWaitGroup sync.WaitGroup // waits for server conns to finish
+	active        *connSet       // accepted client conns, closed when graceful shutdown times out
+	forceClosed   int32          // 1 if active conns are closed by force
+	upgraded      int32          // 1 if new process of upgrade takes over
+	shutdownOnce  sync.Once
+	doneCh        chan struct{} // closed when shutdown finishes
 
 	Config   m_config.Conf
 	ConfRoot string
 
 	stats	Stats
 	Version string // version of bfe server
+	startTime time.Time
+	health  *health // dial failures and state of upstreams
+	metrics *metrics
+	conns   *connTable // active relays
+
+	reverse *reverseHub // state of reverse tunnel on server side
+	mux     *muxPool    // mux sessions to upstreams on local side
+
+	route     *router    // routing of targets on local side
+	routeLock sync.Mutex // serializes changes of routing
+
+	pools    map[string]*connPool // connection pools to upstreams on local side, nil after shutdown
+	poolLock sync.Mutex
+
+	plugin *m_plugin.Plugin // SIP003 plugin, nil if not configured
+	dialer m_dialer.Dialer  // outbound dialer, to RemoteServer on local and to targets on server
+	acl    *m_acl.ACL       // ACL of targets on server, overridden by rules of users
+
+	users         []*user      // users of server sorted by name, replaced by admin API
+	usersLock     sync.RWMutex // lock of users
+	userAdminLock sync.Mutex   // serializes changes of users
+
+	clients *clientCount  // concurrent client connections of all listeners
+	drains  chan struct{} // rejected connections being drained
+
+	upBucket   *m_limit.Bucket // bandwidth limits of all connections, nil for no limit
+	downBucket *m_limit.Bucket
+
+	quota       *m_quota.Book    // accounts of traffic, nil if not accounted
+	portAccount *m_quota.Account // traffic of Port, nil if not accounted
 
 }
 
@@ -52,6 +117,31 @@ func NewServer(cfg m_config.Conf, confRoot string, version string) *Server {
 	s.InitConfig()
 
 	s.CloseNotifyCh = make(chan bool)
+	s.doneCh = make(chan struct{})
+	s.listeners = make(map[string]net.Listener)
+	s.guards = make(map[string]*guardListener)
+	s.inherited = make(map[string]net.Listener)
+	s.accepting = make(map[net.Listener]bool)
+	s.serveErr = make(chan error)
+	s.active = newConnSet()
+	s.Transport = m_transport.Raw
+	s.dialer = m_dialer.Direct
+	s.reverse = newReverseHub()
+	s.mux = newMuxPool(s.muxConfig(), s.dialTransport)
+	s.route = &router{
+		mode:      m_route.ModeGlobal,
+		upstream:  cfg.Server.RemoteServer,
+		upstreams: []string{cfg.Server.RemoteServer},
+	}
+	s.pools = make(map[string]*connPool)
+	s.clients = newClientCount()
+	s.drains = make(chan struct{}, maxRejectDrains)
+	s.health = newHealth()
+	s.metrics = s.newMetrics()
+	s.conns = newConnTable()
+	s.startTime = time.Now()
+	s.upBucket = kbps(cfg.Server.UploadRate)
+	s.downBucket = kbps(cfg.Server.DownloadRate)
 
 	s.stats.ReqNum = 0
 	s.stats.CoNum = 0
@@ -62,46 +152,174 @@ func NewServer(cfg m_config.Conf, confRoot string, version string) *Server {
 
 // Start a proxy client
 func Start(cfg m_config.Conf, version string, confRoot string) error {
+	return NewServer(cfg, confRoot, version).Run()
+}
+
+// legacyPassword is the key of cipher used by versions which ignored
+// Password in config
+const legacyPassword = "password"
+
+// password returns Password in config, or legacyPassword if it is empty so
+// that such config keeps working with peers of old versions.
+func (s *Server) password() string {
+	if s.Config.Server.Password == "" {
+		return legacyPassword
+	}
+	return s.Config.Server.Password
+}
+
+// Run sets up server according to config and serves until it fails or
+// shuts down gracefully.
+func (s *Server) Run() error {
 	var err error
 
-	s := NewServer(cfg, confRoot, version)
+	if err = checkConfig(&s.Config.Server); err != nil {
+		return err
+	}
 
 	// 选择一个加密算法，可以不加密？和简单密码
-	ciph, err := m_core.PickCipher(s.Config.Server.Cipher, []byte{}, "password")
+	ciph, err := m_core.PickCipher(s.Config.Server.Cipher, []byte{}, s.password())
 	if err != nil {
 		return err
 	}
 	s.Cipher = ciph
 
-	serveChan := make(chan error)
+	// take listeners passed on upgrade or by systemd before any process
+	// is started
+	if err = s.inheritListeners(); err != nil {
+		return err
+	}
+	defer s.closeInherited()
+
+	if err = s.loadQuota(); err != nil {
+		return err
+	}
+	if !s.Config.Server.Local {
+		if err = s.loadUsers(); err != nil {
+			return err
+		}
+	}
+	if s.quota != nil {
+		go s.runQuota()
+	}
+
+	tr, err := s.PickTransport()
+	if err != nil {
+		return err
+	}
+	s.Transport = tr
+
+	d, err := s.PickDialer()
+	if err != nil {
+		return err
+	}
+	s.dialer = d
+
+	if s.Config.Server.Plugin != "" {
+		if err = s.StartPlugin(); err != nil {
+			return err
+		}
+		defer s.plugin.Stop()
+	}
+	if s.Config.Server.Local {
+		if err = s.loadRoute(); err != nil {
+			return err
+		}
+	}
+	if err = s.listenAll(); err != nil {
+		return err
+	}
+
+	if s.hasListener("monitor") {
+		go func() {
+			if err := s.ServeMonitor(); err != nil {
+				log.Logger.Warn("monitor: %v", err)
+			}
+		}()
+	}
 
 	if s.Config.Server.Local {
 		go func() {
-			err := s.ServeSocksLocal()
-			serveChan <- err
+			s.served(s.ServeSocksLocal())
 		}()
+		if s.Config.Server.ReverseTarget != "" {
+			go func() {
+				s.served(s.ServeReverseLocal(s.localShadow()))
+			}()
+		}
 	} else {
 		go func() {
-			err := s.ServeSocksServer()
-			serveChan <- err
+			s.served(s.ServeSocksServer())
 		}()
+		if s.runningAddr("reverse") != "" {
+			go func() {
+				s.served(s.ServeReverseServer())
+			}()
+		}
+	}
+
+	go s.handleSignals()
+	if err = m_upgrade.Ready(); err != nil {
+		log.Logger.Warn("upgrade: failed to report readiness: %v", err)
+	}
+	s.notify("READY=1\n" + s.statusLine())
+	if interval := m_systemd.WatchdogInterval(); interval > 0 {
+		go s.runWatchdog(interval)
 	}
 
-	err = <-serveChan
+	// listeners replaced on reload return nil
+	for {
+		err = <-s.serveErr
+		if err != nil || s.CheckGracefulShutdown() {
+			break
+		}
+	}
+	if s.CheckGracefulShutdown() {
+		<-s.doneCh
+		return nil
+	}
 	return err
 }
 
+// served passes result of serving a listener to Run, or drops it after
+// shutdown when Run may not wait for it.
+func (s *Server) served(err error) {
+	select {
+	case s.serveErr <- err:
+	case <-s.doneCh:
+	}
+}
+
 func (s *Server) ServeSocksLocal() (err error) {
-	log.Logger.Info("Start: SOCKS proxy local %s <-> %s", s.Addr, s.Config.Server.RemoteServer)
-	shadow := s.Cipher.StreamConn
-	return s.ServeLocal(s.listener, shadow, func(c net.Conn) (m_socks.Addr, error) { return m_socks.HandShake(c) })
+	addr := s.runningAddr("socks")
+	log.Logger.Info("Start: SOCKS proxy local %s <-> %s", addr, s.Config.Server.RemoteServer)
+	shadow := s.localShadow()
+	if s.Config.Server.MaxIdle > 0 {
+		// pre-dial connections before the first request comes
+		if p := s.getPool(s.Config.Server.RemoteServer); p != nil {
+			p.fill()
+		}
+	}
+	l, err := s.listen("socks", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeLocal(l, shadow, handShake)
+}
+
+func handShake(c net.Conn) (m_socks.Addr, error) {
+	return m_socks.HandShake(c)
 }
 
 // newConn create a conn to serve client request
 func (s *Server) ServeSocksServer() (err error) {
-	log.Logger.Info("Start: SOCKS proxy server %s", s.Addr)
-	shadow := s.Cipher.StreamConn
-	return s.ServeServer(s.listener, shadow)
+	addr := s.runningAddr("socks")
+	log.Logger.Info("Start: SOCKS proxy server %s", addr)
+	l, err := s.listen("socks", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeServer(l)
 }
 
 // InitConfig set some parameter based on config.
@@ -114,8 +332,14 @@ func (srv *Server) InitConfig() {
 		srv.ReadTimeout = time.Duration(srv.Config.Server.ClientReadTimeout) * time.Second
 	}
 
+	// set TlsHandshakeTimeout
+	srv.TlsHandshakeTimeout = time.Duration(srv.Config.Server.TlsHandshakeTimeout) * time.Second
+
 	// set GracefulShutdownTimeout
 	srv.GracefulShutdownTimeout = time.Duration(srv.Config.Server.GracefulShutdownTimeout) * time.Second
+
+	// set IdleConnTimeout
+	srv.IdleConnTimeout = time.Duration(srv.Config.Server.IdleConnTimeout) * time.Second
 }
 
 func (srv *Server) InitSocks() (err error) {
@@ -124,52 +348,6 @@ func (srv *Server) InitSocks() (err error) {
 	return nil
 }
 
-// ShutdownHandler is signal handler for QUIT
-func (srv *Server) ShutdownHandler(sig os.Signal) {
-	shutdownTimeout := srv.Config.Server.GracefulShutdownTimeout
-	log.Logger.Info("get signal %s, graceful shutdown in %ds", sig, shutdownTimeout)
-
-	// notify that server is in graceful shutdown state
-	close(srv.CloseNotifyCh)
-
-	// close server listeners
-	srv.closeListeners()
-
-	// waits server conns to finish
-	connFinCh := make(chan bool)
-	go func() {
-		srv.connWaitGroup.Wait()
-		connFinCh <- true
-	}()
-
-	shutdownTimer := time.After(time.Duration(shutdownTimeout) * time.Second)
-
-Loop:
-	for {
-		select {
-		// waits server conns to finish
-		case <-connFinCh:
-			log.Logger.Info("graceful shutdown success.")
-			break Loop
-
-		// wait for shutdown timeout
-		case <-shutdownTimer:
-			log.Logger.Info("graceful shutdown timeout.")
-			break Loop
-		}
-	}
-
-	// shutdown server
-	log.Logger.Close()
-	os.Exit(0)
-}
-
-func (srv *Server) closeListeners() {
-	if err := srv.listener.Close(); err != nil {
-		log.Logger.Error("closeListeners(): %s, %s", err, srv.listener.Addr())
-	}
-}
-
 // CheckGracefulShutdown check wether the server is in graceful shutdown state.
 func (srv *Server) CheckGracefulShutdown() bool {
 	select {
@@ -179,3 +357,20 @@ func (srv *Server) CheckGracefulShutdown() bool {
 		return false
 	}
 }
+
+// GetStats returns a snapshot of statistics of server.
+func (srv *Server) GetStats() Stats {
+	return Stats{
+		ReqNum:          atomic.LoadInt64(&srv.stats.ReqNum),
+		CoNum:           atomic.LoadInt64(&srv.stats.CoNum),
+		ConnTotal:       atomic.LoadInt64(&srv.stats.ConnTotal),
+		BytesIn:         atomic.LoadInt64(&srv.stats.BytesIn),
+		BytesOut:        atomic.LoadInt64(&srv.stats.BytesOut),
+		HandshakeFail:   atomic.LoadInt64(&srv.stats.HandshakeFail),
+		ReplayRejected:  atomic.LoadInt64(&srv.stats.ReplayRejected),
+		CorkTimerFlush:  atomic.LoadInt64(&srv.stats.CorkTimerFlush),
+		CorkBufferFlush: atomic.LoadInt64(&srv.stats.CorkBufferFlush),
+		CorkEarlyFlush:  atomic.LoadInt64(&srv.stats.CorkEarlyFlush),
+		RejectedConns:   atomic.LoadInt64(&srv.stats.RejectedConns),
+	}
+}
@@ -2,6 +2,7 @@ package m_server
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,9 @@ import (
 
 import (
 	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_quota"
+	"github.com/zyong/miniproxygo/m_route"
+	"github.com/zyong/miniproxygo/m_shadow"
 	"github.com/zyong/miniproxygo/m_socks"
 )
 
@@ -35,22 +39,19 @@ func isTimeout(err error) bool {
 	return ok && e.Timeout()
 }
 
-// relay copies between left and right bidirectionally
-func (srv *Server) relay(left, right net.Conn) error {
+// relay copies between left of client and right of target bidirectionally,
+// with bandwidth limited by t
+func (srv *Server) relay(left, right net.Conn, t *throttle) error {
 	var err, err1 error
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		_, err1 = io.Copy(right, left)
-		if srv.ReadTimeout > 0 {
-			right.SetReadDeadline(time.Now().Add(srv.ReadTimeout)) // unblock read on right
-		}
+		_, err1 = io.Copy(right, t.upload(left))
+		srv.unblock(right, err1) // unblock read on right
 	}()
-	_, err = io.Copy(left, right)
-	if srv.ReadTimeout > 0 {
-		left.SetReadDeadline(time.Now().Add(srv.ReadTimeout)) // unblock read on left
-	}
+	_, err = io.Copy(left, t.download(right))
+	srv.unblock(left, err) // unblock read on left
 	wg.Wait()
 	if err1 != nil && !errors.Is(err1, os.ErrDeadlineExceeded) { // requires Go 1.15+
 		return err1
@@ -61,22 +62,41 @@ func (srv *Server) relay(left, right net.Conn) error {
 	return nil
 }
 
+// unblock lets read on c time out after copy to c ends with err, at once
+// if quota is exceeded or connections are closed by force on shutdown.
+func (srv *Server) unblock(c net.Conn, err error) {
+	switch {
+	case errors.Is(err, m_quota.ErrExceeded), atomic.LoadInt32(&srv.forceClosed) == 1:
+		c.SetReadDeadline(time.Now())
+	case srv.ReadTimeout > 0:
+		c.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
+	}
+}
+
 type corkedConn struct {
 	net.Conn
-	bufw   *bufio.Writer
-	corked bool
-	delay  time.Duration
-	err    error
-	lock   sync.Mutex
-	once   sync.Once
+	bufw       *bufio.Writer
+	corked     bool
+	delay      time.Duration
+	flushAfter int // flush after this many writes in adaptive mode, 0 to disable
+	writes     int
+	timer      *time.Timer
+	stats      *Stats
+	err        error
+	lock       sync.Mutex
 }
 
-func timedCork(c net.Conn, d time.Duration, bufSize int) net.Conn {
+// timedCork holds writes on c until delay passes or buffer of bufSize is
+// full. If flushAfter > 0, writes are flushed as soon as flushAfter writes
+// have been buffered.
+func timedCork(c net.Conn, d time.Duration, bufSize int, flushAfter int, stats *Stats) net.Conn {
 	return &corkedConn{
-		Conn:   c,
-		bufw:   bufio.NewWriterSize(c, bufSize),
-		corked: true,
-		delay:  d,
+		Conn:       c,
+		bufw:       bufio.NewWriterSize(c, bufSize),
+		corked:     true,
+		delay:      d,
+		flushAfter: flushAfter,
+		stats:      stats,
 	}
 }
 
@@ -86,18 +106,69 @@ func (w *corkedConn) Write(p []byte) (int, error) {
 	if w.err != nil {
 		return 0, w.err
 	}
-	if w.corked {
-		w.once.Do(func() {
-			time.AfterFunc(w.delay, func() {
-				w.lock.Lock()
-				defer w.lock.Unlock()
-				w.corked = false
-				w.err = w.bufw.Flush()
-			})
+	if !w.corked {
+		return w.Conn.Write(p)
+	}
+
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() {
+			w.lock.Lock()
+			defer w.lock.Unlock()
+			if w.corked {
+				w.uncork(&w.stats.CorkTimerFlush)
+			}
 		})
-		return w.bufw.Write(p)
 	}
-	return w.Conn.Write(p)
+
+	if len(p) > w.bufw.Available() {
+		// buffer is full, bufio writes through
+		n, err := w.bufw.Write(p)
+		if err == nil {
+			err = w.uncork(&w.stats.CorkBufferFlush)
+		}
+		return n, err
+	}
+
+	n, err := w.bufw.Write(p)
+	if w.writes++; err == nil && w.flushAfter > 0 && w.writes >= w.flushAfter {
+		err = w.uncork(&w.stats.CorkEarlyFlush)
+	}
+	return n, err
+}
+
+// uncork flushes buffered writes and counts the trigger of flush
+func (w *corkedConn) uncork(trigger *int64) error {
+	w.corked = false
+	w.timer.Stop()
+	w.err = w.bufw.Flush()
+	atomic.AddInt64(trigger, 1)
+	return w.err
+}
+
+// cork wraps connection c of listener, socks or reverse, according to its
+// cork settings, which fall back to global ones. In adaptive mode, c is
+// flushed when a write of payload follows header writes, e.g. salt and
+// target address.
+func (srv *Server) cork(c net.Conn, listener string, header int) net.Conn {
+	cfg := &srv.Config.Server
+	delay, bufSize := cfg.SocksCorkDelay, cfg.SocksCorkBufSize
+	if listener == "reverse" {
+		delay, bufSize = cfg.ReverseCorkDelay, cfg.ReverseCorkBufSize
+	}
+	if delay == 0 {
+		delay = cfg.CorkDelay
+	}
+	if bufSize == 0 {
+		bufSize = cfg.CorkBufSize
+	}
+	if delay <= 0 {
+		return c
+	}
+	flushAfter := 0
+	if cfg.CorkAdaptive {
+		flushAfter = header + 1
+	}
+	return timedCork(c, time.Duration(delay)*time.Millisecond, bufSize, flushAfter, &srv.stats)
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
@@ -111,151 +182,279 @@ func (w *corkedConn) Write(p []byte) (int, error) {
 // Return
 //     - err: error
 func (srv *Server) ServeLocal(l net.Listener, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (m_socks.Addr, error)) error {
-	var tempDelay time.Duration // how long to sleep on accept failure
-
-	l, err := net.Listen("tcp", srv.Addr)
-
+	l, err := srv.guard(l, srv.clientRules("socks"))
 	if err != nil {
-		log.Logger.Warn("socks: failed to listen to %s: %v", srv.Config.Server.Port, err)
 		return err
 	}
 
-	var start time.Time
+	return srv.serve(l, "socks", func(c net.Conn) {
+		atomic.AddInt64(&srv.stats.ReqNum, 1)
+		atomic.AddInt64(&srv.stats.CoNum, 1)
+		atomic.AddInt64(&srv.stats.ConnTotal, 1)
+		defer atomic.AddInt64(&srv.stats.CoNum, -1)
+		defer c.Close()
 
-	for {
-		// accept new connection
-		c, e := l.Accept()
-		if e != nil {
-			if isTimeout(e) {
-				continue
-			}
+		accepted := time.Now()
+		tgt, err := getAddr(c)
 
-			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				tempDelay = delayCalc(tempDelay)
+		log.Logger.Info("socks: get target address: %s", fmt.Sprintf("%s", tgt))
+		if err != nil {
+			log.Logger.Warn("socks: failed to get target address from %v: %v", c.RemoteAddr(), err)
+			srv.handshakeFailed(err)
 
-				log.Logger.Error("socks: Accept error: %v; retrying in %v", e, tempDelay)
-				time.Sleep(tempDelay)
-				continue
+			_, err = io.Copy(ioutil.Discard, c)
+			if err != nil {
+				log.Logger.Warn("socks: failed to discard error: %v", err)
 			}
+			return
+		}
 
-			// if in GraceShutdown state, exit accept loop after timeout
-			if srv.CheckGracefulShutdown() {
-				shutdownTimeout := srv.Config.Server.GracefulShutdownTimeout
-				time.Sleep(time.Duration(shutdownTimeout) * time.Second)
-			}
+		srv.metrics.handshakeDuration.With().Observe(time.Since(accepted).Seconds())
 
-			return e
+		if srv.overQuota(nil) {
+			return
 		}
 
-		atomic.AddInt64(&srv.stats.ReqNum, 1)
+		action, rule := srv.route.decide(tgt)
+		switch action {
+		case m_route.Block:
+			log.Logger.Info("socks: block %s by rule %q", tgt, rule)
+			return
+		case m_route.Direct:
+			srv.proxyDirect(c, tgt, rule)
+			return
+		}
 
-		// start go-routine for new connection
-		go func() {
-			defer c.Close()
+		upstream := srv.route.current()
+		start := time.Now()
+		rc, err := srv.dialRemote(srv.upstreamAddr(upstream), shadow)
+		if err != nil {
+			log.Logger.Warn("socks: failed to connect to upstream %s: %v", upstream, err)
+			return
+		}
+		log.Logger.Info("socks: proxy %s <-> %s, connect elapsed time:%fs, total req num %d",
+			c.RemoteAddr(), rc.RemoteAddr(), time.Since(start).Seconds(), atomic.LoadInt64(&srv.stats.ReqNum))
 
-			tgt, err := getAddr(c)
+		defer rc.Close()
 
-			log.Logger.Info("socks: get target address: %s", fmt.Sprintf("%s", tgt))
-			if err != nil {
-				log.Logger.Warn("socks: failed to get target address from %v: %v", c.RemoteAddr(), err)
+		req := []byte(tgt)
+		if cfg := &srv.Config.Server; cfg.PaddingRecords > 0 {
+			// hide length of target address in padded record with initial payload
+			req = readInitial(c, tgt, time.Duration(cfg.PaddingWait)*time.Millisecond)
+		}
+		if _, err = rc.Write(req); err != nil {
+			log.Logger.Warn("socks: failed to send target address: %v", err)
+			return
+		}
 
-				_, err = io.Copy(ioutil.Discard, c)
-				if err != nil {
-					log.Logger.Warn("socks: failed to discard error: %v", err)
-				}
-				return
-			}
+		log.Logger.Info("socks: proxy %s <-> %s", c.RemoteAddr(), tgt)
+		e := srv.conns.add(&connEntry{
+			client:   c.RemoteAddr().String(),
+			target:   tgt.String(),
+			upstream: upstream,
+			route:    m_route.Proxy,
+			rule:     rule,
+			left:     c,
+			right:    rc,
+		})
+		defer srv.conns.remove(e)
+		if err = srv.relay(c, rc, srv.newThrottle(nil, e)); err != nil {
+			log.Logger.Warn("socks: relay error from %v:%v", c.RemoteAddr(), err)
+			srv.metrics.errors.With(errClassRelay).Inc()
+		}
+		srv.metrics.connDuration.With("").Observe(time.Since(start).Seconds())
+	})
+}
 
-			start = time.Now()
-			rc, err := net.Dial("tcp", srv.Config.Server.RemoteServer)
-			if err != nil {
-				log.Logger.Warn("socks: failed to connect to RemoteServer: %v", err)
-				return
-			}
-			log.Logger.Info("socks: proxy %s <-> %s, connect elapsed time:%fs, total req num %d",
-				c.RemoteAddr(), rc.RemoteAddr(), time.Since(start).Seconds(), srv.stats.ReqNum)
+// proxyDirect connects to tgt without upstream and relays it with client
+// c, as decided by rule.
+func (srv *Server) proxyDirect(c net.Conn, tgt m_socks.Addr, rule string) {
+	start := time.Now()
+	rc, err := srv.dialer.Dial("tcp", tgt.String())
+	srv.dialed(tgt.String(), false, start, err)
+	if err != nil {
+		log.Logger.Warn("socks: failed to connect to %s directly: %v", tgt, err)
+		return
+	}
+	defer rc.Close()
+
+	log.Logger.Info("socks: direct %s <-> %s", c.RemoteAddr(), tgt)
+	e := srv.conns.add(&connEntry{
+		client: c.RemoteAddr().String(),
+		target: tgt.String(),
+		route:  m_route.Direct,
+		rule:   rule,
+		left:   c,
+		right:  rc,
+	})
+	defer srv.conns.remove(e)
+	if err = srv.relay(c, rc, srv.newThrottle(nil, e)); err != nil {
+		log.Logger.Warn("socks: relay error from %v:%v", c.RemoteAddr(), err)
+		srv.metrics.errors.With(errClassRelay).Inc()
+	}
+	srv.metrics.connDuration.With("").Observe(time.Since(start).Seconds())
+}
 
-			defer rc.Close()
+// errCmdHandled means the stream has been served by a command other than proxy
+var errCmdHandled = errors.New("socks: stream handled by command")
 
-			rc = timedCork(rc, 10*time.Millisecond, 1280)
+// readRequest reads the first command of enciphered stream sc. Reverse tunnel
+// and mux commands are served here and errCmdHandled is returned, otherwise
+// the target address of proxy request is returned.
+func (srv *Server) readRequest(sc net.Conn, u *user) (m_socks.Addr, error) {
+	var cmd [1]byte
+	if _, err := io.ReadFull(sc, cmd[:]); err != nil {
+		return nil, err
+	}
 
-			// create data structure for new connection
-			rc = shadow(rc)
+	switch cmd[0] {
+	case cmdReverseControl:
+		if err := srv.serveReverseControl(sc, u); err != nil {
+			log.Logger.Warn("reverse: control from %v of user %s refused: %v", sc.RemoteAddr(), u.name, err)
+		}
+		return nil, errCmdHandled
+	case cmdReverseDial:
+		if err := srv.serveReverseDial(sc, u); err != nil {
+			log.Logger.Warn("reverse: dial back from %v error: %v", sc.RemoteAddr(), err)
+		}
+		return nil, errCmdHandled
+	case cmdMux:
+		if err := srv.serveMux(sc, u); err != nil {
+			return nil, err
+		}
+		return nil, errCmdHandled
+	}
 
-			if _, err = rc.Write(tgt); err != nil {
-				log.Logger.Warn("socks: failed to send target address: %v", err)
-				return
-			}
+	return m_socks.ReadAddr(io.MultiReader(bytes.NewReader(cmd[:]), sc))
+}
 
-			log.Logger.Info("socks: proxy %s <-> %s", c.RemoteAddr(), tgt)
-			if err = srv.relay(rc, c); err != nil {
-				log.Logger.Warn("socks: relay error from %v:%v", c.RemoteAddr(), err)
-			}
+// dialRemote returns an enciphered stream to upstream server addr. The
+// stream is carried by a mux session if mux is enabled and negotiated with
+// server.
+func (srv *Server) dialRemote(addr string, shadow func(net.Conn) net.Conn) (net.Conn, error) {
+	if srv.Config.Server.Mux {
+		st, err := srv.mux.open(addr, shadow)
+		if err == nil {
+			return st, nil
+		}
+		log.Logger.Warn("mux: failed to open stream: %v, fall back to plain connection", err)
+	}
 
-		}()
+	rc, err := srv.dialUpstream(addr)
+	if err != nil {
+		return nil, err
 	}
-}
 
-// Listen on addr for incoming connections.
-func (srv *Server) ServeServer(l net.Listener, shadow func(net.Conn) net.Conn) error {
-	l, err := net.Listen("tcp", srv.Addr)
+	header := 2 // salt and target address
+	if srv.Config.Server.PaddingRecords > 0 {
+		header = 1 // target address is merged with initial payload
+	}
+	rc = srv.cork(rc, "socks", header)
 
+	// create data structure for new connection
+	return shadow(rc), nil
+}
+
+// ServeServer serves enciphered streams from locals accepted on l.
+func (srv *Server) ServeServer(l net.Listener) error {
+	l, err := srv.guard(l, srv.clientRules("socks"))
 	if err != nil {
-		log.Logger.Warn("socks: failed to listen to %s: %v", srv.Config.Server.Port, err)
 		return err
 	}
 
-	var start time.Time
+	return srv.serve(l, "socks", func(c net.Conn) {
+		atomic.AddInt64(&srv.stats.CoNum, 1)
+		atomic.AddInt64(&srv.stats.ConnTotal, 1)
+		defer atomic.AddInt64(&srv.stats.CoNum, -1)
+		defer c.Close()
+
+		accepted := time.Now()
+		c = srv.Transport.Server(c)
+		c = srv.cork(c, "socks", 1) // salt
 
-	for {
-		c, err := l.Accept()
+		u, c, err := srv.identify(c)
 		if err != nil {
-			log.Logger.Warn("socks: failed to accept: %v", err)
-			continue
+			log.Logger.Warn("socks: failed to identify user of %v: %v", c.RemoteAddr(), err)
+			srv.handshakeFailed(err)
+			// drain c like a bad request, not to tell a probe from wrong password
+			io.Copy(ioutil.Discard, c)
+			return
 		}
+		// closed by admin API if user is removed, disabled or rekeyed
+		if !u.conns.add(c) {
+			return
+		}
+		defer u.conns.remove(c)
+		sc := u.cipher.StreamConn(c)
 
-		atomic.AddInt64(&srv.stats.ReqNum, 1)
-		go func() {
-			defer c.Close()
-
-			c = timedCork(c, 10*time.Millisecond, 1280)
-
-			sc := shadow(c)
-
-			start = time.Now()
-			// todo add user certification
-			tgt, err := m_socks.ReadAddr(sc)
-			log.Logger.Info("socks: server read addr elapsed time :%fs", time.Since(start)/1000)
-
-			if err != nil {
-				log.Logger.Warn("socks: failed to get target address from %v: %v", c.RemoteAddr(), err)
-				// drain c to avoid leaking server behavioral features
-				// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
-				_, err = io.Copy(ioutil.Discard, c)
-				if err != nil {
-					log.Logger.Warn("socks: discard error: %v", err)
-				}
-				return
-			}
+		start := time.Now()
+		tgt, err := srv.readRequest(sc, u)
+		log.Logger.Info("socks: server read addr elapsed time :%fs", time.Since(start)/1000)
 
-			start = time.Now()
-			// # todo add dns resolve module
-			rc, err := net.Dial("tcp", tgt.String())
+		if err == errCmdHandled {
+			return
+		}
+		if err != nil {
+			log.Logger.Warn("socks: failed to get target address from %v: %v", c.RemoteAddr(), err)
+			srv.handshakeFailed(err)
+			// drain c to avoid leaking server behavioral features
+			// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
+			_, err = io.Copy(ioutil.Discard, c)
 			if err != nil {
-				log.Logger.Warn("socks: failed to connect to target: %v", err)
-				return
+				log.Logger.Warn("socks: discard error: %v", err)
 			}
-			atomic.AddInt64(&srv.stats.ReqNum, 1)
+			return
+		}
 
-			log.Logger.Info("socks: proxy %s <-> %s, connect elapsed time:%fs, total req num %d",
-				c.RemoteAddr(), rc.RemoteAddr(), time.Since(start).Seconds(), srv.stats.ReqNum)
+		srv.metrics.handshakeDuration.With().Observe(time.Since(accepted).Seconds())
+		srv.proxyTarget(sc, tgt, u)
+	})
+}
 
+// handshakeFailed counts failure of reading target address of a connection
+func (srv *Server) handshakeFailed(err error) {
+	if errors.Is(err, m_shadow.ErrRepeatedSalt) {
+		atomic.AddInt64(&srv.stats.ReplayRejected, 1)
+		srv.metrics.errors.With(errClassReplay).Inc()
+		return
+	}
+	atomic.AddInt64(&srv.stats.HandshakeFail, 1)
+	srv.metrics.errors.With(errClassHandshake).Inc()
+}
 
-			defer rc.Close()
+// proxyTarget connects to tgt for user u and relays it with enciphered
+// stream sc.
+func (srv *Server) proxyTarget(sc net.Conn, tgt m_socks.Addr, u *user) {
+	if srv.overQuota(u) {
+		return
+	}
 
-			if err = srv.relay(sc, rc); err != nil {
-				log.Logger.Warn("socks: relay error: %v", err)
-			}
-		}()
+	start := time.Now()
+	rc, err := srv.dialTarget(tgt, u)
+	srv.dialed(tgt.String(), false, start, err)
+	if err != nil {
+		log.Logger.Warn("socks: failed to connect to target: %v", err)
+		return
+	}
+	atomic.AddInt64(&srv.stats.ReqNum, 1)
+
+	log.Logger.Info("socks: proxy %s <-> %s, connect elapsed time:%fs, total req num %d",
+		sc.RemoteAddr(), rc.RemoteAddr(), time.Since(start).Seconds(), atomic.LoadInt64(&srv.stats.ReqNum))
+
+	defer rc.Close()
+
+	e := srv.conns.add(&connEntry{
+		client:   sc.RemoteAddr().String(),
+		user:     userLabel(u),
+		target:   tgt.String(),
+		upstream: rc.RemoteAddr().String(),
+		left:     sc,
+		right:    rc,
+	})
+	defer srv.conns.remove(e)
+	if err = srv.relay(sc, rc, srv.newThrottle(u, e)); err != nil {
+		log.Logger.Warn("socks: relay error: %v", err)
+		srv.metrics.errors.With(errClassRelay).Inc()
 	}
+	srv.metrics.connDuration.With(userLabel(u)).Observe(time.Since(start).Seconds())
 }
@@ -0,0 +1,181 @@
+package m_server
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_limit"
+	"github.com/zyong/miniproxygo/m_metrics"
+)
+
+// throttle limits bandwidth and counts traffic of a relayed connection,
+// upload is from client to target and download is reverse. A nil throttle
+// passes everything.
+//
+// Relays limited by a bucket are read in chunks through m_limit.Reader,
+// others are only metered as bytes pass, keeping WriterTo and ReaderFrom
+// of the underlying conns.
+type throttle struct {
+	up      []m_limit.Limiter
+	down    []m_limit.Limiter
+	limited bool // a bucket of non-zero rate is in limiters
+}
+
+// kbps creates a bucket of rate in KB/s, nil if rate is 0
+func kbps(rate int) *m_limit.Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return m_limit.NewBucket(float64(rate*1024), 0)
+}
+
+// counter counts bytes in stats
+type counter struct {
+	n *int64
+}
+
+func (c counter) Take(n int) error {
+	atomic.AddInt64(c.n, int64(n))
+	return nil
+}
+
+// metricCounter counts bytes in metrics
+type metricCounter struct {
+	c *m_metrics.Counter
+}
+
+func (c metricCounter) Take(n int) error {
+	c.c.Add(int64(n))
+	return nil
+}
+
+// newThrottle collects buckets of server, of user u and of a new
+// connection, and meters of stats, of relay e in connection table and of
+// accounts of port and of u. u is nil on local.
+func (srv *Server) newThrottle(u *user, e *connEntry) *throttle {
+	cfg := &srv.Config.Server
+	t := &throttle{
+		up: []m_limit.Limiter{
+			counter{&srv.stats.BytesIn},
+			metricCounter{srv.metrics.bytes.With("in", userLabel(u))},
+		},
+		down: []m_limit.Limiter{
+			counter{&srv.stats.BytesOut},
+			metricCounter{srv.metrics.bytes.With("out", userLabel(u))},
+		},
+	}
+	if e != nil {
+		t.up = append(t.up, activity{e, &e.up})
+		t.down = append(t.down, activity{e, &e.down})
+	}
+	add := func(list []m_limit.Limiter, b *m_limit.Bucket) []m_limit.Limiter {
+		if b.Limited() {
+			list = append(list, b)
+			t.limited = true
+		}
+		return list
+	}
+
+	t.up = add(t.up, srv.upBucket)
+	t.down = add(t.down, srv.downBucket)
+	if u != nil {
+		t.up = add(t.up, u.upBucket)
+		t.down = add(t.down, u.downBucket)
+	}
+	t.up = add(t.up, kbps(cfg.ConnUploadRate))
+	t.down = add(t.down, kbps(cfg.ConnDownloadRate))
+
+	if srv.portAccount != nil {
+		t.up = append(t.up, srv.portAccount.UpMeter())
+		t.down = append(t.down, srv.portAccount.DownMeter())
+	}
+	if u != nil && u.account != nil {
+		t.up = append(t.up, u.account.UpMeter())
+		t.down = append(t.down, u.account.DownMeter())
+	}
+	return t
+}
+
+// upload returns reader of client limited by upload limiters
+func (t *throttle) upload(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return t.reader(r, t.up)
+}
+
+// download returns reader of target limited by download limiters
+func (t *throttle) download(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return t.reader(r, t.down)
+}
+
+func (t *throttle) reader(r io.Reader, limiters []m_limit.Limiter) io.Reader {
+	if t.limited {
+		return m_limit.NewReader(r, limiters...)
+	}
+	return &meterReader{r: r, meters: limiters}
+}
+
+// meterReader passes bytes read from r to meters, which only count them
+// and never wait. An error of meters, e.g. quota exceeded, stops reading.
+type meterReader struct {
+	r      io.Reader
+	meters []m_limit.Limiter
+}
+
+func (r *meterReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if e := take(r.meters, n); e != nil {
+		return n, e
+	}
+	return n, err
+}
+
+// WriteTo keeps WriterTo fast path of underlying reader by metering w
+// instead.
+func (r *meterReader) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := r.r.(io.WriterTo); ok {
+		return wt.WriteTo(&meterWriter{w: w, meters: r.meters})
+	}
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+// meterWriter passes bytes written to w to meters
+type meterWriter struct {
+	w      io.Writer
+	meters []m_limit.Limiter
+}
+
+func (w *meterWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if e := take(w.meters, n); e != nil {
+		return n, e
+	}
+	return n, err
+}
+
+// ReadFrom keeps ReaderFrom fast path of underlying writer by metering r
+// instead.
+func (w *meterWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(&meterReader{r: r, meters: w.meters})
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+func take(meters []m_limit.Limiter, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	for _, m := range meters {
+		if err := m.Take(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
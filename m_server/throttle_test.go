@@ -0,0 +1,81 @@
+package m_server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_limit"
+)
+
+func TestThrottleDownload(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.ConnDownloadRate = 256
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+
+	// burst of 256KB passes at once, the next 256KB takes a second
+	msg := bytes.Repeat([]byte("x"), 512*1024)
+	start := time.Now()
+	go c.Write(msg)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, len(msg))); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if d := time.Since(start); d < 800*time.Millisecond || d > 3*time.Second {
+		t.Fatalf("download took %v, want about 1s", d)
+	}
+}
+
+func TestThrottleMetered(t *testing.T) {
+	sc, _ := testConfigs(t)
+	srv := NewServer(sc, "", "test")
+	u, err := srv.newUser(userSpec{Name: "alice", Password: "secret"}, nil, nil)
+	if err != nil {
+		t.Fatalf("new user: %v", err)
+	}
+
+	// relays without rates are only metered, counted as bytes pass
+	th := srv.newThrottle(u, nil)
+	r := th.upload(bytes.NewReader(make([]byte, 10)))
+	if _, ok := r.(*m_limit.Reader); ok {
+		t.Fatal("reader should not be limited without rates")
+	}
+	if _, ok := r.(io.WriterTo); !ok {
+		t.Fatal("metered reader should keep WriterTo")
+	}
+	if _, err = r.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if srv.stats.BytesIn != 4 {
+		t.Fatalf("bytes in while reading: %d", srv.stats.BytesIn)
+	}
+	var w bytes.Buffer
+	if _, err = io.Copy(&w, th.download(bytes.NewReader(make([]byte, 20)))); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if srv.stats.BytesOut != 20 || w.Len() != 20 {
+		t.Fatalf("bytes out: %d, copied %d", srv.stats.BytesOut, w.Len())
+	}
+
+	u.downBucket.SetRate(1024, 0)
+	th = srv.newThrottle(u, nil)
+	if _, ok := th.download(bytes.NewReader(nil)).(*m_limit.Reader); !ok {
+		t.Fatal("reader should be limited with rate of user")
+	}
+}
@@ -0,0 +1,127 @@
+package m_server
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_transport"
+)
+
+// PickTransport creates transport between local and server according to config.
+func (srv *Server) PickTransport() (m_transport.Transport, error) {
+	cfg := &srv.Config.Server
+
+	switch strings.ToLower(cfg.Transport) {
+	case "", "tcp":
+		return m_transport.Raw, nil
+	case "tls":
+		return srv.newTLS()
+	case "ws":
+		return srv.newWebSocket(), nil
+	case "wss":
+		tr, err := srv.newTLS()
+		if err != nil {
+			return nil, err
+		}
+		return m_transport.Chain(tr, srv.newWebSocket()), nil
+	case "obfs-http":
+		return m_transport.NewObfsHTTP(srv.obfsOptions()), nil
+	case "obfs-tls":
+		return m_transport.NewObfsTLS(srv.obfsOptions()), nil
+	}
+
+	return nil, m_transport.ErrTransportNotSupported
+}
+
+func (srv *Server) newTLS() (m_transport.Transport, error) {
+	cfg := &srv.Config.Server
+	serverName := cfg.TlsServerName
+	if serverName == "" && cfg.Local {
+		// verify certificate against host of RemoteServer by default
+		serverName, _, _ = net.SplitHostPort(cfg.RemoteServer)
+	}
+	return m_transport.NewTLS(&m_transport.TLSOptions{
+		CertFile:         srv.confPath(cfg.TlsCertFile),
+		KeyFile:          srv.confPath(cfg.TlsKeyFile),
+		HandshakeTimeout: srv.TlsHandshakeTimeout,
+		ServerName:       serverName,
+		ALPN:             splitList(cfg.TlsAlpn),
+		PinSHA256:        cfg.TlsPinSha256,
+		CAFile:           srv.confPath(cfg.TlsCaFile),
+	})
+}
+
+func (srv *Server) newWebSocket() m_transport.Transport {
+	cfg := &srv.Config.Server
+	return m_transport.NewWebSocket(&m_transport.WebSocketOptions{
+		Path:             cfg.WsPath,
+		HandshakeTimeout: srv.TlsHandshakeTimeout,
+		Host:             cfg.WsHost,
+		EarlyData:        cfg.WsEarlyData,
+	})
+}
+
+func (srv *Server) obfsOptions() *m_transport.ObfsOptions {
+	cfg := &srv.Config.Server
+	return &m_transport.ObfsOptions{
+		HandshakeTimeout: srv.TlsHandshakeTimeout,
+		Host:             cfg.ObfsHost,
+		URI:              cfg.ObfsUri,
+	}
+}
+
+// dialTransport dials a new connection to upstream addr, wrapped by transport.
+func (srv *Server) dialTransport(addr string) (net.Conn, error) {
+	c, err := srv.dialTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return srv.Transport.Client(c), nil
+}
+
+// dialPooled dials a connection to upstream addr for pool. Handshake of
+// transport is done before the connection idles in pool, otherwise server
+// would close it when its handshake timeout passes. Obfs can not do so as
+// its handshake carries the first payload, pool drops such connections
+// closed by server when they are taken.
+func (srv *Server) dialPooled(addr string) (net.Conn, error) {
+	c, err := srv.dialTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+	if hc, ok := c.(interface{ Handshake() error }); ok {
+		if srv.TlsHandshakeTimeout > 0 {
+			c.SetDeadline(time.Now().Add(srv.TlsHandshakeTimeout))
+		}
+		err = hc.Handshake()
+		c.SetDeadline(time.Time{})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// confPath returns path of file relative to root of configuration.
+func (srv *Server) confPath(file string) string {
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(srv.ConfRoot, file)
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var l []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			l = append(l, item)
+		}
+	}
+	return l
+}
@@ -0,0 +1,128 @@
+package m_server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_config"
+)
+
+// writeCert writes a self-signed certificate of localhost and its key into
+// dir, and returns paths of them.
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// tlsConfigs returns configs of server and local over tls, local verifies
+// certificate against CA without TlsServerName.
+func tlsConfigs(t *testing.T) (m_config.Conf, m_config.Conf) {
+	certFile, keyFile := writeCert(t, t.TempDir())
+	sc, lc := testConfigs(t)
+	sc.Server.Transport = "tls"
+	sc.Server.TlsCertFile = certFile
+	sc.Server.TlsKeyFile = keyFile
+	lc.Server.Transport = "tls"
+	lc.Server.TlsCaFile = certFile
+	lc.Server.RemoteServer = fmt.Sprintf("localhost:%d", sc.Server.Port)
+	return sc, lc
+}
+
+func TestTLSDefaultServerName(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := tlsConfigs(t)
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	go Start(lc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c, "hello")
+}
+
+func TestTLSPooledIdle(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := tlsConfigs(t)
+	sc.Server.TlsHandshakeTimeout = 1
+	lc.Server.MaxIdle = 1
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+	local := NewServer(lc, "", "test")
+	go local.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	p := local.getPool(lc.Server.RemoteServer)
+	if !waitPool(p, 1) {
+		t.Fatal("pool not filled")
+	}
+	p.lock.Lock()
+	pooled := p.idle[0].conn
+	p.lock.Unlock()
+
+	// pooled connection idles longer than handshake timeout of server
+	time.Sleep(1500 * time.Millisecond)
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	c.Close()
+	if c != pooled {
+		t.Fatal("pooled connection closed by server")
+	}
+
+	c, err = socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c, "hello")
+}
@@ -0,0 +1,171 @@
+package m_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_systemd"
+	"github.com/zyong/miniproxygo/m_upgrade"
+)
+
+// upgradeTimeout is the max time for new process to get ready on upgrade
+const upgradeTimeout = 30 * time.Second
+
+var errUpgradePlugin = errors.New("upgrade: not supported with plugin on server, which holds Port")
+
+// inheritListeners takes listeners passed by old process on upgrade, or
+// by systemd socket activation. A single socket of systemd is taken as
+// socks listener unless it is named otherwise.
+func (srv *Server) inheritListeners() error {
+	ls, err := m_upgrade.Inherit()
+	if err == nil && ls == nil {
+		ls, err = m_systemd.Listeners()
+		if len(ls) == 1 && ls["socks"] == nil && ls["reverse"] == nil && ls["monitor"] == nil {
+			for name, l := range ls {
+				ls = map[string]net.Listener{"socks": l}
+				log.Logger.Info("systemd: listener %s taken as socks", name)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	for name, l := range ls {
+		srv.inherited[name] = l
+	}
+	return nil
+}
+
+// inherit returns listener of name passed on upgrade if it is bound to
+// addr, or nil, with listenerLock held. Listener of another address is
+// closed, e.g. after port is changed in config.
+func (srv *Server) inherit(name, addr string) net.Listener {
+	l, ok := srv.inherited[name]
+	if !ok {
+		return nil
+	}
+	delete(srv.inherited, name)
+	if !sameAddr(l.Addr(), addr) {
+		log.Logger.Info("%s: inherited listener %s is not %s, closed", name, l.Addr(), addr)
+		l.Close()
+		return nil
+	}
+	log.Logger.Info("%s: inherited listener %s", name, l.Addr())
+	return l
+}
+
+// closeInherited closes listeners passed on upgrade or by systemd but not
+// used
+func (srv *Server) closeInherited() {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+	for name, l := range srv.inherited {
+		log.Logger.Info("%s: inherited listener %s not used, closed", name, l.Addr())
+		l.Close()
+		delete(srv.inherited, name)
+	}
+}
+
+// sameAddr reports whether a is the address listened by addr
+func sameAddr(a net.Addr, addr string) bool {
+	got, ok := a.(*net.TCPAddr)
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if !ok || err != nil || got.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP == nil || got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
+
+// Upgrade starts a new process of the running executable with the same
+// arguments and listeners, and shuts down gracefully once the new process
+// is ready. Server keeps serving if the new process fails to get ready.
+func (srv *Server) Upgrade() error {
+	// listeners are not replaced by reload during upgrade
+	srv.reloadLock.Lock()
+	defer srv.reloadLock.Unlock()
+
+	if srv.CheckGracefulShutdown() {
+		return errShuttingDown
+	}
+	if srv.plugin != nil && !srv.Config.Server.Local {
+		return errUpgradePlugin
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	names, files, err := srv.listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// new process loads accounts saved now, traffic drained afterwards by
+	// this process is not counted
+	if srv.quota != nil {
+		if err = srv.quota.Save(); err != nil {
+			log.Logger.Warn("quota: failed to save: %v", err)
+		}
+	}
+
+	p, err := m_upgrade.Start(path, os.Args[1:], names, files, upgradeTimeout)
+	if err != nil {
+		return err
+	}
+	log.Logger.Info("upgrade: new process %d is ready, graceful shutdown in %v", p.Pid, srv.GracefulShutdownTimeout)
+	srv.handOff(p.Pid)
+	return nil
+}
+
+// handOff hands service over to new process pid, and shuts down. Accounts
+// are saved by the new process from now on, and not overwritten by this
+// one.
+func (srv *Server) handOff(pid int) {
+	if srv.quota != nil {
+		srv.quota.Detach()
+	}
+	atomic.StoreInt32(&srv.upgraded, 1)
+	srv.notify(fmt.Sprintf("MAINPID=%d", pid))
+	go srv.Shutdown()
+}
+
+// listenerFiles returns names and dups of fds of listeners
+func (srv *Server) listenerFiles() ([]string, []*os.File, error) {
+	srv.listenerLock.Lock()
+	defer srv.listenerLock.Unlock()
+
+	var names []string
+	var files []*os.File
+	for _, name := range listenerNames {
+		l, ok := srv.listeners[name].(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	return names, files, nil
+}
@@ -0,0 +1,105 @@
+package m_server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInheritListeners(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	go Start(sc, "test", "")
+	time.Sleep(100 * time.Millisecond)
+
+	// listeners passed on upgrade, the unused one is closed
+	socks, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc.Server.Port = socks.Addr().(*net.TCPAddr).Port
+	local := NewServer(lc, "", "test")
+	local.inherited["socks"] = socks
+	local.inherited["monitor"] = unused
+	go local.Run()
+	defer local.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c, "hello")
+	c.Close()
+	if !local.listening("socks", socks) {
+		t.Fatal("inherited listener should be used")
+	}
+	if c, err := net.Dial("tcp", unused.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("unused inherited listener should be closed")
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+		same bool
+	}{
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}, ":1080", true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 1080}, "0.0.0.0:1080", true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, "127.0.0.1:1080", true},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}, ":1081", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, ":1080", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}, "127.0.0.1:1080", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddr(tt.addr, tt.want); got != tt.same {
+			t.Errorf("sameAddr(%v, %q) = %v, want %v", tt.addr, tt.want, got, tt.same)
+		}
+	}
+}
+
+func TestHandOffQuota(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	sc, lc := testConfigs(t)
+	sc.Server.QuotaFile = filepath.Join(t.TempDir(), "quota.json")
+	srv := NewServer(sc, "", "test")
+	go srv.Run()
+	go Start(lc, "test", "")
+	time.Sleep(200 * time.Millisecond)
+
+	// a connection drained by old process after hand-off
+	c, err := socksDial(fmt.Sprintf("127.0.0.1:%d", lc.Server.Port), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks dial: %v", err)
+	}
+	checkEcho(t, c, "hello")
+
+	// accounts saved by new process
+	srv.GracefulShutdownTimeout = 200 * time.Millisecond
+	want := []byte(`{"start":"2024-01-01T00:00:00Z","accounts":{}}`)
+	if err = ioutil.WriteFile(sc.Server.QuotaFile, want, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	srv.handOff(0)
+	checkEcho(t, c, "world")
+	c.Close()
+	srv.Shutdown()
+
+	got, err := ioutil.ReadFile(sc.Server.QuotaFile)
+	if err != nil || string(got) != string(want) {
+		t.Fatalf("accounts of new process overwritten: %s, %v", got, err)
+	}
+}
@@ -0,0 +1,463 @@
+package m_server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+import (
+	"github.com/baidu/go-lib/log"
+	"github.com/zyong/miniproxygo/m_acl"
+	"github.com/zyong/miniproxygo/m_config"
+	"github.com/zyong/miniproxygo/m_core"
+	"github.com/zyong/miniproxygo/m_dialer"
+	"github.com/zyong/miniproxygo/m_limit"
+	"github.com/zyong/miniproxygo/m_quota"
+	"github.com/zyong/miniproxygo/m_util"
+)
+
+var (
+	errNoUser     = errors.New("no enabled user")
+	errUserExists = errors.New("user exists")
+
+	// connections of users are told apart by opening them with AEAD
+	errUsersCipher = errors.New("more than one user requires an AEAD cipher")
+)
+
+// userSpec is the settings of a user, from [User] sections of config or
+// from UserStateFile written by admin API.
+type userSpec struct {
+	Name         string   `json:"name"`
+	Password     string   `json:"password"`
+	Acl          []string `json:"acl,omitempty"`
+	Disabled     bool     `json:"disabled,omitempty"`
+	UploadRate   int      `json:"upload_rate,omitempty"`   // KB/s, UserUploadRate of server if 0
+	DownloadRate int      `json:"download_rate,omitempty"` // KB/s, UserDownloadRate of server if 0
+	Quota        int      `json:"quota,omitempty"`         // MB, UserQuota of server if 0
+
+	// egress to targets, those of server if empty
+	BindIp        string `json:"bind_ip,omitempty"`
+	BindInterface string `json:"bind_interface,omitempty"`
+	SoMark        int    `json:"so_mark,omitempty"`
+}
+
+// userState is the content of UserStateFile
+type userState struct {
+	Users []userSpec `json:"users"`
+}
+
+// user is a user of server, identified by the cipher of its stream. A user
+// is not changed once created, admin API replaces it with a new one which
+// shares buckets, account and connections with the old one.
+type user struct {
+	name   string
+	spec   userSpec
+	cipher m_core.Cipher
+	acl    *m_acl.ACL      // ACL of server overridden by rules of user
+	dialer m_dialer.Dialer // dialer of targets, that of server if nil
+
+	upBucket   *m_limit.Bucket // shared by connections of user
+	downBucket *m_limit.Bucket
+
+	account *m_quota.Account // traffic of user, nil if not accounted
+	conns   *connSet         // client connections of user
+}
+
+// connSet is a set of client connections
+type connSet struct {
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[net.Conn]struct{})}
+}
+
+// add adds c to set, it returns false if set is closed
+func (s *connSet) add(c net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *connSet) remove(c net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *connSet) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+// closeAll closes all connections in set and those added later
+func (s *connSet) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// loadUsers creates users of server from UserStateFile if it exists, or
+// else from config. Without [User] sections, the only user is Username
+// with Password of server. It must be called after loadQuota.
+func (srv *Server) loadUsers() error {
+	srv.userAdminLock.Lock()
+	defer srv.userAdminLock.Unlock()
+	return srv.applyUsers()
+}
+
+// reloadUsers applies users and ACL of targets in cfg, running settings
+// are kept if they are invalid.
+func (srv *Server) reloadUsers(cfg *m_config.Conf) error {
+	srv.userAdminLock.Lock()
+	defer srv.userAdminLock.Unlock()
+
+	// settings read by applyUsers, with userAdminLock held
+	cur := &srv.Config.Server
+	old := *cur
+	oldUsers := srv.Config.User
+	set := func(c *m_config.ConfigServer, users map[string]*m_config.ConfigUser) {
+		srv.listenerLock.Lock()
+		defer srv.listenerLock.Unlock()
+		cur.Acl, cur.AclDenyPrivate = c.Acl, c.AclDenyPrivate
+		cur.UserUploadRate, cur.UserDownloadRate = c.UserUploadRate, c.UserDownloadRate
+		cur.UserQuota = c.UserQuota
+		srv.Config.User = users
+	}
+
+	set(&cfg.Server, cfg.User)
+	if err := srv.applyUsers(); err != nil {
+		set(&old, oldUsers)
+		return err
+	}
+	return nil
+}
+
+// applyUsers replaces users with those in UserStateFile or config, with
+// userAdminLock held. Users of same names keep their buckets, accounts and
+// connections, while connections of users removed, disabled or rekeyed are
+// closed.
+func (srv *Server) applyUsers() error {
+	cfg := &srv.Config.Server
+
+	global, err := m_acl.New(cfg.Acl, cfg.AclDenyPrivate)
+	if err != nil {
+		return err
+	}
+	specs, err := srv.loadUserState()
+	if err != nil {
+		return err
+	}
+	if specs == nil {
+		specs = srv.configUsers()
+	} else if n := len(srv.Config.User); n > 0 {
+		log.Logger.Warn("users: %s takes precedence, %d users in config are ignored", cfg.UserStateFile, n)
+	}
+
+	old := srv.userList()
+	kept := make(map[*user]bool)
+	var cut []*user
+	users := make([]*user, 0, len(specs))
+	for _, spec := range specs {
+		var prev *user
+		if i, found := findUser(old, spec.Name); found {
+			prev = old[i]
+			kept[prev] = true
+		}
+		u, err := srv.newUser(spec, prev, global)
+		if err != nil {
+			return err
+		}
+		if prev != nil && (spec.Disabled || spec.Password != prev.spec.Password) {
+			u.conns = newConnSet()
+			cut = append(cut, prev)
+		}
+		users = append(users, u)
+	}
+	if len(users) > 1 && !m_core.IsAEAD(users[0].cipher) {
+		return fmt.Errorf("users: cipher %s: %w", cfg.Cipher, errUsersCipher)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	for _, u := range old {
+		if !kept[u] {
+			cut = append(cut, u)
+		}
+	}
+
+	srv.acl = global
+	srv.setUsers(users)
+	for _, u := range users {
+		srv.setLimits(u)
+	}
+	for _, u := range cut {
+		u.conns.closeAll()
+	}
+	return nil
+}
+
+// configUsers returns users in config
+func (srv *Server) configUsers() []userSpec {
+	cfg := &srv.Config.Server
+	if len(srv.Config.User) == 0 {
+		return []userSpec{{Name: cfg.Username, Password: srv.password()}}
+	}
+
+	specs := make([]userSpec, 0, len(srv.Config.User))
+	for name, u := range srv.Config.User {
+		specs = append(specs, userSpec{
+			Name:         name,
+			Password:     u.Password,
+			Acl:          u.Acl,
+			UploadRate:   u.UploadRate,
+			DownloadRate: u.DownloadRate,
+			Quota:        u.Quota,
+
+			BindIp:        u.BindIp,
+			BindInterface: u.BindInterface,
+			SoMark:        u.SoMark,
+		})
+	}
+	return specs
+}
+
+// loadUserState reads users in UserStateFile, nil if it does not exist
+func (srv *Server) loadUserState() ([]userSpec, error) {
+	path := srv.Config.Server.UserStateFile
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(srv.confPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state userState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("users: %s: %v", path, err)
+	}
+	if state.Users == nil {
+		state.Users = []userSpec{}
+	}
+	return state.Users, nil
+}
+
+// saveUserState writes users to UserStateFile, if it is set
+func (srv *Server) saveUserState(users []*user) error {
+	path := srv.Config.Server.UserStateFile
+	if path == "" {
+		return nil
+	}
+	state := userState{Users: make([]userSpec, len(users))}
+	for i, u := range users {
+		state.Users[i] = u.spec
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// passwords are in file
+	return m_util.WriteFileAtomic(srv.confPath(path), data, 0600)
+}
+
+// newUser creates user of spec with ACL of server global, sharing buckets,
+// account and connections of prev if it is not nil. Limits of spec are set
+// by setLimits.
+func (srv *Server) newUser(spec userSpec, prev *user, global *m_acl.ACL) (*user, error) {
+	ciph, err := m_core.PickCipher(srv.Config.Server.Cipher, nil, spec.Password)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %v", spec.Name, err)
+	}
+	rules, err := m_acl.Parse(spec.Acl)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %v", spec.Name, err)
+	}
+	dialer, err := srv.userDialer(&spec)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %v", spec.Name, err)
+	}
+	u := &user{name: spec.Name, spec: spec, cipher: ciph, acl: global.With(rules), dialer: dialer}
+
+	if prev != nil {
+		u.upBucket, u.downBucket = prev.upBucket, prev.downBucket
+		u.account, u.conns = prev.account, prev.conns
+		return u, nil
+	}
+	// buckets of rate 0 are kept and shared with users replacing this one,
+	// rates set later apply to connections started after
+	u.upBucket = m_limit.NewBucket(0, 0)
+	u.downBucket = m_limit.NewBucket(0, 0)
+	u.conns = newConnSet()
+	if srv.quota != nil {
+		u.account = srv.quota.Account("user:" + spec.Name)
+	}
+	return u, nil
+}
+
+// setLimits sets rates and quota of spec of u, falling back to those of
+// server.
+func (srv *Server) setLimits(u *user) {
+	cfg := &srv.Config.Server
+	up, down, quota := u.spec.UploadRate, u.spec.DownloadRate, u.spec.Quota
+	if up == 0 {
+		up = cfg.UserUploadRate
+	}
+	if down == 0 {
+		down = cfg.UserDownloadRate
+	}
+	if quota == 0 {
+		quota = cfg.UserQuota
+	}
+
+	u.upBucket.SetRate(float64(up*1024), 0)
+	u.downBucket.SetRate(float64(down*1024), 0)
+	if u.account != nil {
+		u.account.SetLimit(mb(quota), cfg.QuotaCut)
+	}
+}
+
+// userList returns current users sorted by name
+func (srv *Server) userList() []*user {
+	srv.usersLock.RLock()
+	defer srv.usersLock.RUnlock()
+	return srv.users
+}
+
+func (srv *Server) setUsers(users []*user) {
+	srv.usersLock.Lock()
+	defer srv.usersLock.Unlock()
+	srv.users = users
+}
+
+// findUser returns index of user name in users, or where to insert it
+func findUser(users []*user, name string) (int, bool) {
+	i := sort.Search(len(users), func(i int) bool { return users[i].name >= name })
+	return i, i < len(users) && users[i].name == name
+}
+
+// putUser creates user of spec, or replaces the user of same name if
+// replace is set, and persists users. Connections of the old user are
+// closed if it is disabled or its password changes.
+func (srv *Server) putUser(spec userSpec, replace bool) (*user, error) {
+	srv.userAdminLock.Lock()
+	defer srv.userAdminLock.Unlock()
+
+	users := srv.userList()
+	i, found := findUser(users, spec.Name)
+	if found && !replace {
+		return nil, errUserExists
+	}
+	var prev *user
+	if found {
+		prev = users[i]
+	}
+	u, err := srv.newUser(spec, prev, srv.acl)
+	if err != nil {
+		return nil, err
+	}
+	cut := prev != nil && (spec.Disabled || spec.Password != prev.spec.Password)
+	if cut {
+		u.conns = newConnSet()
+	}
+
+	next := make([]*user, 0, len(users)+1)
+	next = append(next, users[:i]...)
+	next = append(next, u)
+	if found {
+		i++
+	}
+	next = append(next, users[i:]...)
+	if len(next) > 1 && !m_core.IsAEAD(u.cipher) {
+		return nil, errUsersCipher
+	}
+	if err = srv.saveUserState(next); err != nil {
+		return nil, err
+	}
+	srv.setUsers(next)
+	srv.setLimits(u)
+
+	if cut {
+		prev.conns.closeAll()
+	}
+	return u, nil
+}
+
+// deleteUser removes user name and closes its connections, it reports
+// whether the user exists.
+func (srv *Server) deleteUser(name string) (bool, error) {
+	srv.userAdminLock.Lock()
+	defer srv.userAdminLock.Unlock()
+
+	users := srv.userList()
+	i, found := findUser(users, name)
+	if !found {
+		return false, nil
+	}
+	next := make([]*user, 0, len(users)-1)
+	next = append(next, users[:i]...)
+	next = append(next, users[i+1:]...)
+	if err := srv.saveUserState(next); err != nil {
+		return true, err
+	}
+	srv.setUsers(next)
+
+	users[i].conns.closeAll()
+	return true, nil
+}
+
+// newPassword generates a random password
+func newPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// identify finds out the enabled user of connection c, and returns c with
+// bytes read in identification restored.
+func (srv *Server) identify(c net.Conn) (*user, net.Conn, error) {
+	users := srv.userList()
+	enabled := make([]*user, 0, len(users))
+	for _, u := range users {
+		if !u.spec.Disabled {
+			enabled = append(enabled, u)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil, c, errNoUser
+	}
+	// with other users disabled, a connection must be told from theirs
+	if len(users) == 1 {
+		return enabled[0], c, nil
+	}
+
+	ciphers := make([]m_core.Cipher, len(enabled))
+	for i, u := range enabled {
+		ciphers[i] = u.cipher
+	}
+	i, c, err := m_core.Identify(c, ciphers)
+	if err != nil {
+		return nil, c, err
+	}
+	return enabled[i], c, nil
+}
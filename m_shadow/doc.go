@@ -19,6 +19,9 @@ The higher 2 bits are reserved and must be set to zero. The first AEAD encrypt/d
 operation uses a counting nonce starting from 0. After each encrypt/decrypt operation,
 the nonce is incremented by one as if it were an unsigned little-endian integer.
 
+Optionally the first records of a stream carry padding, see PaddingOptions. A peer pads
+its reply in the same way if the stream it received is padded.
+
 
 Each encrypted packet transmitted on a packet-oriented connection has the following structure:
 
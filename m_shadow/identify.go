@@ -0,0 +1,54 @@
+package m_shadow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrUnknownCipher means none of ciphers opens a stream
+var ErrUnknownCipher = errors.New("no cipher matches stream")
+
+// Identify finds out which one of ciphers enciphers the stream read from c,
+// by opening its first length chunk with each of them. Bytes consumed are
+// read again from the returned conn. Ciphers must have the same salt size
+// and AEAD overhead.
+func Identify(c net.Conn, ciphers []Cipher) (int, net.Conn, error) {
+	if len(ciphers) == 0 {
+		return -1, c, ErrUnknownCipher
+	}
+
+	salt := make([]byte, ciphers[0].SaltSize())
+	if _, err := io.ReadFull(c, salt); err != nil {
+		return -1, c, err
+	}
+
+	var chunk, nonce []byte
+	for i, ciph := range ciphers {
+		aead, err := ciph.Decrypter(salt)
+		if err != nil {
+			continue
+		}
+		if chunk == nil {
+			chunk = make([]byte, 2+aead.Overhead())
+			if _, err = io.ReadFull(c, chunk); err != nil {
+				return -1, c, err
+			}
+			nonce = make([]byte, aead.NonceSize())
+		}
+		if _, err = aead.Open(nil, nonce, chunk, nil); err == nil {
+			consumed := append(salt, chunk...)
+			return i, &replayConn{Conn: c, r: io.MultiReader(bytes.NewReader(consumed), c)}, nil
+		}
+	}
+	return -1, c, ErrUnknownCipher
+}
+
+// replayConn reads bytes consumed from Conn again
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,36 @@
+package m_shadow
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+	var ciphers []Cipher
+	for i := byte(1); i <= 3; i++ {
+		ciph, _ := AESGCM(bytes.Repeat([]byte{i}, 16))
+		ciphers = append(ciphers, ciph)
+	}
+
+	c, s := net.Pipe()
+	go NewConn(c, ciphers[2]).Write([]byte("hello"))
+
+	i, rc, err := Identify(s, ciphers)
+	if err != nil || i != 2 {
+		t.Fatalf("identify: got %d %v, want 2", i, err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(NewConn(rc, ciphers[2]), b); err != nil || string(b) != "hello" {
+		t.Fatalf("read identified stream: %q %v", b, err)
+	}
+
+	other, _ := AESGCM(bytes.Repeat([]byte{9}, 16))
+	go NewConn(c, other).Write([]byte("hello"))
+	if _, _, err = Identify(s, ciphers); err != ErrUnknownCipher {
+		t.Fatalf("identify unknown: got %v, want %v", err, ErrUnknownCipher)
+	}
+	c.Close()
+	s.Close()
+}
@@ -0,0 +1,189 @@
+package m_shadow
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// padMarker starts plaintext of the first padded record of a stream. It is
+// never a valid address type, so a padded stream is told from a plain one.
+const padMarker = 0xF3
+
+const (
+	defaultPadMinSize = 64
+	defaultPadMaxSize = 1200
+)
+
+// size distributions of padded records
+const (
+	PaddingUniform = "uniform" // spread evenly in [MinSize, MaxSize]
+	PaddingBimodal = "bimodal" // near MinSize or near MaxSize, like small requests and full segments of web traffic
+)
+
+// ErrBadPadding means a padded record is malformed
+var ErrBadPadding = errors.New("bad padding")
+
+// PaddingOptions is the settings of padding the first records of stream.
+//
+// Plaintext of a padded record is
+//
+//	[data length][data][padding]
+//
+// with 2-byte big-endian data length, and the first one is prefixed with
+// padMarker and number of padded records. Size of padded records is picked
+// randomly in [MinSize, MaxSize] by Distribution, data longer than that is
+// split. Sizes are up to the sender, so peers need not agree on them.
+type PaddingOptions struct {
+	Records      int    // number of padded records in each direction, at most 255
+	MinSize      int    // min plaintext size of padded record
+	MaxSize      int    // max plaintext size of padded record
+	Distribution string // PaddingUniform or PaddingBimodal, PaddingUniform if empty
+}
+
+// CheckPaddingDistribution returns error if dist is not a known
+// distribution of padded record sizes.
+func CheckPaddingDistribution(dist string) error {
+	switch dist {
+	case "", PaddingUniform, PaddingBimodal:
+		return nil
+	}
+	return fmt.Errorf("unknown padding distribution %q", dist)
+}
+
+// WithPadding makes stream c created by NewConn pad its first records.
+// Peer must support padding: it detects padded stream and pads its reply
+// in the same way.
+func WithPadding(c net.Conn, opts *PaddingOptions) net.Conn {
+	if sc, ok := c.(*streamConn); ok && opts != nil && opts.Records > 0 {
+		o := *opts
+		if o.Records > 0xFF {
+			o.Records = 0xFF
+		}
+		sc.padding = &o
+	}
+	return c
+}
+
+type padder struct {
+	left    int // padded records left
+	records int // number of padded records announced in the first one
+	minSize int
+	maxSize int
+	dist    string
+	first   bool // the first record carries padMarker
+}
+
+func newPadder(opts *PaddingOptions, first bool) *padder {
+	p := &padder{
+		left:    opts.Records,
+		records: opts.Records,
+		minSize: opts.MinSize,
+		maxSize: opts.MaxSize,
+		dist:    opts.Distribution,
+		first:   first,
+	}
+	if p.minSize <= 0 {
+		p.minSize = defaultPadMinSize
+	}
+	if p.maxSize < p.minSize {
+		p.maxSize = defaultPadMaxSize
+		if p.maxSize < p.minSize {
+			p.maxSize = p.minSize
+		}
+	}
+	if p.maxSize > payloadSizeMask {
+		p.maxSize = payloadSizeMask
+	}
+	return p
+}
+
+// read reads data from r into a padded record in buf. Return length of
+// data, size of record and any error encountered.
+func (p *padder) read(r io.Reader, buf []byte) (int, int, error) {
+	hdr := 2
+	if p.first {
+		hdr += 2
+	}
+
+	size := p.size()
+	if size <= hdr {
+		size = hdr + 1
+	}
+
+	nr, err := r.Read(buf[hdr:size])
+	if nr <= 0 {
+		return 0, 0, err
+	}
+
+	if p.first {
+		buf[0], buf[1] = padMarker, byte(p.records)
+		p.first = false
+	}
+	buf[hdr-2], buf[hdr-1] = byte(nr>>8), byte(nr)
+	pad := buf[hdr+nr : size]
+	for i := range pad {
+		pad[i] = 0 // padding is enciphered, zeros are as good as random
+	}
+	p.left--
+	return nr, size, err
+}
+
+// size picks plaintext size of next padded record by distribution
+func (p *padder) size() int {
+	d := p.maxSize - p.minSize
+	if d <= 0 {
+		return p.minSize
+	}
+	var b [4]byte
+	io.ReadFull(rand.Reader, b[:])
+	r := binary.BigEndian.Uint32(b[:])
+
+	if p.dist != PaddingBimodal {
+		return p.minSize + int(r%uint32(d+1))
+	}
+	// the lowest or the highest eighth of range, picked by the lowest bit
+	band := d / 8
+	off := int((r >> 1) % uint32(band+1))
+	if r&1 == 0 {
+		return p.minSize + off
+	}
+	return p.maxSize - off
+}
+
+type unpadder struct {
+	left    int  // padded records left
+	records int  // number of padded records announced by peer
+	detect  bool // the first record may be padded
+}
+
+// strip returns data in record payload p.
+func (u *unpadder) strip(p []byte) ([]byte, error) {
+	if u.detect {
+		u.detect = false
+		if len(p) == 0 || p[0] != padMarker {
+			return p, nil
+		}
+		if len(p) < 2 {
+			return nil, ErrBadPadding
+		}
+		u.left, u.records = int(p[1]), int(p[1])
+		p = p[2:]
+	}
+	if u.left == 0 {
+		return p, nil
+	}
+	u.left--
+
+	if len(p) < 2 {
+		return nil, ErrBadPadding
+	}
+	n := int(p[0])<<8 | int(p[1])
+	if n > len(p)-2 {
+		return nil, ErrBadPadding
+	}
+	return p[2 : 2+n], nil
+}
@@ -0,0 +1,152 @@
+package m_shadow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func init() {
+	// both ends share salt filter in one process, disable it
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+}
+
+// recordSizes reads enciphered stream from r and returns payload sizes of
+// its records.
+func recordSizes(t *testing.T, ciph Cipher, r io.Reader) []int {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(r, salt); err != nil {
+		t.Fatalf("read salt: %v", err)
+	}
+	aead, err := ciph.Decrypter(salt)
+	if err != nil {
+		t.Fatalf("decrypter: %v", err)
+	}
+	rd := newReader(r, aead)
+
+	var sizes []int
+	for {
+		n, err := rd.readRecord()
+		if err != nil {
+			return sizes
+		}
+		sizes = append(sizes, n)
+	}
+}
+
+func testCipher(t *testing.T) Cipher {
+	ciph, err := AESGCM(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatalf("cipher: %v", err)
+	}
+	return ciph
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	ciph := testCipher(t)
+	opts := &PaddingOptions{Records: 3, MinSize: 100, MaxSize: 200}
+
+	for _, padded := range []bool{false, true} {
+		c, s := net.Pipe()
+		client := NewConn(c, ciph)
+		if padded {
+			client = WithPadding(client, opts)
+		}
+		server := NewConn(s, ciph)
+
+		req := append([]byte{0x01, 127, 0, 0, 1, 0, 80}, bytes.Repeat([]byte("q"), 500)...)
+		go client.Write(req)
+		got := make([]byte, len(req))
+		if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, req) {
+			t.Fatalf("padded %v: request mismatch: %v", padded, err)
+		}
+
+		resp := bytes.Repeat([]byte("r"), 20000)
+		go server.Write(resp)
+		got = make([]byte, len(resp))
+		if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, resp) {
+			t.Fatalf("padded %v: response mismatch: %v", padded, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestPaddingRecordSizes(t *testing.T) {
+	ciph := testCipher(t)
+	opts := &PaddingOptions{Records: 4, MinSize: 100, MaxSize: 200}
+
+	c, s := net.Pipe()
+	client := WithPadding(NewConn(c, ciph), opts)
+	go func() {
+		client.Write([]byte{0x01, 127, 0, 0, 1, 0, 80})
+		client.Write(bytes.Repeat([]byte("x"), 1000))
+		c.Close()
+	}()
+	sizes := recordSizes(t, ciph, s)
+
+	// address and the first data are shaped, the rest is plain
+	if len(sizes) < 5 {
+		t.Fatalf("too few records: %v", sizes)
+	}
+	for i, n := range sizes[:4] {
+		if n < 100 || n > 200 {
+			t.Fatalf("record %d of size %d not in range: %v", i, n, sizes)
+		}
+	}
+	total := 0
+	for _, n := range sizes[4:] {
+		total += n
+	}
+	if total == 0 {
+		t.Fatalf("no plain records after padded ones: %v", sizes)
+	}
+}
+
+func TestPaddingMarker(t *testing.T) {
+	ciph := testCipher(t)
+	c, s := net.Pipe()
+	client := WithPadding(NewConn(c, ciph), &PaddingOptions{Records: 1, MinSize: 64, MaxSize: 64})
+	go func() {
+		client.Write([]byte("abc"))
+		c.Close()
+	}()
+
+	salt := make([]byte, ciph.SaltSize())
+	io.ReadFull(s, salt)
+	aead, _ := ciph.Decrypter(salt)
+	rd := newReader(s, aead)
+	n, err := rd.readRecord()
+	if err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	p := rd.buf[:n]
+	if n != 64 || p[0] != padMarker || p[1] != 1 || binary.BigEndian.Uint16(p[2:]) != 3 || string(p[4:7]) != "abc" {
+		t.Fatalf("unexpected padded record: %x", p)
+	}
+}
+
+func TestPaddingBimodal(t *testing.T) {
+	p := newPadder(&PaddingOptions{Records: 1, MinSize: 100, MaxSize: 900, Distribution: PaddingBimodal}, false)
+	low, high := 0, 0
+	for i := 0; i < 1000; i++ {
+		switch n := p.size(); {
+		case n >= 100 && n <= 200:
+			low++
+		case n >= 800 && n <= 900:
+			high++
+		default:
+			t.Fatalf("size %d not near bounds", n)
+		}
+	}
+	if low < 300 || high < 300 {
+		t.Fatalf("sizes not split between modes: %d low, %d high", low, high)
+	}
+
+	if err := CheckPaddingDistribution("normal"); err == nil {
+		t.Fatal("unknown distribution should be refused")
+	}
+}
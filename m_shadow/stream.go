@@ -20,6 +20,7 @@ type writer struct {
 	cipher.AEAD
 	nonce []byte
 	buf   []byte
+	pad   *padder // pads the first records, nil if done or disabled
 }
 
 // NewWriter wraps an io.Writer with AEAD encryption.
@@ -47,13 +48,24 @@ func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
 	for {
 		buf := w.buf
 		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
-		nr, er := r.Read(payloadBuf)
+
+		var nr, size int
+		var er error
+		if w.pad != nil {
+			nr, size, er = w.pad.read(r, payloadBuf)
+			if w.pad.left == 0 {
+				w.pad = nil
+			}
+		} else {
+			nr, er = r.Read(payloadBuf)
+			size = nr
+		}
 
 		if nr > 0 {
 			n += int64(nr)
-			buf = buf[:2+w.Overhead()+nr+w.Overhead()]
-			payloadBuf = payloadBuf[:nr]
-			buf[0], buf[1] = byte(nr>>8), byte(nr) // big-endian payload size
+			buf = buf[:2+w.Overhead()+size+w.Overhead()]
+			payloadBuf = payloadBuf[:size]
+			buf[0], buf[1] = byte(size>>8), byte(size) // big-endian payload size
 			w.Seal(buf[:0], w.nonce, buf[:2], nil)
 			increment(w.nonce)
 
@@ -84,6 +96,7 @@ type reader struct {
 	nonce    []byte
 	buf      []byte
 	leftover []byte
+	unpad    *unpadder // strips padding of the first records, nil if disabled
 }
 
 // NewReader wraps an io.Reader with AEAD decryption.
@@ -98,8 +111,17 @@ func newReader(r io.Reader, aead cipher.AEAD) *reader {
 	}
 }
 
-// read and decrypt a record into the internal buffer. Return decrypted payload length and any error encountered.
-func (r *reader) read() (int, error) {
+// read and decrypt a record into the internal buffer. Return decrypted payload without padding and any error encountered.
+func (r *reader) read() ([]byte, error) {
+	n, err := r.readRecord()
+	if err != nil || r.unpad == nil {
+		return r.buf[:n], err
+	}
+	return r.unpad.strip(r.buf[:n])
+}
+
+// readRecord reads and decrypts a record into the internal buffer. Return decrypted payload length and any error encountered.
+func (r *reader) readRecord() (int, error) {
 	// decrypt payload size
 	buf := r.buf[:2+r.Overhead()]
 	_, err := io.ReadFull(r.Reader, buf)
@@ -140,10 +162,10 @@ func (r *reader) Read(b []byte) (int, error) {
 		return n, nil
 	}
 
-	n, err := r.read()
-	m := copy(b, r.buf[:n])
-	if m < n { // insufficient len(b), keep leftover for next read
-		r.leftover = r.buf[m:n]
+	p, err := r.read()
+	m := copy(b, p)
+	if m < len(p) { // insufficient len(b), keep leftover for next read
+		r.leftover = p[m:]
 	}
 	return m, err
 }
@@ -163,9 +185,9 @@ func (r *reader) WriteTo(w io.Writer) (n int64, err error) {
 	}
 
 	for {
-		nr, er := r.read()
-		if nr > 0 {
-			nw, ew := w.Write(r.buf[:nr])
+		p, er := r.read()
+		if len(p) > 0 {
+			nw, ew := w.Write(p)
 			n += int64(nw)
 
 			if ew != nil {
@@ -198,8 +220,9 @@ func increment(b []byte) {
 type streamConn struct {
 	net.Conn
 	Cipher
-	r *reader
-	w *writer
+	r       *reader
+	w       *writer
+	padding *PaddingOptions // set on the side starting padded stream
 }
 
 func (c *streamConn) initReader() error {
@@ -217,6 +240,14 @@ func (c *streamConn) initReader() error {
 	}
 
 	c.r = newReader(c.Conn, aead)
+	switch {
+	case c.padding != nil:
+		// peer pads reply in the same way
+		c.r.unpad = &unpadder{left: c.padding.Records}
+	case c.w == nil:
+		// stream is started by peer, which may pad it
+		c.r.unpad = &unpadder{detect: true}
+	}
 	return nil
 }
 
@@ -253,6 +284,13 @@ func (c *streamConn) initWriter() error {
 	}
 	m_internal.AddSalt(salt)
 	c.w = newWriter(c.Conn, aead)
+	switch {
+	case c.padding != nil:
+		c.w.pad = newPadder(c.padding, true)
+	case c.r != nil && c.r.unpad != nil && c.r.unpad.records > 0:
+		// reply to padded stream is padded in the same way
+		c.w.pad = newPadder(&PaddingOptions{Records: c.r.unpad.records}, false)
+	}
 	return nil
 }
 
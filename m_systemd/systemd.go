@@ -0,0 +1,114 @@
+// Package m_systemd supports socket activation and service notification of
+// systemd natively, without libsystemd.
+//
+// See sd_listen_fds(3) and sd_notify(3).
+package m_systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_util"
+)
+
+const (
+	firstFd = 3 // SD_LISTEN_FDS_START
+
+	envListenPid   = "LISTEN_PID"
+	envListenFds   = "LISTEN_FDS"
+	envListenNames = "LISTEN_FDNAMES"
+	envNotify      = "NOTIFY_SOCKET"
+	envWatchdogUs  = "WATCHDOG_USEC"
+	envWatchdogPid = "WATCHDOG_PID"
+)
+
+// Listeners returns listeners passed by systemd socket activation by names
+// of FileDescriptorName=, or nil if process is not socket activated. The
+// variables of socket activation are unset, so that they are not passed
+// to child processes.
+func Listeners() (map[string]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv(envListenPid))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFds))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv(envListenNames), ":")
+	os.Unsetenv(envListenPid)
+	os.Unsetenv(envListenFds)
+	os.Unsetenv(envListenNames)
+
+	for fd := firstFd; fd < firstFd+n; fd++ {
+		m_util.CloseOnExec(fd)
+	}
+
+	ls := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFd+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil && ls[name] != nil {
+			l.Close()
+			err = fmt.Errorf("duplicate name")
+		}
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd: listener %s of fd %d: %v", name, firstFd+i, err)
+		}
+		ls[name] = l
+	}
+	return ls, nil
+}
+
+// Notify sends state like "READY=1" or "STATUS=..." to systemd, lines of
+// state are separated by "\n". It does nothing if NOTIFY_SOCKET is unset.
+func Notify(state string) error {
+	path := os.Getenv(envNotify)
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		// abstract namespace
+		path = "\x00" + path[1:]
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the time within which systemd expects
+// "WATCHDOG=1", or 0 if watchdog is disabled. WATCHDOG_PID is unset, so
+// that a new process of upgrade, which becomes main process, takes over
+// watchdog.
+func WatchdogInterval() time.Duration {
+	us, err := strconv.ParseInt(os.Getenv(envWatchdogUs), 10, 64)
+	if err != nil || us <= 0 {
+		return 0
+	}
+	if s := os.Getenv(envWatchdogPid); s != "" {
+		if pid, err := strconv.Atoi(s); err != nil || pid != os.Getpid() {
+			return 0
+		}
+		os.Unsetenv(envWatchdogPid)
+	}
+	return time.Duration(us) * time.Microsecond
+}
@@ -0,0 +1,137 @@
+package m_systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stubEnv makes test binary run as a socket activated service, which
+// greets clients of listener "socks" like one started by systemd.
+const stubEnv = "M_SYSTEMD_STUB"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(stubEnv) == "1" {
+		runStub()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runStub() {
+	// systemd sets LISTEN_PID after fork
+	os.Setenv(envListenPid, strconv.Itoa(os.Getpid()))
+	ls, err := Listeners()
+	if err != nil || ls["socks"] == nil || os.Getenv(envListenFds) != "" {
+		os.Exit(2)
+	}
+	c, err := ls["socks"].Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	c.Write([]byte("activated"))
+	c.Close()
+}
+
+// fakeNotify listens on a fake notify socket set to NOTIFY_SOCKET
+func fakeNotify(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	os.Setenv(envNotify, path)
+	return c
+}
+
+func readNotify(t *testing.T, c *net.UnixConn) string {
+	b := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("read notify: %v", err)
+	}
+	return string(b[:n])
+}
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv(envNotify)
+	if err := Notify("READY=1"); err != nil {
+		t.Fatalf("notify without socket: %v", err)
+	}
+
+	c := fakeNotify(t)
+	defer c.Close()
+	defer os.Unsetenv(envNotify)
+	for _, state := range []string{"READY=1\nSTATUS=serving", "WATCHDOG=1", "STOPPING=1"} {
+		if err := Notify(state); err != nil {
+			t.Fatalf("notify: %v", err)
+		}
+		if got := readNotify(t, c); got != state {
+			t.Fatalf("notify: got %q, want %q", got, state)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv(envWatchdogUs)
+	defer os.Unsetenv(envWatchdogPid)
+
+	os.Unsetenv(envWatchdogUs)
+	if d := WatchdogInterval(); d != 0 {
+		t.Fatalf("disabled watchdog: got %v", d)
+	}
+	os.Setenv(envWatchdogUs, "2000000")
+	os.Setenv(envWatchdogPid, "1")
+	if d := WatchdogInterval(); d != 0 {
+		t.Fatalf("watchdog of another process: got %v", d)
+	}
+	os.Setenv(envWatchdogPid, strconv.Itoa(os.Getpid()))
+	if d := WatchdogInterval(); d != 2*time.Second {
+		t.Fatalf("watchdog: got %v", d)
+	}
+	if _, ok := os.LookupEnv(envWatchdogPid); ok {
+		t.Fatal("WATCHDOG_PID should be unset")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	if ls, err := Listeners(); ls != nil || err != nil {
+		t.Fatalf("not activated: got %v, %v", ls, err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	f, err := l.File()
+	if err != nil {
+		t.Fatalf("file of listener: %v", err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), stubEnv+"=1", envListenFds+"=1", envListenNames+"=socks")
+	cmd.ExtraFiles = []*os.File{f}
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer cmd.Wait()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	if string(b) != "activated" {
+		t.Fatalf("read: got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,566 @@
+package m_transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tlsRecordChangeCipherSpec byte = 0x14
+	tlsRecordHandshake        byte = 0x16
+	tlsRecordApplicationData  byte = 0x17
+
+	tlsMaxRecordPayload = 16384
+	obfsHelloMaxPayload = 8192 // max bytes of first payload carried in ClientHello
+)
+
+var (
+	ErrNotObfs   = errors.New("obfs: unexpected handshake")
+	ErrBadRecord = errors.New("obfs: bad tls record")
+)
+
+// cipher suites and extensions of ClientHello sent by simple-obfs
+var (
+	obfsCipherSuites = []byte{
+		0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+		0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+		0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+		0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+	}
+	obfsHelloExts = []byte{
+		// ec point formats
+		0x00, 0x0b, 0x00, 0x04, 0x03, 0x01, 0x00, 0x02,
+		// elliptic curves
+		0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18,
+		// signature algorithms
+		0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e,
+		0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, 0x01, 0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02,
+		0x04, 0x03, 0x03, 0x01, 0x03, 0x02, 0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+		// encrypt then mac
+		0x00, 0x16, 0x00, 0x00,
+		// extended master secret
+		0x00, 0x17, 0x00, 0x00,
+	}
+	// extensions of ServerHello: renegotiation info, extended master
+	// secret and ec point formats
+	obfsServerHelloExts = []byte{
+		0xff, 0x01, 0x00, 0x01, 0x00,
+		0x00, 0x17, 0x00, 0x00,
+		0x00, 0x0b, 0x00, 0x02, 0x01, 0x00,
+	}
+)
+
+// ObfsOptions is the settings of obfs transports
+type ObfsOptions struct {
+	// server side
+	HandshakeTimeout time.Duration // max time to read handshake of client, no limit if 0
+
+	// client side
+	Host string // host shown in handshake, comma separated to pick one randomly; address of server if empty
+	URI  string // path of HTTP request, "/" if empty
+}
+
+type obfsHTTP struct {
+	opts ObfsOptions
+}
+
+// NewObfsHTTP creates a transport compatible with simple-obfs in http mode.
+// The first payload in each direction is carried in body of a fake
+// websocket upgrade request and response, the rest goes over raw connection.
+func NewObfsHTTP(opts *ObfsOptions) Transport {
+	t := &obfsHTTP{opts: *opts}
+	if t.opts.URI == "" {
+		t.opts.URI = "/"
+	}
+	return t
+}
+
+func (t *obfsHTTP) Client(c net.Conn) net.Conn {
+	return &obfsHTTPConn{Conn: c, opts: &t.opts, client: true, br: bufio.NewReader(c)}
+}
+
+func (t *obfsHTTP) Server(c net.Conn) net.Conn {
+	hr := newHeaderReader(c)
+	return &obfsHTTPConn{Conn: c, opts: &t.opts, br: bufio.NewReader(hr), hr: hr}
+}
+
+type obfsTLS struct {
+	opts ObfsOptions
+}
+
+// NewObfsTLS creates a transport compatible with simple-obfs in tls mode.
+// The first payload of client is carried in session ticket of a fake
+// ClientHello, and the first one of server in a fake encrypted handshake
+// message after ServerHello. The rest goes in application data records.
+func NewObfsTLS(opts *ObfsOptions) Transport {
+	return &obfsTLS{opts: *opts}
+}
+
+func (t *obfsTLS) Client(c net.Conn) net.Conn {
+	return &obfsTLSConn{Conn: c, opts: &t.opts, client: true, br: bufio.NewReader(c)}
+}
+
+func (t *obfsTLS) Server(c net.Conn) net.Conn {
+	hr := newHeaderReader(c)
+	return &obfsTLSConn{Conn: c, opts: &t.opts, br: bufio.NewReader(hr), hr: hr}
+}
+
+// obfsHTTPConn hides the first payload in HTTP messages. Client sends
+// request on the first Write, server answers it on the first Write after
+// request is read.
+type obfsHTTPConn struct {
+	net.Conn
+	opts   *ObfsOptions
+	client bool
+	br     *bufio.Reader
+	hr     *headerReader // limits header of request on server side
+
+	readOnce sync.Once
+	readErr  error  // error of reading header
+	key      string // Sec-WebSocket-Key of request
+
+	writeLock sync.Mutex
+	wrote     bool
+}
+
+// NetConn returns the underlying connection
+func (c *obfsHTTPConn) NetConn() net.Conn { return c.Conn }
+
+// readHeader reads header of response on client side, or request on server
+// side. Payload in body is left in buffer.
+func (c *obfsHTTPConn) readHeader() {
+	if c.client {
+		resp, err := http.ReadResponse(c.br, nil)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			c.readErr = ErrNotObfs
+		}
+		return
+	}
+
+	done := serverHandshake(c.Conn, c.opts.HandshakeTimeout, c.hr)
+	req, err := http.ReadRequest(c.br)
+	done()
+	if err != nil {
+		c.readErr = err
+		return
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		httpFallback(c.Conn, http.StatusNotFound)
+		c.readErr = ErrNotObfs
+		return
+	}
+	c.key = req.Header.Get("Sec-WebSocket-Key")
+}
+
+func (c *obfsHTTPConn) Read(b []byte) (int, error) {
+	c.readOnce.Do(c.readHeader)
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return c.br.Read(b)
+}
+
+func (c *obfsHTTPConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.wrote {
+		return c.Conn.Write(b)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var hdr string
+	if c.client {
+		hdr = c.requestHeader(len(b))
+	} else {
+		// response follows request
+		c.readOnce.Do(c.readHeader)
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		hdr = c.responseHeader()
+	}
+	c.wrote = true
+
+	n, err := c.Conn.Write(append([]byte(hdr), b...))
+	if n -= len(hdr); n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (c *obfsHTTPConn) requestHeader(length int) string {
+	host := obfsHost(c.opts, c.Conn)
+	if _, port, err := net.SplitHostPort(c.Conn.RemoteAddr().String()); err == nil && port != "80" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", c.opts.URI)
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "User-Agent: curl/7.%d.%d\r\n", randn(51), randn(3))
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", randBase64(16))
+	fmt.Fprintf(&b, "Content-Length: %d\r\n", length)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func (c *obfsHTTPConn) responseHeader() string {
+	accept := randBase64(20)
+	if c.key != "" {
+		accept = acceptKey(c.key)
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(&b, "Server: nginx/1.%d.%d\r\n", randn(11), randn(12))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(http.TimeFormat))
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Accept: %s\r\n", accept)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// obfsTLSConn hides stream in fake TLS records. Client sends ClientHello
+// on the first Write, server answers with ServerHello on the first Write
+// after ClientHello is read.
+type obfsTLSConn struct {
+	net.Conn
+	opts   *ObfsOptions
+	client bool
+	br     *bufio.Reader
+	hr     *headerReader // limits ClientHello on server side
+
+	readOnce  sync.Once
+	readErr   error  // error of reading handshake
+	sessionID []byte // session id of ClientHello, echoed in ServerHello
+	pending   []byte // payload carried in ClientHello
+	remain    int    // payload bytes left in current record
+
+	writeLock sync.Mutex
+	wrote     bool
+}
+
+// NetConn returns the underlying connection
+func (c *obfsTLSConn) NetConn() net.Conn { return c.Conn }
+
+// readHandshake reads ServerHello on client side, or ClientHello on server
+// side.
+func (c *obfsTLSConn) readHandshake() {
+	if !c.client {
+		done := serverHandshake(c.Conn, c.opts.HandshakeTimeout, c.hr)
+		defer done()
+	}
+	typ, body, err := c.readRecord()
+	if err != nil {
+		c.readErr = err
+		return
+	}
+	if typ != tlsRecordHandshake || len(body) < 4 {
+		c.readErr = ErrNotObfs
+		return
+	}
+
+	if c.client {
+		if body[0] != 0x02 { // server hello
+			c.readErr = ErrNotObfs
+		}
+		return
+	}
+	if body[0] != 0x01 { // client hello
+		c.readErr = ErrNotObfs
+		return
+	}
+	c.readErr = c.parseClientHello(body[4:])
+}
+
+// parseClientHello takes session id and payload in session ticket
+func (c *obfsTLSConn) parseClientHello(p []byte) error {
+	// version and random
+	if len(p) < 34 {
+		return ErrNotObfs
+	}
+	p = p[34:]
+
+	sid, p, ok := readVector(p, 1)
+	if !ok {
+		return ErrNotObfs
+	}
+	c.sessionID = sid
+	if _, p, ok = readVector(p, 2); !ok { // cipher suites
+		return ErrNotObfs
+	}
+	if _, p, ok = readVector(p, 1); !ok { // compression methods
+		return ErrNotObfs
+	}
+	exts, _, ok := readVector(p, 2)
+	if !ok {
+		return ErrNotObfs
+	}
+
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		var data []byte
+		if data, exts, ok = readVector(exts[2:], 2); !ok {
+			return ErrNotObfs
+		}
+		if typ == 0x0023 { // session ticket
+			c.pending = data
+			return nil
+		}
+	}
+	return ErrNotObfs
+}
+
+// readVector reads a vector with length prefix of n bytes
+func readVector(p []byte, n int) ([]byte, []byte, bool) {
+	if len(p) < n {
+		return nil, nil, false
+	}
+	var l int
+	for i := 0; i < n; i++ {
+		l = l<<8 | int(p[i])
+	}
+	p = p[n:]
+	if len(p) < l {
+		return nil, nil, false
+	}
+	return p[:l], p[l:], true
+}
+
+func (c *obfsTLSConn) readRecordHeader() (byte, int, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	if hdr[1] != 0x03 {
+		return 0, 0, ErrBadRecord
+	}
+	return hdr[0], int(binary.BigEndian.Uint16(hdr[3:])), nil
+}
+
+// readRecord reads a whole record of handshake, which is not larger than
+// max plaintext of TLS.
+func (c *obfsTLSConn) readRecord() (byte, []byte, error) {
+	typ, n, err := c.readRecordHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > tlsMaxRecordPayload {
+		return 0, nil, ErrBadRecord
+	}
+	body := make([]byte, n)
+	if _, err = io.ReadFull(c.br, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// Read reads payload of records, skipping ChangeCipherSpec.
+func (c *obfsTLSConn) Read(b []byte) (int, error) {
+	c.readOnce.Do(c.readHandshake)
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	for c.remain == 0 {
+		typ, n, err := c.readRecordHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case tlsRecordApplicationData, tlsRecordHandshake:
+			c.remain = n
+		case tlsRecordChangeCipherSpec:
+			if _, err = c.br.Discard(n); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, ErrBadRecord
+		}
+	}
+
+	if len(b) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.br.Read(b)
+	c.remain -= n
+	return n, err
+}
+
+func (c *obfsTLSConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buf []byte
+	payload := b
+	if !c.wrote {
+		if c.client {
+			first := payload
+			if len(first) > obfsHelloMaxPayload {
+				first = first[:obfsHelloMaxPayload]
+			}
+			buf = c.clientHello(first)
+			payload = payload[len(first):]
+		} else {
+			// ServerHello follows ClientHello
+			c.readOnce.Do(c.readHandshake)
+			if c.readErr != nil {
+				return 0, c.readErr
+			}
+			first := payload
+			if len(first) > tlsMaxRecordPayload {
+				first = first[:tlsMaxRecordPayload]
+			}
+			buf = c.serverHello()
+			buf = appendRecord(buf, tlsRecordChangeCipherSpec, []byte{0x01})
+			buf = appendRecord(buf, tlsRecordHandshake, first)
+			payload = payload[len(first):]
+		}
+		c.wrote = true
+	}
+
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > tlsMaxRecordPayload {
+			n = tlsMaxRecordPayload
+		}
+		buf = appendRecord(buf, tlsRecordApplicationData, payload[:n])
+		payload = payload[n:]
+	}
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *obfsTLSConn) clientHello(payload []byte) []byte {
+	host := obfsHost(c.opts, c.Conn)
+
+	b := make([]byte, 0, 256+len(obfsCipherSuites)+len(obfsHelloExts)+len(host)+len(payload))
+	b = append(b, tlsRecordHandshake, 0x03, 0x01, 0, 0) // length filled later
+	b = append(b, 0x01, 0, 0, 0)                        // client hello, length filled later
+	b = append(b, 0x03, 0x03)
+	b = appendRandom(b)
+	b = append(b, 32)
+	b = append(b, randBytes(32)...) // session id
+	b = appendUint16(b, len(obfsCipherSuites))
+	b = append(b, obfsCipherSuites...)
+	b = append(b, 0x01, 0x00) // null compression
+
+	extStart := len(b)
+	b = append(b, 0, 0) // length filled later
+	// session ticket carrying payload
+	b = appendUint16(b, 0x0023)
+	b = appendUint16(b, len(payload))
+	b = append(b, payload...)
+	// server name
+	b = appendUint16(b, 0x0000)
+	b = appendUint16(b, len(host)+5)
+	b = appendUint16(b, len(host)+3)
+	b = append(b, 0x00) // host name
+	b = appendUint16(b, len(host))
+	b = append(b, host...)
+	b = append(b, obfsHelloExts...)
+
+	binary.BigEndian.PutUint16(b[extStart:], uint16(len(b)-extStart-2))
+	binary.BigEndian.PutUint16(b[3:], uint16(len(b)-5))
+	binary.BigEndian.PutUint16(b[7:], uint16(len(b)-9))
+	return b
+}
+
+func (c *obfsTLSConn) serverHello() []byte {
+	var body []byte
+	body = append(body, 0x03, 0x03)
+	body = appendRandom(body)
+	body = append(body, byte(len(c.sessionID)))
+	body = append(body, c.sessionID...)
+	body = append(body, 0xcc, 0xa8) // ECDHE-RSA-CHACHA20-POLY1305
+	body = append(body, 0x00)       // null compression
+	body = appendUint16(body, len(obfsServerHelloExts))
+	body = append(body, obfsServerHelloExts...)
+
+	hs := []byte{0x02, 0, 0, 0} // server hello
+	binary.BigEndian.PutUint16(hs[2:], uint16(len(body)))
+	hs = append(hs, body...)
+
+	b := []byte{tlsRecordHandshake, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(b[3:], uint16(len(hs)))
+	return append(b, hs...)
+}
+
+func appendRecord(b []byte, typ byte, payload []byte) []byte {
+	b = append(b, typ, 0x03, 0x03)
+	b = appendUint16(b, len(payload))
+	return append(b, payload...)
+}
+
+func appendUint16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendRandom appends random of hello, unix time and 28 random bytes
+func appendRandom(b []byte) []byte {
+	var t [4]byte
+	binary.BigEndian.PutUint32(t[:], uint32(time.Now().Unix()))
+	b = append(b, t[:]...)
+	return append(b, randBytes(28)...)
+}
+
+// obfsHost picks host shown in handshake
+func obfsHost(opts *ObfsOptions, c net.Conn) string {
+	var hosts []string
+	for _, h := range strings.Split(opts.Host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) > 0 {
+		return hosts[randn(len(hosts))]
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	io.ReadFull(rand.Reader, b)
+	return b
+}
+
+func randBase64(n int) string {
+	return base64.StdEncoding.EncodeToString(randBytes(n))
+}
+
+// randn returns a random number in [0, n)
+func randn(n int) int {
+	return int(binary.BigEndian.Uint32(randBytes(4)) % uint32(n))
+}
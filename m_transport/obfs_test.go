@@ -0,0 +1,330 @@
+package m_transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handshakes of simple-obfs, laid out by obfs_http.c and obfs_tls.c of it
+// with random fields fixed. obfs-local talks to server at port 8139 with
+// obfs-host www.bing.com, and both sides send a payload of 5 bytes.
+const (
+	fixtureHTTPRequest = "GET / HTTP/1.1\r\n" +
+		"Host: www.bing.com:8139\r\n" +
+		"User-Agent: curl/7.42.1\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello"
+	fixtureHTTPResponse = "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Server: nginx/1.9.7\r\n" +
+		"Date: Mon, 19 Oct 2026 08:00:00 GMT\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: 4yd0cS1vzs6wrlQ+Ts9jLcIbzQM=\r\n" +
+		"\r\n" +
+		"world"
+
+	fixtureClientHello = "16030100e5" + // handshake record
+		"010000e1" + "0303" + // client hello, tls 1.2
+		"5f5e1000" + "8f3ac1d25b7e09e6a4c3f1720d5b98e1c6a72f403d9e8b155cf0a61e" + // random
+		"20" + "2c91d7a4e05f3b68c1a97e24f60d8b35a7c2e91f4b06d38a5fe17c29b40a6d13" + // session id
+		"0038" + "c02cc030009fcca9cca8ccaac02bc02f009ec024c028006bc023c0270067c00a" +
+		"c0140039c009c0130033009d009c003d003c0035002f00ff" + // cipher suites
+		"0100" + // null compression
+		"0060" +
+		"0023" + "0005" + "68656c6c6f" + // session ticket carrying payload
+		"0000" + "0011" + "000f" + "00" + "000c" + "7777772e62696e672e636f6d" + // server name
+		"000b000403010002" + // ec point formats
+		"000a000a0008001d001700190018" + // elliptic curves
+		"000d0020001e060106020603050105020503040104020403030103020303020102020203" + // signature algorithms
+		"00160000" + // encrypt then mac
+		"00170000" // extended master secret
+	fixtureServerHello = "160301005b" + // handshake record
+		"02000057" + "0303" + // server hello, tls 1.2
+		"5f5e1001" + "d41c7a0e93b58f26c07d1ea4395bf8620ae7c31d94f5082b6ec3a719" + // random
+		"20" + "2c91d7a4e05f3b68c1a97e24f60d8b35a7c2e91f4b06d38a5fe17c29b40a6d13" + // session id of client
+		"cca8" + "00" + // cipher suite, null compression
+		"000f" + "ff01000100" + "00170000" + "000b00020100" + // extensions
+		"140303000101" + // change cipher spec
+		"1603030005" + "776f726c64" // encrypted handshake carrying payload
+)
+
+// positions of random fields in tls fixtures
+var (
+	fixtureClientHelloRandom = [][2]int{{11, 43}, {44, 76}} // random and session id
+	fixtureServerHelloRandom = [][2]int{{11, 43}}
+)
+
+// fixtureConn shows remote address of server in fixtures
+type fixtureConn struct {
+	net.Conn
+}
+
+func (fixtureConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8139}
+}
+
+// readHTTP reads header of a HTTP message and body of n bytes
+func readHTTP(t *testing.T, br *bufio.Reader, n int) string {
+	var b strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read header: %v", err)
+		}
+		b.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	b.Write(body)
+	return b.String()
+}
+
+// checkHTTPFixture compares message with fixture line by line, only names
+// of headers in random are compared.
+func checkHTTPFixture(t *testing.T, got, fixture string, random ...string) {
+	gotLines, lines := strings.Split(got, "\r\n"), strings.Split(fixture, "\r\n")
+	if len(gotLines) != len(lines) {
+		t.Fatalf("got %q, want layout of %q", got, fixture)
+	}
+	for i, line := range lines {
+		name := strings.SplitN(line, ":", 2)[0]
+		for _, r := range random {
+			if name == r {
+				line, gotLines[i] = name, strings.SplitN(gotLines[i], ":", 2)[0]
+			}
+		}
+		if gotLines[i] != line {
+			t.Fatalf("line %d: got %q, want %q", i, gotLines[i], line)
+		}
+	}
+}
+
+// checkTLSFixture compares records with fixture, skipping random fields.
+func checkTLSFixture(t *testing.T, got []byte, fixture string, random [][2]int) {
+	want, err := hex.DecodeString(fixture)
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+	got = append([]byte(nil), got...)
+	for _, r := range random {
+		copy(got[r[0]:r[1]], want[r[0]:r[1]])
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x\nwant %x", got, want)
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	return b
+}
+
+func TestObfsEcho(t *testing.T) {
+	opts := &ObfsOptions{Host: "www.bing.com"}
+	for name, tr := range map[string]Transport{
+		"http": NewObfsHTTP(opts),
+		"tls":  NewObfsTLS(opts),
+	} {
+		l := serveEcho(t, tr)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		cc := tr.Client(c)
+		cc.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// the first write goes in handshake, the second spans records
+		for _, msg := range [][]byte{[]byte("hello obfs"), bytes.Repeat([]byte("x"), 70000)} {
+			go cc.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(cc, got); err != nil {
+				t.Fatalf("%s: read: %v", name, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("%s: echo mismatch", name)
+			}
+		}
+		cc.Close()
+		l.Close()
+	}
+}
+
+// TestObfsHTTPRequest checks request of client is a valid HTTP request
+// carrying the first payload in body.
+func TestObfsHTTPRequest(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	cc := NewObfsHTTP(&ObfsOptions{Host: "www.bing.com", URI: "/obfs"}).Client(c)
+	go cc.Write([]byte("payload"))
+
+	req, err := http.ReadRequest(bufio.NewReader(s))
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.URL.Path != "/obfs" || req.Host != "www.bing.com" ||
+		req.Header.Get("Upgrade") != "websocket" || string(body) != "payload" {
+		t.Fatalf("unexpected request: %s %s %v %q", req.Host, req.URL, req.Header, body)
+	}
+	cc.Close()
+}
+
+// TestObfsTLSClientHello checks ClientHello of client is accepted by a
+// real TLS stack.
+func TestObfsTLSClientHello(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	cc := NewObfsTLS(&ObfsOptions{Host: "www.bing.com"}).Client(c)
+	defer cc.Close()
+	go func() {
+		cc.Write([]byte("payload"))
+		io.Copy(io.Discard, c) // drain alert of server
+	}()
+
+	errDone := errors.New("done")
+	var hello *tls.ClientHelloInfo
+	ts := tls.Server(s, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errDone
+		},
+	})
+	ts.Handshake()
+	if hello == nil || hello.ServerName != "www.bing.com" {
+		t.Fatalf("unexpected client hello: %+v", hello)
+	}
+}
+
+func TestObfsHTTPFallback(t *testing.T) {
+	l := serveEcho(t, NewObfsHTTP(&ObfsOptions{}))
+	defer l.Close()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("fallback: got %d", resp.StatusCode)
+	}
+}
+
+func TestObfsHTTPFixture(t *testing.T) {
+	tr := NewObfsHTTP(&ObfsOptions{Host: "www.bing.com"})
+	buf := make([]byte, 16)
+
+	// server parses request of simple-obfs and answers in its layout
+	c, s := net.Pipe()
+	sc := tr.Server(s)
+	go c.Write([]byte(fixtureHTTPRequest))
+	n, err := sc.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("server read: %q %v", buf[:n], err)
+	}
+	go sc.Write([]byte("world"))
+	got := readHTTP(t, bufio.NewReader(c), 5)
+	checkHTTPFixture(t, got, fixtureHTTPResponse, "Server", "Date", "Sec-WebSocket-Accept")
+	sc.Close()
+
+	// client sends request in layout of simple-obfs and parses its response
+	c, s = net.Pipe()
+	cc := tr.Client(fixtureConn{c})
+	go cc.Write([]byte("hello"))
+	br := bufio.NewReader(s)
+	got = readHTTP(t, br, 5)
+	checkHTTPFixture(t, got, fixtureHTTPRequest, "User-Agent", "Sec-WebSocket-Key")
+	go s.Write([]byte(fixtureHTTPResponse))
+	n, err = cc.Read(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("client read: %q %v", buf[:n], err)
+	}
+	cc.Close()
+}
+
+func TestObfsTLSFixture(t *testing.T) {
+	tr := NewObfsTLS(&ObfsOptions{Host: "www.bing.com"})
+	clientHello := mustDecodeHex(t, fixtureClientHello)
+	serverHello := mustDecodeHex(t, fixtureServerHello)
+	buf := make([]byte, 16)
+
+	// server parses ClientHello of simple-obfs and answers in its layout
+	c, s := net.Pipe()
+	sc := tr.Server(s)
+	go c.Write(clientHello)
+	n, err := sc.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("server read: %q %v", buf[:n], err)
+	}
+	go sc.Write([]byte("world"))
+	got := make([]byte, len(serverHello))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatalf("read server hello: %v", err)
+	}
+	checkTLSFixture(t, got, fixtureServerHello, fixtureServerHelloRandom)
+	sc.Close()
+
+	// client sends ClientHello in layout of simple-obfs and parses its answer
+	c, s = net.Pipe()
+	cc := tr.Client(fixtureConn{c})
+	go cc.Write([]byte("hello"))
+	got = make([]byte, len(clientHello))
+	if _, err = io.ReadFull(s, got); err != nil {
+		t.Fatalf("read client hello: %v", err)
+	}
+	checkTLSFixture(t, got, fixtureClientHello, fixtureClientHelloRandom)
+	go s.Write(serverHello)
+	n, err = cc.Read(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("client read: %q %v", buf[:n], err)
+	}
+	cc.Close()
+}
+
+func TestObfsHandshakeLimits(t *testing.T) {
+	opts := &ObfsOptions{HandshakeTimeout: 200 * time.Millisecond}
+	for name, tr := range map[string]Transport{
+		"http": NewObfsHTTP(opts),
+		"tls":  NewObfsTLS(opts),
+	} {
+		// client stalling in handshake
+		if err := serverRead(t, tr, nil); err == nil {
+			t.Fatalf("%s: handshake should time out", name)
+		}
+	}
+
+	// endless header
+	req := "GET / HTTP/1.1\r\nHost: www.bing.com\r\nX-Pad: " + strings.Repeat("a", 64<<10)
+	if err := serverRead(t, NewObfsHTTP(&ObfsOptions{}), []byte(req)); !errors.Is(err, ErrHandshakeTooLarge) {
+		t.Fatalf("http: got %v, want %v", err, ErrHandshakeTooLarge)
+	}
+	// ClientHello larger than a tls record
+	hello := []byte{tlsRecordHandshake, 0x03, 0x01, 0xff, 0xff}
+	if err := serverRead(t, NewObfsTLS(&ObfsOptions{}), hello); err != ErrBadRecord {
+		t.Fatalf("tls: got %v, want %v", err, ErrBadRecord)
+	}
+}
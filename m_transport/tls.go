@@ -0,0 +1,160 @@
+package m_transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPinMismatch means certificate of server does not match pinned fingerprint
+var ErrPinMismatch = errors.New("tls: certificate fingerprint mismatch")
+
+// TLSOptions is the settings of TLS transport
+type TLSOptions struct {
+	// server side
+	CertFile         string        // certificate file
+	KeyFile          string        // private key file
+	HandshakeTimeout time.Duration // max time of handshake, no limit if 0
+
+	// client side
+	ServerName string   // SNI, also used to verify certificate
+	ALPN       []string // protocols for ALPN
+	PinSHA256  string   // hex sha256 fingerprint of server certificate
+	CAFile     string   // custom CA to verify server certificate
+}
+
+type tlsTransport struct {
+	client  *tls.Config
+	server  *tls.Config
+	timeout time.Duration // handshake timeout of server side
+}
+
+// NewTLS creates a TLS transport. Server config is built only if
+// certificate and key are given.
+func NewTLS(opts *TLSOptions) (Transport, error) {
+	t := &tlsTransport{timeout: opts.HandshakeTimeout}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: load key pair: %v", err)
+		}
+		t.server = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   opts.ALPN,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	client := &tls.Config{
+		ServerName: opts.ServerName,
+		NextProtos: opts.ALPN,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificate found in %s", opts.CAFile)
+		}
+		client.RootCAs = pool
+	}
+	if opts.PinSHA256 != "" {
+		pin, err := parseFingerprint(opts.PinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		if opts.CAFile == "" {
+			// pinned certificate is trusted without a chain
+			client.InsecureSkipVerify = true
+		}
+		client.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return ErrPinMismatch
+			}
+			return nil
+		}
+	}
+	t.client = client
+
+	return t, nil
+}
+
+func (t *tlsTransport) Client(c net.Conn) net.Conn { return tls.Client(c, t.client) }
+
+func (t *tlsTransport) Server(c net.Conn) net.Conn {
+	config := t.server
+	if config == nil {
+		// refuse handshake, no certificate configured
+		config = &tls.Config{}
+	}
+	tc := tls.Server(c, config)
+	if t.timeout <= 0 {
+		return tc
+	}
+	return &serverConn{Conn: tc, timeout: t.timeout}
+}
+
+// serverConn runs handshake of server side within timeout on first read or
+// write, so that a client stalling in handshake does not hold the
+// connection.
+type serverConn struct {
+	*tls.Conn
+	timeout time.Duration
+	once    sync.Once
+	err     error
+}
+
+func (c *serverConn) handshake() error {
+	c.once.Do(func() {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+		c.err = c.Conn.Handshake()
+		c.Conn.SetDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// Fingerprint returns hex sha256 fingerprint of a DER encoded certificate.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseFingerprint accepts hex with or without colons
+func parseFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("tls: invalid sha256 fingerprint %q", s)
+	}
+	return b, nil
+}
@@ -0,0 +1,186 @@
+package m_transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// genCert generates a self-signed certificate for name, writes it and its
+// key into dir, and returns paths of them and DER of certificate.
+func genCert(t *testing.T, dir, name string) (string, string, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, der
+}
+
+// tlsPair runs a handshake between client and server side of transports,
+// echoing one message, and returns the client connection state.
+func tlsPair(t *testing.T, server, client Transport) (tls.ConnectionState, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sc := server.Server(c)
+		defer sc.Close()
+		io.Copy(sc, sc)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := client.Client(c)
+	defer cc.Close()
+
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = cc.Write([]byte("hello")); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(cc, b); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	if string(b) != "hello" {
+		t.Fatalf("echo: got %q", b)
+	}
+	return cc.(*tls.Conn).ConnectionState(), nil
+}
+
+func TestTLSWithCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := genCert(t, dir, "proxy.test")
+
+	server, err := NewTLS(&TLSOptions{CertFile: certFile, KeyFile: keyFile, ALPN: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	client, err := NewTLS(&TLSOptions{ServerName: "proxy.test", CAFile: certFile, ALPN: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	state, err := tlsPair(t, server, client)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("alpn: got %q, want http/1.1", state.NegotiatedProtocol)
+	}
+	if state.ServerName != "proxy.test" {
+		t.Errorf("sni: got %q, want proxy.test", state.ServerName)
+	}
+}
+
+func TestTLSWrongServerName(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := genCert(t, dir, "proxy.test")
+
+	server, _ := NewTLS(&TLSOptions{CertFile: certFile, KeyFile: keyFile})
+	client, _ := NewTLS(&TLSOptions{ServerName: "other.test", CAFile: certFile})
+	if _, err := tlsPair(t, server, client); err == nil {
+		t.Fatal("handshake should fail with wrong server name")
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := genCert(t, dir, "proxy.test")
+
+	server, _ := NewTLS(&TLSOptions{CertFile: certFile, KeyFile: keyFile, HandshakeTimeout: 200 * time.Millisecond})
+	client, _ := NewTLS(&TLSOptions{ServerName: "proxy.test", CAFile: certFile})
+	if _, err := tlsPair(t, server, client); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	// client stalling in handshake
+	c, s := net.Pipe()
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Server(s).Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("handshake should time out")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handshake not timed out")
+	}
+}
+
+func TestTLSPin(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, der := genCert(t, dir, "proxy.test")
+	_, _, otherDer := genCert(t, dir, "other.test")
+
+	server, _ := NewTLS(&TLSOptions{CertFile: certFile, KeyFile: keyFile})
+
+	client, err := NewTLS(&TLSOptions{ServerName: "cdn.example.com", PinSHA256: Fingerprint(der)})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if _, err = tlsPair(t, server, client); err != nil {
+		t.Fatalf("handshake with pinned certificate: %v", err)
+	}
+
+	client, _ = NewTLS(&TLSOptions{ServerName: "proxy.test", PinSHA256: Fingerprint(otherDer)})
+	if _, err = tlsPair(t, server, client); err == nil {
+		t.Fatal("handshake should fail with wrong pin")
+	}
+}
+
+func TestTLSInvalidOptions(t *testing.T) {
+	if _, err := NewTLS(&TLSOptions{PinSHA256: "abcd"}); err == nil {
+		t.Error("invalid fingerprint should fail")
+	}
+	if _, err := NewTLS(&TLSOptions{CertFile: "nonexist.pem", KeyFile: "nonexist.key"}); err == nil {
+		t.Error("missing key pair should fail")
+	}
+}
@@ -0,0 +1,98 @@
+// Package m_transport implements transports carrying enciphered streams
+// between local and server, e.g. TLS. A transport wraps the raw connection
+// beneath the cipher, so it works with every cipher.
+package m_transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// max bytes read from client before its handshake is read on server side,
+// including read ahead of buffer
+const handshakeReadLimit = 24 << 10
+
+// Transport wraps raw connections between local and server
+type Transport interface {
+	// Client wraps a connection dialed by local
+	Client(net.Conn) net.Conn
+	// Server wraps a connection accepted by server
+	Server(net.Conn) net.Conn
+}
+
+// ErrTransportNotSupported occurs when a transport is not supported.
+var ErrTransportNotSupported = errors.New("transport not supported")
+
+// ErrHandshakeTooLarge occurs when handshake of client exceeds the limit.
+var ErrHandshakeTooLarge = errors.New("transport: handshake too large")
+
+// Raw transport carries streams over the raw connection
+var Raw Transport = raw{}
+
+type raw struct{}
+
+func (raw) Client(c net.Conn) net.Conn { return c }
+func (raw) Server(c net.Conn) net.Conn { return c }
+
+type chain []Transport
+
+// Chain creates a transport wrapping connection with ts in order, the first
+// one is the nearest to raw connection.
+func Chain(ts ...Transport) Transport { return chain(ts) }
+
+func (ch chain) Client(c net.Conn) net.Conn {
+	for _, t := range ch {
+		c = t.Client(c)
+	}
+	return c
+}
+
+func (ch chain) Server(c net.Conn) net.Conn {
+	for _, t := range ch {
+		c = t.Server(c)
+	}
+	return c
+}
+
+// headerReader limits bytes read from connection while server reads
+// handshake of client, so that a client can not feed an endless header.
+type headerReader struct {
+	r     io.Reader
+	limit int // bytes left, no limit if negative
+}
+
+func newHeaderReader(r io.Reader) *headerReader {
+	return &headerReader{r: r, limit: -1}
+}
+
+func (r *headerReader) Read(b []byte) (int, error) {
+	if r.limit < 0 {
+		return r.r.Read(b)
+	}
+	if r.limit == 0 {
+		return 0, ErrHandshakeTooLarge
+	}
+	if len(b) > r.limit {
+		b = b[:r.limit]
+	}
+	n, err := r.r.Read(b)
+	r.limit -= n
+	return n, err
+}
+
+// serverHandshake sets deadline of c and limit of hr for reading handshake
+// of client, the returned func lifts both once handshake is done.
+func serverHandshake(c net.Conn, timeout time.Duration, hr *headerReader) func() {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	hr.limit = handshakeReadLimit
+	return func() {
+		hr.limit = -1
+		if timeout > 0 {
+			c.SetDeadline(time.Time{})
+		}
+	}
+}
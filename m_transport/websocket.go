@@ -0,0 +1,405 @@
+package m_transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+
+	wsMaxControlPayload = 125
+	wsCloseTimeout      = time.Second // time for sending close frame
+)
+
+var (
+	ErrNotWebSocket = errors.New("websocket: not a websocket upgrade")
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadFrame     = errors.New("websocket: bad frame")
+)
+
+// WebSocketOptions is the settings of WebSocket transport
+type WebSocketOptions struct {
+	Path string // path of upgrade request, "/" if empty
+
+	// server side
+	HandshakeTimeout time.Duration // max time of upgrade, no limit if 0
+
+	// client side
+	Host      string // Host header of upgrade request, address of server if empty
+	EarlyData int    // max bytes of first payload carried in upgrade request, 0 to disable
+}
+
+type wsTransport struct {
+	opts WebSocketOptions
+}
+
+// NewWebSocket creates a WebSocket transport. Enciphered stream is carried
+// in binary frames. With early data, the first payload written by client
+// is sent in Sec-WebSocket-Protocol header of upgrade request.
+func NewWebSocket(opts *WebSocketOptions) Transport {
+	t := &wsTransport{opts: *opts}
+	if t.opts.Path == "" {
+		t.opts.Path = "/"
+	}
+	return t
+}
+
+func (t *wsTransport) Client(c net.Conn) net.Conn {
+	return &wsConn{Conn: c, opts: &t.opts, client: true, br: bufio.NewReader(c)}
+}
+
+func (t *wsTransport) Server(c net.Conn) net.Conn {
+	hr := newHeaderReader(c)
+	return &wsConn{Conn: c, opts: &t.opts, br: bufio.NewReader(hr), hr: hr}
+}
+
+// wsConn carries a byte stream in WebSocket binary frames. Handshake is
+// done lazily by the first Write on client side or the first Read on server
+// side.
+type wsConn struct {
+	net.Conn
+	opts   *WebSocketOptions
+	client bool
+	br     *bufio.Reader
+	hr     *headerReader // limits upgrade request on server side
+
+	handshakeLock sync.Mutex
+	handshakeDone bool
+	handshakeErr  error
+	established   int32 // set to 1 after handshake succeeded
+
+	writeLock sync.Mutex
+
+	// state of reading frame
+	remain  uint64 // payload bytes left in current frame
+	masked  bool
+	mask    [4]byte
+	maskPos int
+	early   []byte // early data received in upgrade request
+	readErr error
+}
+
+// NetConn returns the underlying connection
+func (c *wsConn) NetConn() net.Conn { return c.Conn }
+
+// Handshake runs handshake without early data if not done yet.
+func (c *wsConn) Handshake() error {
+	_, err := c.handshake(nil)
+	return err
+}
+
+func (c *wsConn) handshake(early []byte) ([]byte, error) {
+	c.handshakeLock.Lock()
+	defer c.handshakeLock.Unlock()
+	if c.handshakeDone {
+		return early, c.handshakeErr
+	}
+	c.handshakeDone = true
+
+	if c.client {
+		early, c.handshakeErr = c.clientHandshake(early)
+	} else {
+		c.handshakeErr = c.serverHandshake()
+	}
+	if c.handshakeErr == nil {
+		atomic.StoreInt32(&c.established, 1)
+	}
+	return early, c.handshakeErr
+}
+
+// clientHandshake sends upgrade request carrying early data if enabled, and
+// returns payload not sent.
+func (c *wsConn) clientHandshake(payload []byte) ([]byte, error) {
+	var key [16]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return payload, err
+	}
+	secKey := base64.StdEncoding.EncodeToString(key[:])
+
+	host := c.opts.Host
+	if host == "" {
+		host = c.Conn.RemoteAddr().String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", c.opts.Path)
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", secKey)
+	b.WriteString("Sec-WebSocket-Version: 13\r\n")
+
+	var protocol string
+	if n := c.opts.EarlyData; n > 0 && len(payload) > 0 {
+		if n > len(payload) {
+			n = len(payload)
+		}
+		protocol = base64.RawURLEncoding.EncodeToString(payload[:n])
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+		payload = payload[n:]
+	}
+	b.WriteString("\r\n")
+
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return payload, err
+	}
+
+	resp, err := http.ReadResponse(c.br, nil)
+	if err != nil {
+		return payload, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(secKey) {
+		return payload, ErrBadHandshake
+	}
+	if protocol != "" && resp.Header.Get("Sec-WebSocket-Protocol") != protocol {
+		return payload, ErrBadHandshake
+	}
+	return payload, nil
+}
+
+// serverHandshake accepts upgrade request on configured path, answering
+// other requests with a normal HTTP response.
+func (c *wsConn) serverHandshake() error {
+	defer serverHandshake(c.Conn, c.opts.HandshakeTimeout, c.hr)()
+
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != c.opts.Path || key == "" ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		httpFallback(c.Conn, http.StatusNotFound)
+		return ErrNotWebSocket
+	}
+
+	protocol := req.Header.Get("Sec-WebSocket-Protocol")
+	if protocol != "" {
+		early, err := base64.RawURLEncoding.DecodeString(protocol)
+		if err != nil {
+			httpFallback(c.Conn, http.StatusBadRequest)
+			return ErrBadHandshake
+		}
+		c.early = early
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Accept: %s\r\n", acceptKey(key))
+	if protocol != "" {
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+	}
+	b.WriteString("\r\n")
+	_, err = io.WriteString(c.Conn, b.String())
+	return err
+}
+
+// httpFallback answers a request which is not expected with a plain response
+func httpFallback(w io.Writer, code int) {
+	body := fmt.Sprintf("%d %s\n", code, strings.ToLower(http.StatusText(code)))
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Write sends b in a binary frame.
+func (c *wsConn) Write(b []byte) (int, error) {
+	n := len(b)
+	b, err := c.handshake(b)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+	if err = c.writeFrame(wsOpBinary, b); err != nil {
+		return n - len(b), err
+	}
+	return n, nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	var hdr [14]byte
+	hdr[0] = 0x80 | op // FIN
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		hdr[1] = byte(l)
+	case l <= 0xFFFF:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+
+	frame := make([]byte, 0, n+4+len(payload))
+	if c.client {
+		// frames from client must be masked
+		hdr[1] |= 0x80
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, hdr[:n]...)
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, hdr[:n]...)
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Read reads payload of data frames, handling control frames.
+func (c *wsConn) Read(b []byte) (int, error) {
+	if _, err := c.handshake(nil); err != nil {
+		return 0, err
+	}
+	if len(c.early) > 0 {
+		n := copy(b, c.early)
+		c.early = c.early[n:]
+		return n, nil
+	}
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	for c.remain == 0 {
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remain -= uint64(n)
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextFrame reads header of next data frame, answering control frames.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// frames from client must be masked, and from server must not
+	if masked == c.client {
+		return ErrBadFrame
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remain, c.masked, c.mask, c.maskPos = length, masked, mask, 0
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlPayload {
+			return ErrBadFrame
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		}
+		return nil
+	}
+	return ErrBadFrame
+}
+
+// Close sends close frame if handshake is done, and closes connection.
+func (c *wsConn) Close() error {
+	if atomic.LoadInt32(&c.established) == 1 {
+		// unblock pending write, do not wait for a stuck peer
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000, normal closure
+	}
+	return c.Conn.Close()
+}
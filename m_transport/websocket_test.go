@@ -0,0 +1,130 @@
+package m_transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveEcho accepts connections on a new listener, wraps them with server
+// side of t and echoes back.
+func serveEcho(t *testing.T, tr Transport) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sc := tr.Server(c)
+				defer sc.Close()
+				io.Copy(sc, sc)
+			}()
+		}
+	}()
+	return l
+}
+
+// serverRead sends handshake of client to server side of tr, and returns
+// error of the first read of server.
+func serverRead(t *testing.T, tr Transport, handshake []byte) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	go c.Write(handshake)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tr.Server(s).Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("server read not returned")
+	}
+	return nil
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	for _, early := range []int{0, 16, 4096} {
+		server := NewWebSocket(&WebSocketOptions{Path: "/ws"})
+		client := NewWebSocket(&WebSocketOptions{Path: "/ws", Host: "cdn.example.com", EarlyData: early})
+		l := serveEcho(t, server)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		cc := client.Client(c)
+		cc.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// first write exercises early data, the second a large frame
+		for _, msg := range [][]byte{[]byte("hello websocket"), bytes.Repeat([]byte("x"), 70000)} {
+			go cc.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(cc, got); err != nil {
+				t.Fatalf("early %d: read: %v", early, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("early %d: echo mismatch", early)
+			}
+		}
+		cc.Close()
+		l.Close()
+	}
+}
+
+func TestWebSocketFallback(t *testing.T) {
+	l := serveEcho(t, NewWebSocket(&WebSocketOptions{Path: "/ws"}))
+	defer l.Close()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/index.html")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "not found") {
+		t.Fatalf("fallback: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestWebSocketWrongPath(t *testing.T) {
+	l := serveEcho(t, NewWebSocket(&WebSocketOptions{Path: "/ws"}))
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := NewWebSocket(&WebSocketOptions{Path: "/other"}).Client(c)
+	defer cc.Close()
+	if _, err = cc.Write([]byte("hello")); err != ErrBadHandshake {
+		t.Fatalf("write: got %v, want %v", err, ErrBadHandshake)
+	}
+}
+
+func TestWebSocketHandshakeLimits(t *testing.T) {
+	tr := NewWebSocket(&WebSocketOptions{HandshakeTimeout: 200 * time.Millisecond})
+
+	// client stalling in handshake
+	if err := serverRead(t, tr, nil); err == nil {
+		t.Fatal("handshake should time out")
+	}
+
+	// endless header
+	req := "GET / HTTP/1.1\r\nHost: proxy.test\r\nX-Pad: " + strings.Repeat("a", 64<<10)
+	if err := serverRead(t, NewWebSocket(&WebSocketOptions{}), []byte(req)); !errors.Is(err, ErrHandshakeTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrHandshakeTooLarge)
+	}
+}
@@ -0,0 +1,148 @@
+// Package m_upgrade replaces a running process with a new one of the same
+// executable without closing its listening sockets.
+//
+// The old process starts the new one with listeners passed as inherited
+// file descriptors, and waits for it to report readiness through a pipe,
+// after which the old process stops accepting and drains connections.
+package m_upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/zyong/miniproxygo/m_util"
+)
+
+const (
+	envListeners = "MINIPROXY_LISTENERS" // names of inherited listeners, separated by comma
+	envReady     = "MINIPROXY_READY_FD"  // fd of pipe to report readiness on
+
+	firstFd = 3 // first inherited fd after stdin, stdout and stderr
+)
+
+// ErrNotReady is returned by Start if new process exits before ready
+var ErrNotReady = errors.New("upgrade: new process exited before ready")
+
+var (
+	readyFile *os.File // pipe to old process, nil if not started by upgrade
+	readyLock sync.Mutex
+)
+
+// Start starts executable path with args and listeners in files, named by
+// names, and waits up to timeout for it to call Ready. The new process is
+// killed if it exits or is not ready in time.
+func Start(path string, args []string, names []string, files []*os.File, timeout time.Duration) (*os.Process, error) {
+	if len(names) != len(files) {
+		return nil, fmt.Errorf("upgrade: %d names of %d listeners", len(names), len(files))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), w)
+	cmd.Env = append(environ(),
+		envListeners+"="+strings.Join(names, ","),
+		envReady+"="+strconv.Itoa(firstFd+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		// read fails with EOF if new process exits before ready
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err == nil {
+			go cmd.Wait()
+			return cmd.Process, nil
+		}
+		if err == io.EOF {
+			err = ErrNotReady
+		}
+	case <-time.After(timeout):
+		err = fmt.Errorf("upgrade: new process not ready in %v", timeout)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil, err
+}
+
+// environ returns environment of process without variables of upgrade
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListeners+"=") && !strings.HasPrefix(kv, envReady+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// Inherit returns listeners passed by old process by names, or nil if
+// process is not started by upgrade. It must be called once before other
+// processes are started, so that inherited fds are not leaked to them.
+func Inherit() (map[string]net.Listener, error) {
+	names := os.Getenv(envListeners)
+	fd, err := strconv.Atoi(os.Getenv(envReady))
+	if names == "" || err != nil {
+		return nil, nil
+	}
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReady)
+
+	m_util.CloseOnExec(fd)
+	readyLock.Lock()
+	readyFile = os.NewFile(uintptr(fd), "ready")
+	readyLock.Unlock()
+
+	ls := make(map[string]net.Listener)
+	for i, name := range strings.Split(names, ",") {
+		// FileListener dups fd with close-on-exec set
+		f := os.NewFile(uintptr(firstFd+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("upgrade: inherit listener %s: %v", name, err)
+		}
+		ls[name] = l
+	}
+	return ls, nil
+}
+
+// Ready tells old process that this process is serving, so that old one
+// stops accepting and drains. It does nothing if process is not started by
+// upgrade or readiness is reported already.
+func Ready() error {
+	readyLock.Lock()
+	defer readyLock.Unlock()
+	if readyFile == nil {
+		return nil
+	}
+	_, err := readyFile.Write([]byte{1})
+	readyFile.Close()
+	readyFile = nil
+	return err
+}
@@ -0,0 +1,118 @@
+package m_upgrade
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// stubEnv makes test binary run as new process of upgrade, which reports
+// readiness and greets clients of inherited listener "main" if it is
+// "ready", or exits at once if it is "exit".
+const stubEnv = "M_UPGRADE_STUB"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(stubEnv) {
+	case "ready":
+		runStub()
+		return
+	case "exit":
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func runStub() {
+	ls, err := Inherit()
+	if err != nil || ls["main"] == nil {
+		os.Exit(2)
+	}
+	if err = Ready(); err != nil {
+		os.Exit(3)
+	}
+	for {
+		c, err := ls["main"].Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		c.Write([]byte("new"))
+		c.Close()
+	}
+}
+
+func startStub(t *testing.T, mode string, l *net.TCPListener) (*os.Process, error) {
+	f, err := l.File()
+	if err != nil {
+		t.Fatalf("file of listener: %v", err)
+	}
+	defer f.Close()
+
+	os.Setenv(stubEnv, mode)
+	defer os.Unsetenv(stubEnv)
+	return Start(os.Args[0], nil, []string{"main"}, []*os.File{f}, 5*time.Second)
+}
+
+func TestUpgrade(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	p, err := startStub(t, "ready", l)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer p.Kill()
+
+	// socket stays open after old process closes its listener
+	l.Close()
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := ioutil.ReadAll(c)
+		c.Close()
+		if string(b) != "new" {
+			t.Fatalf("read: got %q, %v", b, err)
+		}
+	}
+}
+
+func TestUpgradeNotReady(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	if _, err = startStub(t, "exit", l); err != ErrNotReady {
+		t.Fatalf("start: got %v, want %v", err, ErrNotReady)
+	}
+
+	// old process keeps serving
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c.Close()
+}
+
+func TestInheritNone(t *testing.T) {
+	ls, err := Inherit()
+	if ls != nil || err != nil {
+		t.Fatalf("inherit: got %v, %v", ls, err)
+	}
+	if err = Ready(); err != nil {
+		t.Fatalf("ready: %v", err)
+	}
+}
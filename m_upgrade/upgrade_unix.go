@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package m_upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signal asks process to upgrade
+var Signal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,8 @@
+package m_upgrade
+
+import (
+	"os"
+)
+
+// Signal asks process to upgrade, nil as fds are not inherited on windows
+var Signal os.Signal
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package m_util
+
+import (
+	"syscall"
+)
+
+// CloseOnExec marks inherited fd to be closed when a process is exec'd,
+// so that it is not leaked to child processes.
+func CloseOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
@@ -0,0 +1,4 @@
+package m_util
+
+// CloseOnExec does nothing, as fds are not inherited on windows
+func CloseOnExec(fd int) {}
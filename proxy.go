@@ -71,7 +71,7 @@ func main() {
 	log.Logger.Info("proxy[version:%s] start", version)
 
 	// load server config
-	confPath := path.Join(*confRoot, "proxy.conf")
+	confPath := path.Join(*confRoot, m_config.ConfFile)
 	config, err = m_config.ConfigLoad(confPath, *confRoot, m_config.SetDefaultConfig)
 
 	if err != nil {